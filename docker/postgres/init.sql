@@ -1,7 +1,241 @@
+CREATE TABLE tenants
+(
+    id SERIAL,
+    slug TEXT NOT NULL UNIQUE,
+    name TEXT NOT NULL,
+    max_products INTEGER NOT NULL DEFAULT 0,
+    max_page_size INTEGER NOT NULL DEFAULT 10,
+    settings JSONB NOT NULL DEFAULT '{}',
+    CONSTRAINT tenants_pkey PRIMARY KEY (id)
+);
+
+INSERT INTO tenants(slug, name) VALUES('default', 'Default') ON CONFLICT DO NOTHING;
+
+-- connections without app.tenant_id, like those of the background jobs,
+-- belong to the default tenant
+CREATE OR REPLACE FUNCTION current_tenant_id() RETURNS INTEGER AS $$
+    SELECT COALESCE(NULLIF(current_setting('app.tenant_id', true), '')::INTEGER, 1)
+$$ LANGUAGE SQL STABLE;
+
 CREATE TABLE products
 (
     id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
     name TEXT NOT NULL,
     price NUMERIC(10,2) NOT NULL DEFAULT 0.00,
+    stock INTEGER NOT NULL DEFAULT 0 CHECK (stock >= 0),
+    published BOOLEAN NOT NULL DEFAULT true,
+    barcode TEXT NOT NULL DEFAULT '',
+    weight NUMERIC(10,3) NOT NULL DEFAULT 0,
+    weight_unit TEXT NOT NULL DEFAULT 'kg',
+    length NUMERIC(10,2) NOT NULL DEFAULT 0,
+    width NUMERIC(10,2) NOT NULL DEFAULT 0,
+    height NUMERIC(10,2) NOT NULL DEFAULT 0,
+    dimension_unit TEXT NOT NULL DEFAULT 'cm',
     CONSTRAINT products_pkey PRIMARY KEY (id)
-)
\ No newline at end of file
+);
+
+CREATE TABLE product_relations
+(
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    related_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    relation_type TEXT NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0,
+    quantity INTEGER NOT NULL DEFAULT 1,
+    CONSTRAINT product_relations_pkey PRIMARY KEY (product_id, related_id, relation_type)
+);
+
+CREATE TABLE suppliers
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    name TEXT NOT NULL,
+    contact_name TEXT NOT NULL DEFAULT '',
+    email TEXT NOT NULL DEFAULT '',
+    phone TEXT NOT NULL DEFAULT '',
+    CONSTRAINT suppliers_pkey PRIMARY KEY (id)
+);
+
+CREATE TABLE supplier_products
+(
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    supplier_id INTEGER NOT NULL REFERENCES suppliers (id) ON DELETE CASCADE,
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    supplier_sku TEXT NOT NULL DEFAULT '',
+    cost_price NUMERIC(10,2) NOT NULL DEFAULT 0.00,
+    lead_time_days INTEGER NOT NULL DEFAULT 0,
+    CONSTRAINT supplier_products_pkey PRIMARY KEY (supplier_id, product_id)
+);
+
+CREATE TABLE reviews
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    rating INTEGER NOT NULL CHECK (rating BETWEEN 1 AND 5),
+    text TEXT NOT NULL DEFAULT '',
+    author TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT reviews_pkey PRIMARY KEY (id)
+);
+
+CREATE INDEX reviews_product_id_idx ON reviews (product_id, status);
+
+CREATE TABLE carts
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    customer TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT carts_pkey PRIMARY KEY (id)
+);
+
+CREATE TABLE cart_items
+(
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    cart_id INTEGER NOT NULL REFERENCES carts (id) ON DELETE CASCADE,
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    unit_price NUMERIC(10,2) NOT NULL,
+    CONSTRAINT cart_items_pkey PRIMARY KEY (cart_id, product_id)
+);
+
+CREATE TABLE orders
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    customer TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    total NUMERIC(12,2) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT orders_pkey PRIMARY KEY (id)
+);
+
+CREATE TABLE order_items
+(
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    order_id INTEGER NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+    product_id INTEGER REFERENCES products (id) ON DELETE SET NULL,
+    name TEXT NOT NULL,
+    quantity INTEGER NOT NULL,
+    unit_price NUMERIC(10,2) NOT NULL
+);
+
+CREATE TABLE wishlist_items
+(
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    customer TEXT NOT NULL,
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    added_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT wishlist_items_pkey PRIMARY KEY (customer, product_id)
+);
+
+CREATE TABLE price_watches
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    customer TEXT NOT NULL,
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    target_price NUMERIC(10,2) NOT NULL,
+    channel TEXT NOT NULL DEFAULT 'log',
+    address TEXT NOT NULL DEFAULT '',
+    triggered_at TIMESTAMPTZ,
+    CONSTRAINT price_watches_pkey PRIMARY KEY (id)
+);
+
+CREATE TABLE product_views
+(
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    bucket TIMESTAMPTZ NOT NULL,
+    views INTEGER NOT NULL DEFAULT 0,
+    CONSTRAINT product_views_pkey PRIMARY KEY (product_id, bucket)
+);
+
+CREATE TABLE product_cooccurrences
+(
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    other_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    count INTEGER NOT NULL,
+    score DOUBLE PRECISION NOT NULL,
+    CONSTRAINT product_cooccurrences_pkey PRIMARY KEY (product_id, other_id)
+);
+
+CREATE TABLE product_duplicates
+(
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    duplicate_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    score DOUBLE PRECISION NOT NULL,
+    reason TEXT NOT NULL,
+    CONSTRAINT product_duplicates_pkey PRIMARY KEY (product_id, duplicate_id)
+);
+
+CREATE TABLE channels
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    code TEXT NOT NULL,
+    name TEXT NOT NULL,
+    CONSTRAINT channels_pkey PRIMARY KEY (id),
+    CONSTRAINT channels_code_key UNIQUE (tenant_id, code)
+);
+
+CREATE TABLE channel_products
+(
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    channel_id INTEGER NOT NULL REFERENCES channels (id) ON DELETE CASCADE,
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    visible BOOLEAN NOT NULL DEFAULT true,
+    price NUMERIC(10,2),
+    CONSTRAINT channel_products_pkey PRIMARY KEY (channel_id, product_id)
+);
+
+-- tenant connections run as catalog_app, which is subject to the row-level
+-- security policies below
+DO $$
+BEGIN
+    CREATE ROLE catalog_app NOLOGIN;
+EXCEPTION WHEN duplicate_object THEN NULL;
+END
+$$;
+
+GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO catalog_app;
+GRANT USAGE, SELECT ON ALL SEQUENCES IN SCHEMA public TO catalog_app;
+
+ALTER TABLE products ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON products USING (tenant_id = current_tenant_id());
+ALTER TABLE product_relations ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON product_relations USING (tenant_id = current_tenant_id());
+ALTER TABLE suppliers ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON suppliers USING (tenant_id = current_tenant_id());
+ALTER TABLE supplier_products ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON supplier_products USING (tenant_id = current_tenant_id());
+ALTER TABLE reviews ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON reviews USING (tenant_id = current_tenant_id());
+ALTER TABLE carts ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON carts USING (tenant_id = current_tenant_id());
+ALTER TABLE cart_items ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON cart_items USING (tenant_id = current_tenant_id());
+ALTER TABLE orders ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON orders USING (tenant_id = current_tenant_id());
+ALTER TABLE order_items ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON order_items USING (tenant_id = current_tenant_id());
+ALTER TABLE wishlist_items ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON wishlist_items USING (tenant_id = current_tenant_id());
+ALTER TABLE price_watches ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON price_watches USING (tenant_id = current_tenant_id());
+ALTER TABLE product_views ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON product_views USING (tenant_id = current_tenant_id());
+ALTER TABLE product_cooccurrences ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON product_cooccurrences USING (tenant_id = current_tenant_id());
+ALTER TABLE product_duplicates ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON product_duplicates USING (tenant_id = current_tenant_id());
+ALTER TABLE channels ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON channels USING (tenant_id = current_tenant_id());
+ALTER TABLE channel_products ENABLE ROW LEVEL SECURITY;
+CREATE POLICY tenant_isolation ON channel_products USING (tenant_id = current_tenant_id());
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+const adminTokenHeader = "X-Admin-Token"
+
+// isAdmin reports whether a request carries an admin credential: the client
+// certificate of an identity in AdminIdentities or the AdminToken in the
+// X-Admin-Token header.
+func (a *App) isAdmin(r *http.Request) bool {
+	if identity := clientIdentity(r); identity != "" {
+		for _, admin := range a.AdminIdentities {
+			if identity == admin {
+				return true
+			}
+		}
+	}
+
+	token := r.Header.Get(adminTokenHeader)
+
+	return a.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.AdminToken)) == 1
+}
+
+// requireAdmin restricts a handler to admins. The routes of the deployment
+// rather than of a tenant, like managing tenants, run on the owner pool and
+// bypass the row-level security policies. Without AdminIdentities or an
+// AdminToken nobody may call them.
+func (a *App) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.isAdmin(r) {
+			respondWithError(w, http.StatusForbidden, "Admin credentials required")
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// API validation modes. Requests that don't match the OpenAPI document are
+// rejected in both; responses that don't match are logged, or replaced by a
+// 500 in strict mode.
+const (
+	apiValidationOff    = ""
+	apiValidationLog    = "log"
+	apiValidationStrict = "strict"
+)
+
+// validate returns the ways value violates the schema, each prefixed with
+// the location of the offending value.
+func (s *apiSchema) validate(value interface{}, at string) []string {
+	if s.Ref != "" {
+		return apiSchemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")].validate(value, at)
+	}
+	if value == nil {
+		if s.Nullable || s.Type == "" {
+			return nil
+		}
+		return []string{at + ": must not be null"}
+	}
+
+	switch s.Type {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{at + ": must be an object"}
+		}
+
+		var problems []string
+		for _, name := range s.Required {
+			if _, ok := object[name]; !ok {
+				problems = append(problems, at+"."+name+": is required")
+			}
+		}
+
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if property, ok := s.Properties[name]; ok {
+				problems = append(problems, property.validate(object[name], at+"."+name)...)
+			}
+		}
+		return problems
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return []string{at + ": must be an array"}
+		}
+
+		var problems []string
+		for i, item := range array {
+			problems = append(problems, s.Items.validate(item, at+"["+strconv.Itoa(i)+"]")...)
+		}
+		return problems
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return []string{at + ": must be a string"}
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			return []string{at + ": must match " + s.Pattern}
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return []string{at + ": must be a number"}
+		}
+	case "integer":
+		if n, ok := value.(float64); !ok || n != math.Trunc(n) {
+			return []string{at + ": must be an integer"}
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return []string{at + ": must be a boolean"}
+		}
+	}
+
+	return nil
+}
+
+// parse converts a path or query parameter to the type of the schema, so it
+// can be validated like a JSON value.
+func (s *apiSchema) parse(raw string) interface{} {
+	switch s.Type {
+	case "integer", "number":
+		if n, err := strconv.ParseFloat(raw, 64); err == nil {
+			return n
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(raw); err == nil {
+			return b
+		}
+	}
+
+	return raw
+}
+
+// validateRequest returns the ways the request violates the operation. It
+// leaves the request body readable by the handler.
+func (op *apiOperation) validateRequest(r *http.Request) []string {
+	var problems []string
+
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+	for _, param := range op.Parameters {
+		raw, ok := vars[param.Name]
+		if param.In == "query" {
+			raw, ok = query.Get(param.Name), query.Has(param.Name)
+		}
+
+		if !ok {
+			if param.Required {
+				problems = append(problems, param.In+" parameter "+param.Name+": is required")
+			}
+			continue
+		}
+		problems = append(problems, param.Schema.validate(param.Schema.parse(raw), param.In+" parameter "+param.Name)...)
+	}
+
+	if op.RequestBody == nil {
+		return problems
+	}
+
+	if r.Body == nil {
+		return append(problems, "body: is required")
+	}
+
+	// bodies in other media types are checked by their decoders
+	if requestMediaType(r) != "application/json" {
+		return problems
+	}
+
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return append(problems, "body: "+err.Error())
+	}
+
+	var payload interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return append(problems, "body: must be valid JSON")
+	}
+
+	return append(problems, op.RequestBody.Content["application/json"].Schema.validate(payload, "body")...)
+}
+
+// validateResponse returns the ways a JSON response body violates the
+// operation. Responses without a documented schema are not checked.
+func (op *apiOperation) validateResponse(code int, body []byte) []string {
+	response, ok := op.Responses[strconv.Itoa(code)]
+	if !ok {
+		response = op.Responses["default"]
+	}
+	media, ok := response.Content["application/json"]
+	if !ok || media.Schema == nil {
+		return nil
+	}
+
+	var payload interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return []string{"body: must be valid JSON"}
+	}
+
+	return media.Schema.validate(payload, "body")
+}
+
+// bufferedResponse holds back a JSON response until it has been validated.
+// Responses in other media types are not validated and pass through as they
+// are written, so they can be streamed.
+type bufferedResponse struct {
+	http.ResponseWriter
+	code        int
+	body        bytes.Buffer
+	passThrough bool
+}
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.code != 0 {
+		return
+	}
+	b.code = code
+	if !strings.HasPrefix(b.Header().Get("Content-Type"), "application/json") {
+		b.passThrough = true
+		b.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.code == 0 {
+		b.WriteHeader(http.StatusOK)
+	}
+	if b.passThrough {
+		return b.ResponseWriter.Write(p)
+	}
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) Flush() {
+	if !b.passThrough {
+		return
+	}
+	if f, ok := b.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// validateAPI is a middleware checking requests and responses against the
+// OpenAPI document, according to APIValidation.
+func (a *App) validateAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mode := a.APIValidation
+		if mode == apiValidationOff {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		op := a.apiOperation(r)
+		if op == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if problems := op.validateRequest(r); len(problems) > 0 {
+			respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"error":   "Request does not match the API specification",
+				"details": problems,
+			})
+			return
+		}
+
+		buffered := &bufferedResponse{ResponseWriter: w}
+		next.ServeHTTP(buffered, r)
+		if buffered.code == 0 {
+			buffered.WriteHeader(http.StatusOK)
+		}
+		if buffered.passThrough {
+			return
+		}
+
+		if problems := op.validateResponse(buffered.code, buffered.body.Bytes()); len(problems) > 0 {
+			log.Printf("%s %s: response does not match the API specification: %s",
+				r.Method, r.URL.Path, strings.Join(problems, "; "))
+
+			if mode == apiValidationStrict {
+				respondWithJSON(w, http.StatusInternalServerError, map[string]interface{}{
+					"error":   "Response does not match the API specification",
+					"details": problems,
+				})
+				return
+			}
+		}
+
+		w.WriteHeader(buffered.code)
+		w.Write(buffered.body.Bytes())
+	})
+}
+
+// apiOperation returns the documented operation of the route matched by the
+// request, or nil.
+func (a *App) apiOperation(r *http.Request) *apiOperation {
+	route := mux.CurrentRoute(r)
+	if route == nil || a.apiDoc == nil {
+		return nil
+	}
+
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return nil
+	}
+	// unversioned paths are documented for version 1, the routes selected by
+	// the API-Version header under their version prefix
+	if v, _ := splitAPIVersion(template); v == 0 {
+		if i := strings.Index(route.GetName(), "/"); i >= 0 {
+			template = "/" + route.GetName()[:i] + template
+		}
+	}
+	path, _ := apiPath(template)
+
+	return a.apiDoc.Paths[path][strings.ToLower(r.Method)]
+}
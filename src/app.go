@@ -1,48 +1,291 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/99designs/gqlgen/graphql/executor"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
+	"google.golang.org/grpc"
 )
 
 type App struct {
-	Router *mux.Router
-	DB     *sql.DB
+	Router    *mux.Router
+	DB        *sql.DB
+	Carriers  []carrier
+	Notifiers map[string]notifier
+	Views     *viewTracker
+	Jobs      map[string]*periodicJob
+
+	TenantBaseDomain  string
+	TenantTokenSecret []byte
+
+	// TenantCacheTTL is how long tenants are cached by slug for identifying
+	// the tenant of requests; zero disables the cache. Initialize sets it to
+	// defaultTenantCacheTTL.
+	TenantCacheTTL time.Duration
+
+	// AdminIdentities and AdminToken grant access to the routes managing the
+	// deployment, by client certificate identity or X-Admin-Token header.
+	AdminIdentities []string
+	AdminToken      string
+
+	// Deprecations announce the end of API versions and routes, keyed by
+	// version like "v1" or by route like "v1 GET /products".
+	Deprecations map[string]deprecation
+
+	// TLSCertFile and TLSKeyFile serve the API over HTTPS, reloading them when
+	// they are rotated. TLSClientCAFile verifies client certificates, which
+	// are mapped to identities by SHA-256 fingerprint like "sha256:ab12..."
+	// or common name in ClientIdentities; without any, the common name is the
+	// identity.
+	TLSCertFile          string
+	TLSKeyFile           string
+	TLSClientCAFile      string
+	TLSRequireClientCert bool
+	ClientIdentities     map[string]string
+	TLSRedirectAddr      string
+
+	// Listeners lists the listeners of Run, like "tcp://:8010" or
+	// "unix:///run/catalog/api.sock?mode=0660&h2c=true"; see listenerSpec.
+	Listeners []string
+
+	// CORSOrigins lists the origins allowed to call the API, as patterns like
+	// "https://*.example.com"; CORS is off without any. CORSMethods and
+	// CORSHeaders restrict the methods and request headers of cross-origin
+	// requests, nil allowing every method and the default headers.
+	// CORSCredentials does not apply to origins allowed by "*" only.
+	CORSOrigins     []string
+	CORSMethods     []string
+	CORSHeaders     []string
+	CORSCredentials bool
+	CORSMaxAge      time.Duration
+
+	// CompressionMinSize and CompressibleTypes select the responses worth
+	// compressing; zero values select the defaults.
+	CompressionMinSize int
+	CompressibleTypes  []string
+
+	// MaxDecompressedSize and MaxCompressionRatio limit compressed request
+	// bodies; zero values select the defaults.
+	MaxDecompressedSize int64
+	MaxCompressionRatio int
+
+	// ErrorSinkURL receives the reports of panics recovered in handlers as
+	// JSON posts; they are logged regardless.
+	ErrorSinkURL string
+
+	// APIValidation checks requests and responses against the OpenAPI
+	// document when set to "log" or "strict"; meant for development.
+	APIValidation string
+
+	apiDoc           *apiDocument
+	gqlExecutor      *executor.Executor
+	grpcServer       *grpc.Server
+	events           *productEventHub
+	connectionString string
+	tenantMu         sync.Mutex
+	tenantDBs        map[int]*sql.DB
+	tenantCacheMu    sync.Mutex
+	tenantCache      map[string]cachedTenant
 }
 
 func (a *App) Initialize(user, password, dbname string) {
-	connectionString := fmt.Sprintf("user=%s password=%s dbname=%s sslmode=disable", user, password, dbname)
+	a.connectionString = fmt.Sprintf("user=%s password=%s dbname=%s sslmode=disable", user, password, dbname)
 
 	var err error
-	a.DB, err = sql.Open("postgres", connectionString)
+	a.DB, err = sql.Open("postgres", a.connectionString)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	a.Carriers = defaultCarriers
+	a.Notifiers = defaultNotifiers()
+	a.Views = newViewTracker(a.DB, 5*time.Second)
+	a.Jobs = map[string]*periodicJob{
+		"recommendations": newPeriodicJob("recommendations", time.Hour, func() error { return computeCooccurrences(a.DB) }),
+		"duplicates":      newPeriodicJob("duplicates", 24*time.Hour, func() error { return detectDuplicates(a.DB) }),
+	}
+	for _, job := range a.Jobs {
+		job.start()
+	}
+
+	a.tenantDBs = map[int]*sql.DB{}
+	a.tenantCache = map[string]cachedTenant{}
+	a.TenantCacheTTL = defaultTenantCacheTTL
+	a.events = newProductEventHub()
+	a.gqlExecutor = a.newGraphQLExecutor()
+
 	a.Router = mux.NewRouter()
+	a.Router.Use(a.assignRequestID)
+	a.Router.Use(a.identifyClient)
+	a.Router.Use(a.recoverPanics)
+	a.Router.Use(a.cors)
+	a.Router.Use(a.compressResponse)
+	a.Router.Use(a.decompressRequest)
+	a.Router.Use(a.identifyTenant)
+	a.Router.Use(a.validateAPI)
+	a.Router.Use(a.negotiateContent)
 	a.initializeRoutes()
+
+	if a.apiDoc, err = buildAPIDocument(a.Router); err != nil {
+		log.Fatal(err)
+	}
 }
 
+// shutdownTimeout is how long the servers wait for the requests and calls
+// in progress when they are stopped.
+const shutdownTimeout = 30 * time.Second
+
+// Run serves the API on the Listeners, or on addr without any, over HTTPS if
+// TLSCertFile is set. With TLSRedirectAddr, plain HTTP requests on it are
+// redirected to the first TLS listener on TCP, or to addr.
 func (a *App) Run(addr string) {
-	log.Fatal(http.ListenAndServe(":8010", a.Router))
+	specs := a.Listeners
+	if len(specs) == 0 {
+		specs = []string{"tcp://" + addr}
+	}
+
+	if a.TLSCertFile != "" && a.TLSRedirectAddr != "" {
+		go func() {
+			log.Fatal(a.NewRedirectServer(a.TLSRedirectAddr, a.redirectTarget(specs, addr)).ListenAndServe())
+		}()
+	}
+
+	// SIGINT and SIGTERM stop the servers, the gRPC server of RunGRPC too,
+	// after which the pending work is written
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := a.Serve(ctx, specs)
+	a.stopGRPC()
+	a.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// redirectTarget returns the address of the first TLS listener on TCP in
+// specs, or addr if there is none.
+func (a *App) redirectTarget(specs []string, addr string) string {
+	for _, spec := range specs {
+		s, err := parseListenerSpec(spec, a.TLSCertFile != "")
+		if err == nil && s.network == "tcp" && s.tls {
+			return s.address
+		}
+	}
+
+	return addr
+}
+
+// Close stops the background jobs, writes the pending product views and
+// closes the connection pools of the app.
+func (a *App) Close() {
+	for _, job := range a.Jobs {
+		job.close()
+	}
+	a.Views.close()
+
+	a.tenantMu.Lock()
+	for _, db := range a.tenantDBs {
+		db.Close()
+	}
+	a.tenantMu.Unlock()
+
+	a.DB.Close()
 }
 
 func (a *App) initializeRoutes() {
-	a.Router.HandleFunc("/products", a.getProducts).Methods("GET")
-	a.Router.HandleFunc("/product", a.createProduct).Methods("POST")
-	a.Router.HandleFunc("/product/{id:[0-9]+}", a.getProduct).Methods("GET")
-	a.Router.HandleFunc("/product/search", a.searchProducts).Queries("name", "{name}").Methods("GET")
-	a.Router.HandleFunc("/product/meta/count", a.getProductCount).Methods("GET")
-	a.Router.HandleFunc("/product/{id:[0-9]+}", a.updateProduct).Methods("PUT")
-	a.Router.HandleFunc("/product/{id:[0-9]+}", a.deleteProduct).Methods("DELETE")
+	a.Router.NotFoundHandler = a.withFallbackMiddleware(a.notFound)
+	a.Router.MethodNotAllowedHandler = http.HandlerFunc(a.methodNotAllowed)
+
+	a.Router.HandleFunc("/graphql", a.graphql).Methods("GET", "POST")
+	a.Router.HandleFunc("/openapi.json", a.getOpenAPI).Methods("GET")
+	a.Router.HandleFunc("/docs", a.getAPIDocs).Methods("GET")
+
+	// the API-Version header selects the version of unversioned paths; its
+	// routes share the names of the /v2 tree, which build the links
+	a.initializeVersionRoutes(a.Router.Headers(apiVersionHeader, "2").Subrouter(), 2, "v2/")
+	a.initializeVersionRoutes(a.Router.PathPrefix("/v1").Subrouter(), 1, "v1/")
+	a.initializeVersionRoutes(a.Router.PathPrefix("/v2").Subrouter(), 2, "v2/")
+	a.initializeVersionRoutes(a.Router.NewRoute().Subrouter(), 1, "")
+}
+
+// initializeVersionRoutes registers the routes of an API version on r,
+// prefixing the names of the routes with names.
+func (a *App) initializeVersionRoutes(r *mux.Router, version int, names string) {
+	r.Use(a.apiVersion(version))
+
+	r.HandleFunc("/products", a.getProducts).Methods("GET").Name(names + "products")
+	r.HandleFunc("/product", a.createProduct).Methods("POST")
+	r.HandleFunc("/product/{id:[0-9]+}", a.getProduct).Methods("GET").Name(names + "product")
+	r.HandleFunc("/product/search", a.searchProducts).Queries("name", "{name}").Methods("GET").Name(names + "product-search")
+	r.HandleFunc("/product/meta/count", a.getProductCount).Methods("GET")
+	r.HandleFunc("/product/{id:[0-9]+}", a.updateProduct).Methods("PUT")
+	r.HandleFunc("/product/{id:[0-9]+}", a.deleteProduct).Methods("DELETE")
+	r.HandleFunc("/product/{id:[0-9]+}/relations", a.getRelations).Methods("GET").Name(names + "product-relations")
+	r.HandleFunc("/product/{id:[0-9]+}/relations", a.createRelation).Methods("POST")
+	r.HandleFunc("/product/{id:[0-9]+}/relations/{type}", a.reorderRelations).Methods("PUT")
+	r.HandleFunc("/product/{id:[0-9]+}/relations/{type}/{related_id:[0-9]+}", a.deleteRelation).Methods("DELETE")
+	r.HandleFunc("/product/{id:[0-9]+}/bundle", a.getBundle).Methods("GET")
+	r.HandleFunc("/product/{id:[0-9]+}/recommendations", a.getRecommendations).Methods("GET").Name(names + "product-recommendations")
+	r.HandleFunc("/product/{id:[0-9]+}/suppliers", a.getProductSuppliers).Methods("GET").Name(names + "product-suppliers")
+	r.HandleFunc("/products/trending", a.getTrendingProducts).Methods("GET").Name(names + "products-trending")
+	r.HandleFunc("/products/duplicates", a.getDuplicates).Methods("GET")
+	r.HandleFunc("/products/merge", a.mergeProducts).Methods("POST")
+	r.HandleFunc("/products/import", a.importProducts).Methods("POST").Name(names + "products-import")
+	r.HandleFunc("/products/margins", a.getProductMargins).Methods("GET")
+	r.HandleFunc("/product/{id:[0-9]+}/reviews", a.getReviews).Methods("GET").Name(names + "product-reviews")
+	r.HandleFunc("/product/{id:[0-9]+}/reviews", a.createReview).Methods("POST")
+	r.HandleFunc("/review/{id:[0-9]+}/status", a.requireAdmin(a.moderateReview)).Methods("PUT")
+	r.HandleFunc("/review/{id:[0-9]+}", a.requireAdmin(a.deleteReview)).Methods("DELETE")
+	r.HandleFunc("/cart", a.createCart).Methods("POST")
+	r.HandleFunc("/cart/{id:[0-9]+}", a.getCart).Methods("GET")
+	r.HandleFunc("/cart/{id:[0-9]+}/items/{product_id:[0-9]+}", a.setCartItem).Methods("PUT")
+	r.HandleFunc("/cart/{id:[0-9]+}/items/{product_id:[0-9]+}", a.deleteCartItem).Methods("DELETE")
+	r.HandleFunc("/cart/{id:[0-9]+}/order", a.placeOrder).Methods("POST")
+	r.HandleFunc("/orders", a.getOrders).Methods("GET")
+	r.HandleFunc("/order/{id:[0-9]+}", a.getOrder).Methods("GET")
+	r.HandleFunc("/order/{id:[0-9]+}/status", a.updateOrderStatus).Methods("PUT")
+	r.HandleFunc("/shipping/estimate", a.estimateShipping).Methods("POST")
+	r.HandleFunc("/wishlist/{customer}", a.getWishlist).Methods("GET")
+	r.HandleFunc("/wishlist/{customer}/{product_id:[0-9]+}", a.addWishlistItem).Methods("PUT")
+	r.HandleFunc("/wishlist/{customer}/{product_id:[0-9]+}", a.deleteWishlistItem).Methods("DELETE")
+	r.HandleFunc("/price-watches", a.requireAdmin(a.getPriceWatches)).Methods("GET")
+	r.HandleFunc("/price-watch", a.createPriceWatch).Methods("POST")
+	r.HandleFunc("/price-watch/{id:[0-9]+}", a.requireAdmin(a.deletePriceWatch)).Methods("DELETE")
+	r.HandleFunc("/jobs/{name}", a.requireAdmin(a.runJob)).Methods("POST")
+	r.HandleFunc("/tenant", a.getCurrentTenant).Methods("GET")
+	r.HandleFunc("/tenants", a.requireAdmin(a.getTenants)).Methods("GET")
+	r.HandleFunc("/tenant", a.requireAdmin(a.createTenant)).Methods("POST")
+	r.HandleFunc("/tenant/{id:[0-9]+}", a.requireAdmin(a.updateTenant)).Methods("PUT")
+	r.HandleFunc("/channels", a.getChannels).Methods("GET")
+	r.HandleFunc("/channel", a.createChannel).Methods("POST")
+	r.HandleFunc("/channel/{id:[0-9]+}", a.deleteChannel).Methods("DELETE")
+	r.HandleFunc("/channel/{id:[0-9]+}/products", a.getChannelProducts).Methods("GET")
+	r.HandleFunc("/channel/{id:[0-9]+}/products/{product_id:[0-9]+}", a.saveChannelProduct).Methods("PUT")
+	r.HandleFunc("/channel/{id:[0-9]+}/products/{product_id:[0-9]+}", a.deleteChannelProduct).Methods("DELETE")
+	r.HandleFunc("/suppliers", a.getSuppliers).Methods("GET")
+	r.HandleFunc("/supplier", a.createSupplier).Methods("POST")
+	r.HandleFunc("/supplier/{id:[0-9]+}", a.getSupplier).Methods("GET")
+	r.HandleFunc("/supplier/{id:[0-9]+}", a.updateSupplier).Methods("PUT")
+	r.HandleFunc("/supplier/{id:[0-9]+}", a.deleteSupplier).Methods("DELETE")
+	r.HandleFunc("/supplier/{id:[0-9]+}/products", a.getSupplierProducts).Methods("GET")
+	r.HandleFunc("/supplier/{id:[0-9]+}/products", a.saveSupplierProduct).Methods("POST")
+	r.HandleFunc("/supplier/{id:[0-9]+}/products/{product_id:[0-9]+}", a.deleteSupplierProduct).Methods("DELETE")
 }
 
 func (a *App) getProduct(writer http.ResponseWriter, request *http.Request) {
@@ -54,8 +297,25 @@ func (a *App) getProduct(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	fields, err := parseProductFields(request.FormValue("fields"))
+	if err != nil {
+		respondWithError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	channelID, err := a.requestChannel(request)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(writer, http.StatusNotFound, "Channel not found")
+		default:
+			respondWithError(writer, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
 	p := product{ID: id}
-	if err := p.getProduct(a.DB); err != nil {
+	if err := p.getChannelProduct(a.db(request), channelID, fields); err != nil {
 		switch err {
 		case sql.ErrNoRows:
 			respondWithError(writer, http.StatusNotFound, "Product not found")
@@ -65,7 +325,24 @@ func (a *App) getProduct(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	respondWithJSON(writer, http.StatusOK, p)
+	if err := p.convertMeasurements(request.FormValue("weight_unit"), request.FormValue("dimension_unit")); err != nil {
+		respondWithError(writer, http.StatusBadRequest, "Invalid weight or dimension unit")
+		return
+	}
+
+	if !isHeadRequest(request) {
+		a.Views.record(p.ID)
+	}
+
+	if request.FormValue("include") == "related" {
+		p.Related, err = getRelations(a.db(request), p.ID, "")
+		if err != nil {
+			respondWithError(writer, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	respond(writer, http.StatusOK, p)
 }
 
 func (a *App) searchProducts(writer http.ResponseWriter, request *http.Request) {
@@ -76,62 +353,164 @@ func (a *App) searchProducts(writer http.ResponseWriter, request *http.Request)
 		return
 	}
 
+	fields, err := parseProductFields(request.FormValue("fields"))
+	if err != nil {
+		respondWithError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	channelID, err := a.requestChannel(request)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(writer, http.StatusNotFound, "Channel not found")
+		default:
+			respondWithError(writer, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
 	p := product{Name: searchTerm}
 
-	products, err := p.searchProducts(a.DB)
+	products, err := p.searchProducts(a.db(request), channelID, fields, 0, 0)
 	if err != nil {
 		respondWithError(writer, http.StatusInternalServerError, err.Error())
 	}
 
-	respondWithJSON(writer, http.StatusOK, products)
+	respond(writer, http.StatusOK, products)
 }
 
 func (a *App) getProductCount(writer http.ResponseWriter, request *http.Request) {
+	channelID, err := a.requestChannel(request)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(writer, http.StatusNotFound, "Channel not found")
+		default:
+			respondWithError(writer, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
 	p := product{}
 
-	count, err := p.getNumberOfProducts(a.DB)
+	count, err := p.getNumberOfProducts(a.db(request), channelID)
 	if err != nil {
 		respondWithError(writer, http.StatusInternalServerError, err.Error())
 	}
 
-	respondWithJSON(writer, http.StatusOK, count)
+	respond(writer, http.StatusOK, count)
 }
 
 func (a *App) getProducts(w http.ResponseWriter, r *http.Request) {
 	count, _ := strconv.Atoi(r.FormValue("count"))
 	start, _ := strconv.Atoi(r.FormValue("start"))
 
-	if count > 10 || count < 1 {
-		count = 10
-	}
+	count = tenantFromRequest(r).pageSize(count)
 	if start < 0 {
 		start = 0
 	}
 
-	products, err := getProducts(a.DB, start, count)
+	var minRating float64
+	if v := r.FormValue("min_rating"); v != "" {
+		var err error
+		if minRating, err = strconv.ParseFloat(v, 64); err != nil || minRating < minReviewRating || minRating > maxReviewRating {
+			respondWithError(w, http.StatusBadRequest, "Invalid minimum rating")
+			return
+		}
+	}
+
+	fields, err := parseProductFields(r.FormValue("fields"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	sort := r.FormValue("sort")
+	if _, ok := productSortOrders[sort]; sort != "" && !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid sort order")
+		return
+	}
+
+	channelID, err := a.requestChannel(r)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Channel not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	products, err := getProducts(a.db(r), productFilter{Start: start, Count: count, MinRating: minRating, Sort: sort, Channel: channelID, Fields: fields})
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, products)
+	respond(w, http.StatusOK, products)
 }
 
 func (a *App) createProduct(w http.ResponseWriter, r *http.Request) {
-	var p product
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&p); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+	// products are published unless the payload says otherwise
+	p := product{Published: true}
+	if err := decodeRequest(r, &p); err != nil {
+		switch err {
+		case errUnsupportedMediaType:
+			respondWithError(w, http.StatusUnsupportedMediaType, "Unsupported media type")
+		default:
+			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		}
 		return
 	}
-	defer r.Body.Close()
 
-	if err := p.createProduct(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if err := a.addProduct(a.db(r), tenantFromRequest(r), &p); err != nil {
+		respondWithProductError(w, err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusCreated, p)
+	respond(w, http.StatusCreated, p)
+}
+
+// importProducts creates a list of products at once, or none of them if one
+// is invalid. Large lists may be sent with Content-Encoding gzip.
+func (a *App) importProducts(w http.ResponseWriter, r *http.Request) {
+	var imported []importedProduct
+	if err := decodeRequest(r, &imported); err != nil {
+		switch err {
+		case errUnsupportedMediaType:
+			respondWithError(w, http.StatusUnsupportedMediaType, "Unsupported media type")
+		default:
+			respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		}
+		return
+	}
+
+	products := make([]product, 0, len(imported))
+	for i, p := range imported {
+		if err := p.validate(); err != nil {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Product %d: %v", i, err))
+			return
+		}
+		products = append(products, p.product)
+	}
+
+	if err := createProducts(a.db(r), tenantFromRequest(r).ID, products); err != nil {
+		switch err {
+		case errProductLimit:
+			respondWithError(w, http.StatusForbidden, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	for _, p := range products {
+		a.events.publish(productEvent{Type: productCreated, TenantID: tenantFromRequest(r).ID, Product: p})
+	}
+
+	respond(w, http.StatusCreated, products)
 }
 
 func (a *App) updateProduct(w http.ResponseWriter, r *http.Request) {
@@ -142,21 +521,24 @@ func (a *App) updateProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var p product
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&p); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid resquest payload")
+	p := product{Published: true}
+	if err := decodeRequest(r, &p); err != nil {
+		switch err {
+		case errUnsupportedMediaType:
+			respondWithError(w, http.StatusUnsupportedMediaType, "Unsupported media type")
+		default:
+			respondWithError(w, http.StatusBadRequest, "Invalid resquest payload")
+		}
 		return
 	}
-	defer r.Body.Close()
 	p.ID = id
 
-	if err := p.updateProduct(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if err := a.saveProduct(a.db(r), tenantFromRequest(r), &p); err != nil {
+		respondWithProductError(w, err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, p)
+	respond(w, http.StatusOK, p)
 }
 
 func (a *App) deleteProduct(w http.ResponseWriter, r *http.Request) {
@@ -167,21 +549,69 @@ func (a *App) deleteProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	p := product{ID: id}
-	if err := p.deleteProduct(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if err := a.removeProduct(a.db(r), tenantFromRequest(r), id); err != nil {
+		respondWithProductError(w, err)
+		return
+	}
+
+	respond(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// respondWithProductError reports an error of a product mutation.
+func respondWithProductError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*invalidProductError); ok {
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+	switch err {
+	case errProductLimit:
+		respondWithError(w, http.StatusForbidden, err.Error())
+	case sql.ErrNoRows:
+		respondWithError(w, http.StatusNotFound, "Product not found")
+	default:
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+var errProductLimit = errors.New("Product limit of the tenant reached")
+
+// checkProductLimit returns errProductLimit if the tenant may not create n
+// more products. It locks the row of the tenant until tx ends, so that
+// concurrent transactions creating products check the limit one after the
+// other.
+func checkProductLimit(tx *sql.Tx, tenantID, n int) error {
+	var max int
+	if err := tx.QueryRow("SELECT max_products FROM tenants WHERE id=$1 FOR UPDATE", tenantID).Scan(&max); err != nil {
+		return err
+	}
+	if max <= 0 {
+		return nil
+	}
+
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM products WHERE tenant_id = current_tenant_id()").Scan(&count); err != nil {
+		return err
+	}
+	if count+n > max {
+		return errProductLimit
+	}
+
+	return nil
 }
 
 func respondWithError(w http.ResponseWriter, code int, message string) {
-	respondWithJSON(w, code, map[string]string{"error": message})
+	respond(w, code, map[string]string{"error": message})
 }
 
+// respondWithJSON writes the payload as JSON regardless of the Accept header,
+// for responses that only exist in JSON.
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
-	response, _ := json.Marshal(payload)
+	response, err := json.Marshal(payload)
+	if err != nil {
+		code = http.StatusInternalServerError
+		response, _ = json.Marshal(map[string]string{"error": err.Error()})
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// channel is a sales channel, like the web shop or a marketplace, with its
+// own assortment and prices. Read endpoints select it by code with the
+// channel query parameter.
+type channel struct {
+	ID   int    `json:"id"`
+	Code string `json:"code"`
+	Name string `json:"name"`
+}
+
+// channelProduct overrides the visibility and price of a product in a
+// channel. A nil Price keeps the product's own price.
+type channelProduct struct {
+	ChannelID int      `json:"channel_id"`
+	ProductID int      `json:"product_id"`
+	Visible   bool     `json:"visible"`
+	Price     *float64 `json:"price"`
+}
+
+func (c *channel) getChannelByCode(db *sql.DB) error {
+	return db.QueryRow("SELECT id, name FROM channels WHERE code=$1", c.Code).Scan(&c.ID, &c.Name)
+}
+
+func (c *channel) createChannel(db *sql.DB) error {
+	return db.QueryRow("INSERT INTO channels(code, name) VALUES($1, $2) RETURNING id",
+		c.Code, c.Name).Scan(&c.ID)
+}
+
+func (c *channel) deleteChannel(db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM channels WHERE id=$1", c.ID)
+
+	return err
+}
+
+func getChannels(db *sql.DB) ([]channel, error) {
+	rows, err := db.Query("SELECT id, code, name FROM channels ORDER BY id")
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	channels := []channel{}
+
+	for rows.Next() {
+		var c channel
+		if err := rows.Scan(&c.ID, &c.Code, &c.Name); err != nil {
+			return nil, err
+		}
+		channels = append(channels, c)
+	}
+
+	return channels, rows.Err()
+}
+
+// saveChannelProduct stores the settings of a product in a channel,
+// replacing earlier ones.
+func (cp *channelProduct) saveChannelProduct(db *sql.DB) error {
+	_, err := db.Exec(
+		`INSERT INTO channel_products(channel_id, product_id, visible, price) VALUES($1, $2, $3, $4)
+		ON CONFLICT (channel_id, product_id) DO UPDATE SET visible=EXCLUDED.visible, price=EXCLUDED.price`,
+		cp.ChannelID, cp.ProductID, cp.Visible, cp.Price)
+
+	return err
+}
+
+func (cp *channelProduct) deleteChannelProduct(db *sql.DB) (bool, error) {
+	res, err := db.Exec("DELETE FROM channel_products WHERE channel_id=$1 AND product_id=$2",
+		cp.ChannelID, cp.ProductID)
+
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+
+	return affected > 0, err
+}
+
+func getChannelProducts(db *sql.DB, channelID int) ([]channelProduct, error) {
+	rows, err := db.Query(
+		"SELECT channel_id, product_id, visible, price FROM channel_products WHERE channel_id=$1 ORDER BY product_id",
+		channelID)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	settings := []channelProduct{}
+
+	for rows.Next() {
+		var cp channelProduct
+		if err := rows.Scan(&cp.ChannelID, &cp.ProductID, &cp.Visible, &cp.Price); err != nil {
+			return nil, err
+		}
+		settings = append(settings, cp)
+	}
+
+	return settings, rows.Err()
+}
+
+// requestChannel returns the ID of the channel named by the channel query
+// parameter, or 0 if there is none. An unknown channel yields sql.ErrNoRows.
+func (a *App) requestChannel(r *http.Request) (int, error) {
+	code := r.FormValue("channel")
+	if code == "" {
+		return 0, nil
+	}
+
+	c := channel{Code: code}
+	if err := c.getChannelByCode(a.db(r)); err != nil {
+		return 0, err
+	}
+
+	return c.ID, nil
+}
+
+func (a *App) getChannels(w http.ResponseWriter, r *http.Request) {
+	channels, err := getChannels(a.db(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, channels)
+}
+
+func (a *App) createChannel(w http.ResponseWriter, r *http.Request) {
+	var c channel
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&c); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if len(c.Code) == 0 || len(c.Name) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Channel code and name are required")
+		return
+	}
+
+	existing := channel{Code: c.Code}
+	switch err := existing.getChannelByCode(a.db(r)); err {
+	case nil:
+		respondWithError(w, http.StatusConflict, "Channel code already in use")
+		return
+	case sql.ErrNoRows:
+	default:
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := c.createChannel(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusCreated, c)
+}
+
+func (a *App) deleteChannel(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid channel ID")
+		return
+	}
+
+	c := channel{ID: id}
+	if err := c.deleteChannel(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *App) getChannelProducts(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid channel ID")
+		return
+	}
+
+	settings, err := getChannelProducts(a.db(r), id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, settings)
+}
+
+func (a *App) saveChannelProduct(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid channel ID")
+		return
+	}
+	productID, err := strconv.Atoi(vars["product_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	// products stay visible unless the payload says otherwise
+	cp := channelProduct{Visible: true}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&cp); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	cp.ChannelID = id
+	cp.ProductID = productID
+
+	if cp.Price != nil && *cp.Price < 0 {
+		respondWithError(w, http.StatusBadRequest, "Price must not be negative")
+		return
+	}
+
+	var exists bool
+	if err := a.db(r).QueryRow("SELECT EXISTS(SELECT 1 FROM channels WHERE id=$1)", id).Scan(&exists); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !exists {
+		respondWithError(w, http.StatusNotFound, "Channel not found")
+		return
+	}
+
+	p := product{ID: productID}
+	if err := p.getProduct(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Product not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	if err := cp.saveChannelProduct(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, cp)
+}
+
+func (a *App) deleteChannelProduct(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid channel ID")
+		return
+	}
+	productID, err := strconv.Atoi(vars["product_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	cp := channelProduct{ChannelID: id, ProductID: productID}
+	deleted, err := cp.deleteChannelProduct(a.db(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !deleted {
+		respondWithError(w, http.StatusNotFound, "Channel product not found")
+		return
+	}
+
+	respond(w, http.StatusOK, map[string]string{"result": "success"})
+}
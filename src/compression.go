@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// defaultCompressionMinSize is the size below which responses are sent
+// uncompressed, as compression gains little on them.
+const defaultCompressionMinSize = 1024
+
+// defaultCompressibleTypes are the media types compressed by default. Types
+// ending in "/" match every subtype.
+var defaultCompressibleTypes = []string{
+	"application/json",
+	"application/vnd.api+json",
+	"application/hal+json",
+	"application/xml",
+	"application/msgpack",
+	"text/",
+}
+
+// Defaults of the limits of compressed request bodies. The ratio applies to
+// bodies decompressing to more than a MiB, as small bodies compress well.
+const (
+	defaultMaxDecompressedSize  = 32 << 20
+	defaultMaxCompressionRatio  = 100
+	compressionRatioGracePeriod = 1 << 20
+)
+
+// compressedBodyRoutes are the named routes accepting request bodies with
+// Content-Encoding gzip.
+var compressedBodyRoutes = map[string]bool{
+	"products-import": true,
+}
+
+var errRequestTooLarge = errors.New("Decompressed request body too large")
+
+// contentCoding compresses responses with one Content-Encoding.
+type contentCoding struct {
+	name      string
+	newWriter func(w io.Writer) compressor
+}
+
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// contentCodings are the supported codings, by preference of the server.
+var contentCodings = []contentCoding{
+	{"br", func(w io.Writer) compressor { return brotli.NewWriterLevel(w, brotli.DefaultCompression) }},
+	{"gzip", func(w io.Writer) compressor { return gzip.NewWriter(w) }},
+	{"deflate", func(w io.Writer) compressor {
+		fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+		return fw
+	}},
+}
+
+// negotiateContentCoding returns the coding preferred by an Accept-Encoding
+// header, or nil for identity. Ties go to the preference of the server.
+func negotiateContentCoding(acceptEncoding string) *contentCoding {
+	if strings.TrimSpace(acceptEncoding) == "" {
+		return nil
+	}
+
+	ranges := parseAccept(acceptEncoding)
+	quality := func(name string) float64 {
+		for _, r := range ranges {
+			if r.mediaType == name {
+				return r.q
+			}
+		}
+		for _, r := range ranges {
+			if r.mediaType == "*" {
+				return r.q
+			}
+		}
+		return 0
+	}
+
+	var best *contentCoding
+	bestQ := 0.0
+	for i, c := range contentCodings {
+		if q := quality(c.name); q > bestQ {
+			best, bestQ = &contentCodings[i], q
+		}
+	}
+
+	return best
+}
+
+// compressedResponse holds back the start of a response until it is known
+// whether it is worth compressing: it reaches the minimum size with a
+// compressible Content-Type.
+type compressedResponse struct {
+	http.ResponseWriter
+	coding  *contentCoding
+	minSize int
+	types   []string
+
+	code       int
+	buffer     []byte
+	decided    bool
+	compressor compressor
+}
+
+func (c *compressedResponse) WriteHeader(code int) {
+	if c.code == 0 {
+		c.code = code
+	}
+}
+
+func (c *compressedResponse) Write(b []byte) (int, error) {
+	if c.code == 0 {
+		c.code = http.StatusOK
+	}
+
+	if !c.decided {
+		c.buffer = append(c.buffer, b...)
+		if len(c.buffer) < c.minSize {
+			return len(b), nil
+		}
+		if err := c.start(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	if c.compressor != nil {
+		return c.compressor.Write(b)
+	}
+
+	return c.ResponseWriter.Write(b)
+}
+
+// Flush sends what has been written so far, compressed if the response is
+// compressible regardless of its size.
+func (c *compressedResponse) Flush() {
+	if !c.decided {
+		c.start()
+	}
+	if c.compressor != nil {
+		c.compressor.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// start decides on the compression of the response and writes its header
+// and the buffered start of the body.
+func (c *compressedResponse) start() error {
+	c.decided = true
+	if c.code == 0 {
+		c.code = http.StatusOK
+	}
+
+	header := c.ResponseWriter.Header()
+	if c.compressible(header) {
+		header.Set("Content-Encoding", c.coding.name)
+		header.Del("Content-Length")
+		c.compressor = c.coding.newWriter(c.ResponseWriter)
+	}
+
+	c.ResponseWriter.WriteHeader(c.code)
+
+	buffer := c.buffer
+	c.buffer = nil
+	if len(buffer) == 0 {
+		return nil
+	}
+	if c.compressor != nil {
+		_, err := c.compressor.Write(buffer)
+		return err
+	}
+	_, err := c.ResponseWriter.Write(buffer)
+	return err
+}
+
+func (c *compressedResponse) compressible(header http.Header) bool {
+	if c.code < http.StatusOK || c.code == http.StatusNoContent || c.code == http.StatusNotModified {
+		return false
+	}
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(header.Get("Content-Type"), ";")[0]))
+	for _, t := range c.types {
+		if mediaType == t || strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// finish sends a response that stayed below the minimum size uncompressed
+// and ends the compressed stream.
+func (c *compressedResponse) finish() {
+	if !c.decided {
+		if c.code == 0 && len(c.buffer) == 0 {
+			return
+		}
+		// too small to be compressed
+		c.decided = true
+		c.ResponseWriter.WriteHeader(c.code)
+		c.ResponseWriter.Write(c.buffer)
+		c.buffer = nil
+	}
+	if c.compressor != nil {
+		c.compressor.Close()
+	}
+}
+
+// compressResponse is a middleware compressing responses with the coding
+// negotiated from the Accept-Encoding header of the request.
+func (a *App) compressResponse(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		coding := negotiateContentCoding(r.Header.Get("Accept-Encoding"))
+		if coding == nil || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		minSize := a.CompressionMinSize
+		if minSize <= 0 {
+			minSize = defaultCompressionMinSize
+		}
+		types := a.CompressibleTypes
+		if types == nil {
+			types = defaultCompressibleTypes
+		}
+
+		// not deferred, a panicking handler leaves the response to
+		// recoverPanics
+		c := &compressedResponse{ResponseWriter: w, coding: coding, minSize: minSize, types: types}
+		next.ServeHTTP(c, r)
+		c.finish()
+	})
+}
+
+// decompressRequest is a middleware decompressing gzip request bodies of the
+// routes in compressedBodyRoutes, refusing bodies over MaxDecompressedSize
+// or compressed beyond MaxCompressionRatio. Compressed bodies are refused on
+// other routes.
+func (a *App) decompressRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+		if encoding == "" || encoding == "identity" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		_, name := responseContext{request: r}.routeName()
+		if encoding != "gzip" || !compressedBodyRoutes[name] {
+			respondWithError(w, http.StatusUnsupportedMediaType, "Unsupported content encoding")
+			return
+		}
+
+		body, err := a.readCompressedBody(r.Body)
+		r.Body.Close()
+		switch err {
+		case nil:
+		case errRequestTooLarge:
+			respondWithError(w, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		default:
+			respondWithError(w, http.StatusBadRequest, "Invalid compressed request body")
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Del("Content-Encoding")
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readCompressedBody decompresses a gzip body, stopping with
+// errRequestTooLarge as soon as it exceeds the limits.
+func (a *App) readCompressedBody(body io.Reader) ([]byte, error) {
+	maxSize := a.MaxDecompressedSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxDecompressedSize
+	}
+	maxRatio := a.MaxCompressionRatio
+	if maxRatio <= 0 {
+		maxRatio = defaultMaxCompressionRatio
+	}
+
+	compressed := &countingReader{reader: body}
+	gz, err := gzip.NewReader(compressed)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var decompressed bytes.Buffer
+	chunk := make([]byte, 32<<10)
+	for {
+		n, err := gz.Read(chunk)
+		decompressed.Write(chunk[:n])
+
+		size := int64(decompressed.Len())
+		if size > maxSize {
+			return nil, errRequestTooLarge
+		}
+		if size > compressionRatioGracePeriod && size > compressed.count*int64(maxRatio) {
+			return nil, errRequestTooLarge
+		}
+
+		if err == io.EOF {
+			return decompressed.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// countingReader counts the bytes read from a reader.
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count += int64(n)
+
+	return n, err
+}
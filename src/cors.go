@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCORSHeaders are the request headers allowed by default in
+// cross-origin requests.
+var defaultCORSHeaders = []string{"Accept", "Authorization", "Content-Type", apiVersionHeader, tenantHeader, adminTokenHeader, requestIDHeader}
+
+// corsExposedHeaders are the response headers cross-origin callers may read
+// besides the ones always exposed.
+var corsExposedHeaders = []string{apiVersionHeader, "Deprecation", "Sunset", "Link", requestIDHeader}
+
+// corsOriginAllowed reports whether an origin matches one of the patterns,
+// where "*" matches any origin and a "*" within a pattern matches any
+// sequence of characters, like "https://*.example.com". wildcard reports
+// whether only the "*" pattern matched.
+func corsOriginAllowed(origin string, patterns []string) (allowed, wildcard bool) {
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			wildcard = true
+			continue
+		}
+		if strings.EqualFold(pattern, origin) {
+			return true, false
+		}
+
+		prefix, suffix, ok := strings.Cut(strings.ToLower(pattern), "*")
+		lower := strings.ToLower(origin)
+		if ok && len(lower) > len(prefix)+len(suffix) && strings.HasPrefix(lower, prefix) && strings.HasSuffix(lower, suffix) {
+			return true, false
+		}
+	}
+
+	return wildcard, wildcard
+}
+
+// allowOrigin sets the Access-Control-Allow-Origin header of an allowed
+// origin. Origins allowed by the "*" pattern get a literal "*", without
+// credentials, so that any site cannot act with the cookies of the user.
+func (a *App) allowOrigin(w http.ResponseWriter, origin string, wildcard bool) {
+	if wildcard {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if a.CORSCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// cors is a middleware letting the origins in CORSOrigins call the API. It
+// answers preflight requests itself, as they carry no tenant, and adds the
+// CORS headers to the responses of other requests. Requests from other
+// origins are served without them, for the browser to block.
+func (a *App) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(a.CORSOrigins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		allowed, wildcard := corsOriginAllowed(origin, a.CORSOrigins)
+
+		requestMethod := r.Header.Get("Access-Control-Request-Method")
+		if r.Method == http.MethodOptions && requestMethod != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+			if !allowed {
+				respondWithError(w, http.StatusForbidden, "Origin not allowed")
+				return
+			}
+			a.preflight(w, r, origin, wildcard, requestMethod)
+			return
+		}
+
+		if allowed {
+			a.allowOrigin(w, origin, wildcard)
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// preflight answers a preflight request of an allowed origin with the
+// methods of the route which are allowed by CORSMethods.
+func (a *App) preflight(w http.ResponseWriter, r *http.Request, origin string, wildcard bool, requestMethod string) {
+	routeMethods := a.routeMethods(r)
+	if len(routeMethods) == 0 {
+		respondWithError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	var methods []string
+	for _, m := range routeMethods {
+		if a.CORSMethods == nil || containsFold(a.CORSMethods, m) {
+			methods = append(methods, m)
+		}
+	}
+	if !containsFold(methods, requestMethod) {
+		respondWithError(w, http.StatusForbidden, "Method not allowed")
+		return
+	}
+
+	allowedHeaders := a.CORSHeaders
+	if allowedHeaders == nil {
+		allowedHeaders = defaultCORSHeaders
+	}
+	var headers []string
+	for _, h := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+		if !containsFold(allowedHeaders, h) {
+			respondWithError(w, http.StatusForbidden, "Header "+h+" not allowed")
+			return
+		}
+		headers = append(headers, h)
+	}
+
+	a.allowOrigin(w, origin, wildcard)
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(headers) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	}
+	if a.CORSMaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(a.CORSMaxAge/time.Second)))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+
+	return false
+}
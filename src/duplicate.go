@@ -0,0 +1,366 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// duplicateNameThreshold is the minimum similarity of two normalized names
+// for the products to be reported as duplicate candidates.
+const duplicateNameThreshold = 0.8
+
+const (
+	duplicateBarcode     = "barcode"
+	duplicateName        = "name"
+	duplicateSimilarName = "similar_name"
+)
+
+type duplicatePair struct {
+	ProductID   int     `json:"product_id"`
+	DuplicateID int     `json:"duplicate_id"`
+	Score       float64 `json:"score"`
+	Reason      string  `json:"reason"`
+}
+
+// duplicateCluster is a group of products connected by duplicate pairs. Its
+// score is that of its weakest pair.
+type duplicateCluster struct {
+	ProductIDs []int           `json:"product_ids"`
+	Score      float64         `json:"score"`
+	Pairs      []duplicatePair `json:"pairs"`
+}
+
+// normalizeName lowercases the name and reduces every run of characters
+// other than letters and digits to a single space, so that "Product 1" and
+// "product-1" compare equal.
+func normalizeName(name string) string {
+	fields := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	return strings.Join(fields, " ")
+}
+
+// nameSimilarity returns 1 minus the Levenshtein distance of the names
+// relative to the length of the longer one.
+func nameSimilarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 && len(rb) == 0 {
+		return 1
+	}
+
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(minInt(prev[j]+1, curr[j-1]+1), prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+
+	return 1 - float64(prev[len(rb)])/float64(longest)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// findDuplicates compares every pair of products by barcode and normalized
+// name.
+func findDuplicates(products []product) []duplicatePair {
+	names := make([]string, len(products))
+	for i, p := range products {
+		names[i] = normalizeName(p.Name)
+	}
+
+	var pairs []duplicatePair
+
+	for i := 0; i < len(products); i++ {
+		for j := i + 1; j < len(products); j++ {
+			pair := duplicatePair{ProductID: products[i].ID, DuplicateID: products[j].ID}
+
+			switch {
+			case products[i].Barcode != "" && products[i].Barcode == products[j].Barcode:
+				pair.Score, pair.Reason = 1, duplicateBarcode
+			case names[i] == names[j]:
+				pair.Score, pair.Reason = 1, duplicateName
+			default:
+				pair.Score, pair.Reason = nameSimilarity(names[i], names[j]), duplicateSimilarName
+			}
+
+			if pair.Score >= duplicateNameThreshold {
+				pairs = append(pairs, pair)
+			}
+		}
+	}
+
+	return pairs
+}
+
+// clusterDuplicates groups the pairs into connected components, strongest
+// clusters first.
+func clusterDuplicates(pairs []duplicatePair) []duplicateCluster {
+	parent := map[int]int{}
+	var find func(int) int
+	find = func(id int) int {
+		if _, ok := parent[id]; !ok {
+			parent[id] = id
+		}
+		if parent[id] != id {
+			parent[id] = find(parent[id])
+		}
+		return parent[id]
+	}
+
+	for _, pair := range pairs {
+		parent[find(pair.ProductID)] = find(pair.DuplicateID)
+	}
+
+	byRoot := map[int]*duplicateCluster{}
+	for _, pair := range pairs {
+		root := find(pair.ProductID)
+		c, ok := byRoot[root]
+		if !ok {
+			c = &duplicateCluster{Score: 1}
+			byRoot[root] = c
+		}
+		c.Pairs = append(c.Pairs, pair)
+		if pair.Score < c.Score {
+			c.Score = pair.Score
+		}
+	}
+
+	clusters := []duplicateCluster{}
+	for _, c := range byRoot {
+		seen := map[int]bool{}
+		for _, pair := range c.Pairs {
+			for _, id := range []int{pair.ProductID, pair.DuplicateID} {
+				if !seen[id] {
+					seen[id] = true
+					c.ProductIDs = append(c.ProductIDs, id)
+				}
+			}
+		}
+		sort.Ints(c.ProductIDs)
+		clusters = append(clusters, *c)
+	}
+
+	sort.Slice(clusters, func(i, j int) bool {
+		if clusters[i].Score != clusters[j].Score {
+			return clusters[i].Score > clusters[j].Score
+		}
+		return clusters[i].ProductIDs[0] < clusters[j].ProductIDs[0]
+	})
+
+	return clusters
+}
+
+// detectDuplicates replaces the stored duplicate pairs with those found
+// among the current products of each tenant.
+func detectDuplicates(db *sql.DB) error {
+	rows, err := db.Query("SELECT tenant_id, id, name, barcode FROM products ORDER BY id")
+	if err != nil {
+		return err
+	}
+
+	byTenant := map[int][]product{}
+	for rows.Next() {
+		var tenantID int
+		var p product
+		if err := rows.Scan(&tenantID, &p.ID, &p.Name, &p.Barcode); err != nil {
+			rows.Close()
+			return err
+		}
+		byTenant[tenantID] = append(byTenant[tenantID], p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM product_duplicates"); err != nil {
+		return err
+	}
+
+	for tenantID, products := range byTenant {
+		for _, pair := range findDuplicates(products) {
+			if _, err := tx.Exec("INSERT INTO product_duplicates(tenant_id, product_id, duplicate_id, score, reason) VALUES($1, $2, $3, $4, $5)",
+				tenantID, pair.ProductID, pair.DuplicateID, pair.Score, pair.Reason); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func getDuplicatePairs(db *sql.DB) ([]duplicatePair, error) {
+	rows, err := db.Query("SELECT product_id, duplicate_id, score, reason FROM product_duplicates ORDER BY product_id, duplicate_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pairs []duplicatePair
+
+	for rows.Next() {
+		var pair duplicatePair
+		if err := rows.Scan(&pair.ProductID, &pair.DuplicateID, &pair.Score, &pair.Reason); err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, pair)
+	}
+
+	return pairs, rows.Err()
+}
+
+// mergeProducts moves everything referencing the source products to the
+// target, adds their stock to it and deletes them, in a single transaction.
+// Rows that would collide with an existing row of the target are combined
+// where that is meaningful and dropped otherwise.
+func mergeProducts(db *sql.DB, targetID int, sourceIDs []int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	sources := pq.Array(sourceIDs)
+
+	var found int
+	err = tx.QueryRow("SELECT COUNT(*) FROM (SELECT id FROM products WHERE id=$1 OR id = ANY($2) FOR UPDATE) p",
+		targetID, sources).Scan(&found)
+	if err != nil {
+		return err
+	}
+	if found != len(sourceIDs)+1 {
+		return sql.ErrNoRows
+	}
+
+	statements := []string{
+		"UPDATE reviews SET product_id=$1 WHERE product_id = ANY($2)",
+		"UPDATE price_watches SET product_id=$1 WHERE product_id = ANY($2)",
+		"UPDATE order_items SET product_id=$1 WHERE product_id = ANY($2)",
+		`INSERT INTO supplier_products(supplier_id, product_id, supplier_sku, cost_price, lead_time_days)
+		SELECT DISTINCT ON (supplier_id) supplier_id, $1::int, supplier_sku, cost_price, lead_time_days
+		FROM supplier_products WHERE product_id = ANY($2) ORDER BY supplier_id, cost_price
+		ON CONFLICT DO NOTHING`,
+		`INSERT INTO wishlist_items(customer, product_id, added_at)
+		SELECT customer, $1::int, MIN(added_at) FROM wishlist_items WHERE product_id = ANY($2) GROUP BY customer
+		ON CONFLICT DO NOTHING`,
+		`INSERT INTO cart_items(cart_id, product_id, quantity, unit_price)
+		SELECT cart_id, $1::int, SUM(quantity), (SELECT price FROM products WHERE id=$1)
+		FROM cart_items WHERE product_id = ANY($2) GROUP BY cart_id
+		ON CONFLICT (cart_id, product_id) DO UPDATE SET quantity = cart_items.quantity + EXCLUDED.quantity`,
+		`INSERT INTO product_views(product_id, bucket, views)
+		SELECT $1::int, bucket, SUM(views) FROM product_views WHERE product_id = ANY($2) GROUP BY bucket
+		ON CONFLICT (product_id, bucket) DO UPDATE SET views = product_views.views + EXCLUDED.views`,
+		`INSERT INTO product_relations(product_id, related_id, relation_type, position, quantity)
+		SELECT * FROM (
+			SELECT CASE WHEN product_id = ANY($2) THEN $1::int ELSE product_id END AS product_id,
+				CASE WHEN related_id = ANY($2) THEN $1::int ELSE related_id END AS related_id,
+				relation_type, position, quantity
+			FROM product_relations WHERE product_id = ANY($2) OR related_id = ANY($2)) r
+		WHERE r.product_id <> r.related_id
+		ON CONFLICT DO NOTHING`,
+		"UPDATE products SET stock = stock + (SELECT COALESCE(SUM(stock), 0) FROM products WHERE id = ANY($2)) WHERE id=$1",
+		"DELETE FROM products WHERE id = ANY($2)",
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, targetID, sources); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (a *App) getDuplicates(w http.ResponseWriter, r *http.Request) {
+	pairs, err := getDuplicatePairs(a.db(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, clusterDuplicates(pairs))
+}
+
+func (a *App) mergeProducts(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		TargetID  int   `json:"target_id"`
+		SourceIDs []int `json:"source_ids"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if len(request.SourceIDs) == 0 {
+		respondWithError(w, http.StatusBadRequest, "At least one source product is required")
+		return
+	}
+	seen := map[int]bool{request.TargetID: true}
+	for _, id := range request.SourceIDs {
+		if seen[id] {
+			respondWithError(w, http.StatusBadRequest, "Source products must be distinct from each other and the target")
+			return
+		}
+		seen[id] = true
+	}
+
+	if err := mergeProducts(a.db(r), request.TargetID, request.SourceIDs); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Product not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	p := product{ID: request.TargetID}
+	if err := p.getProduct(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	tenantID := tenantFromRequest(r).ID
+	for _, id := range request.SourceIDs {
+		a.events.publish(productEvent{Type: productDeleted, TenantID: tenantID, Product: product{ID: id}})
+	}
+	a.events.publish(productEvent{Type: productUpdated, TenantID: tenantID, Product: p})
+
+	respond(w, http.StatusOK, p)
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/mdumfart/go-mux/productpb"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	// errNotRepresentable is returned by encoders for payloads they have no
+	// representation of, like objects in CSV.
+	errNotRepresentable = errors.New("payload cannot be represented in the media type")
+
+	errUnsupportedMediaType = errors.New("unsupported media type")
+)
+
+// encoder writes response payloads in one media type. Its first media type
+// is the one sent as Content-Type, the others are accepted aliases.
+// represents tells from the documented response schema of a route whether
+// the encoder can write its payloads; nil means any payload.
+type encoder struct {
+	mediaTypes  []string
+	contentType string
+	encode      func(payload interface{}, rc responseContext) ([]byte, error)
+	represents  func(schema *apiSchema) bool
+}
+
+// responseContext is what encoders know about the response besides its
+// payload. The request and router are nil for responses written outside of
+// negotiateContent.
+type responseContext struct {
+	code    int
+	request *http.Request
+	router  *mux.Router
+}
+
+// encoders are the media types responses are available in, in order of
+// preference for Accept headers with wildcards. Requests without an Accept
+// header get JSON.
+var encoders = []*encoder{
+	{mediaTypes: []string{"application/json"}, contentType: "application/json", encode: encodeJSON},
+	{mediaTypes: []string{"application/vnd.api+json"}, contentType: "application/vnd.api+json", encode: encodeJSONAPI},
+	{mediaTypes: []string{"application/hal+json"}, contentType: "application/hal+json", encode: encodeHAL},
+	{mediaTypes: []string{"application/xml", "text/xml"}, contentType: "application/xml; charset=utf-8", encode: encodeXML},
+	{mediaTypes: []string{"text/csv"}, contentType: "text/csv; charset=utf-8", encode: encodeCSV, represents: isObjectList},
+	{mediaTypes: []string{"application/msgpack", "application/x-msgpack", "application/vnd.msgpack"}, contentType: "application/msgpack", encode: encodeMsgpack},
+	{mediaTypes: []string{"application/x-protobuf", "application/protobuf"}, contentType: "application/x-protobuf", encode: encodeProtobuf, represents: isProductSchema},
+}
+
+// isObjectList reports whether a response schema is a list of objects, the
+// payloads encodeCSV can write.
+func isObjectList(schema *apiSchema) bool {
+	return schema.Type == "array" && schema.Items != nil && (schema.Items.Ref != "" || schema.Items.Type == "object")
+}
+
+// isProductSchema reports whether a response schema is a product or a list
+// of products, the payloads encodeProtobuf can write.
+func isProductSchema(schema *apiSchema) bool {
+	product := schemaRef("product").Ref
+	if schema.Type == "array" && schema.Items != nil {
+		return schema.Items.Ref == product
+	}
+
+	return schema.Ref == product
+}
+
+// decoders read request bodies by media type. Only the handlers creating or
+// updating products accept other media types than JSON.
+var decoders = map[string]func(body io.Reader, v interface{}) error{
+	"application/json":         func(body io.Reader, v interface{}) error { return json.NewDecoder(body).Decode(v) },
+	"application/hal+json":     func(body io.Reader, v interface{}) error { return json.NewDecoder(body).Decode(v) },
+	"application/vnd.api+json": decodeJSONAPI,
+	"application/xml":          func(body io.Reader, v interface{}) error { return xml.NewDecoder(body).Decode(v) },
+	"text/xml":                 func(body io.Reader, v interface{}) error { return xml.NewDecoder(body).Decode(v) },
+	"application/msgpack":      decodeMsgpack,
+	"application/x-msgpack":    decodeMsgpack,
+	"application/vnd.msgpack":  decodeMsgpack,
+	"application/x-protobuf":   decodeProtobuf,
+	"application/protobuf":     decodeProtobuf,
+}
+
+func (e *encoder) matches(mediaRange string) bool {
+	if mediaRange == "*/*" {
+		return true
+	}
+	for _, t := range e.mediaTypes {
+		if t == mediaRange || strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(t, strings.TrimSuffix(mediaRange, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type mediaRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept returns the media ranges of an Accept header, the most
+// preferred first. Invalid ranges are skipped.
+func parseAccept(header string) []mediaRange {
+	var ranges []mediaRange
+	for _, part := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		ranges = append(ranges, mediaRange{mediaType: mediaType, q: q})
+	}
+
+	// more specific ranges take precedence at the same quality
+	specificity := func(r mediaRange) int {
+		switch {
+		case r.mediaType == "*/*":
+			return 0
+		case strings.HasSuffix(r.mediaType, "/*"):
+			return 1
+		}
+		return 2
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].q != ranges[j].q {
+			return ranges[i].q > ranges[j].q
+		}
+		return specificity(ranges[i]) > specificity(ranges[j])
+	})
+
+	return ranges
+}
+
+// negotiateEncoder returns the encoder of the media type preferred by an
+// Accept header, or nil if none of them is acceptable. With a response
+// schema, encoders that cannot represent it are skipped.
+func negotiateEncoder(accept string, schema *apiSchema) *encoder {
+	if strings.TrimSpace(accept) == "" {
+		return encoders[0]
+	}
+
+	ranges := parseAccept(accept)
+
+	// media types explicitly refused with q=0 are not matched by wildcards
+	refused := func(e *encoder) bool {
+		for _, r := range ranges {
+			if r.q == 0 && r.mediaType != "*/*" && !strings.HasSuffix(r.mediaType, "/*") && e.matches(r.mediaType) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, r := range ranges {
+		if r.q == 0 {
+			continue
+		}
+		for _, e := range encoders {
+			if e.matches(r.mediaType) && !refused(e) && (schema == nil || e.represents == nil || e.represents(schema)) {
+				return e
+			}
+		}
+	}
+
+	return nil
+}
+
+// negotiatedResponse carries the encoder selected for a request to respond.
+// A nil encoder means no acceptable media type is available.
+type negotiatedResponse struct {
+	http.ResponseWriter
+	encoder *encoder
+	request *http.Request
+	router  *mux.Router
+}
+
+// negotiateContent is a middleware selecting the encoder of every response
+// from the Accept header of the request. Requests to documented routes whose
+// responses cannot be written in an acceptable media type are refused with a
+// 406 before their handler runs, so they have no effect.
+func (a *App) negotiateContent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+
+		route, documented := documentedRoute(r)
+		e := negotiateEncoder(r.Header.Get("Accept"), route.Response)
+		if e == nil && documented && route.MediaType == "" {
+			respondNotAcceptable(w)
+			return
+		}
+
+		next.ServeHTTP(&negotiatedResponse{
+			ResponseWriter: w,
+			encoder:        e,
+			request:        r,
+			router:         a.Router,
+		}, r)
+	})
+}
+
+func respondNotAcceptable(w http.ResponseWriter) {
+	var available []string
+	for _, e := range encoders {
+		available = append(available, e.mediaTypes[0])
+	}
+
+	respondWithJSON(w, http.StatusNotAcceptable, map[string]interface{}{
+		"error":   "No acceptable media type for the response",
+		"details": available,
+	})
+}
+
+// respond writes the payload in the media type negotiated by
+// negotiateContent. Errors are sent as JSON if the media type has no
+// representation of them, other payloads are refused with a 406.
+func respond(w http.ResponseWriter, code int, payload interface{}) {
+	e := encoders[0]
+	rc := responseContext{code: code}
+	if n, ok := w.(*negotiatedResponse); ok {
+		e, rc.request, rc.router = n.encoder, n.request, n.router
+	}
+
+	if rc.request != nil && code < http.StatusBadRequest && requestAPIVersion(rc.request) >= 2 {
+		payload = envelopeList(payload)
+	}
+
+	var response []byte
+	err := errNotRepresentable
+	if e != nil {
+		response, err = e.encode(payload, rc)
+	}
+
+	switch {
+	case err == errNotRepresentable && code >= http.StatusBadRequest:
+		respondWithJSON(w, code, payload)
+		return
+	case err == errNotRepresentable:
+		respondNotAcceptable(w)
+		return
+	case err != nil:
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", e.contentType)
+	w.WriteHeader(code)
+	w.Write(response)
+}
+
+// requestMediaType returns the media type of the request body, JSON if the
+// request doesn't say.
+func requestMediaType(r *http.Request) string {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return "application/json"
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+
+	return mediaType
+}
+
+// decodeRequest decodes the request body into v with the decoder of its
+// Content-Type, returning errUnsupportedMediaType if there is none.
+func decodeRequest(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+
+	decode, ok := decoders[requestMediaType(r)]
+	if !ok {
+		return errUnsupportedMediaType
+	}
+
+	return decode(r.Body, v)
+}
+
+// orderedObject is a JSON object which keeps its fields in the order they
+// were set, for representations where the order is visible.
+type orderedObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newOrderedObject() *orderedObject {
+	return &orderedObject{values: map[string]interface{}{}}
+}
+
+func (o *orderedObject) set(key string, value interface{}) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *orderedObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+// toOrdered converts a payload to its JSON value, with objects as
+// orderedObject and numbers as json.Number, so encoders of other media
+// types see the same fields in the same order as JSON clients.
+func toOrdered(payload interface{}) (interface{}, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	return decodeOrdered(dec)
+}
+
+func decodeOrdered(dec *json.Decoder) (interface{}, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token {
+	case json.Delim('{'):
+		object := newOrderedObject()
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			object.set(key.(string), value)
+		}
+		_, err := dec.Token()
+		return object, err
+	case json.Delim('['):
+		list := []interface{}{}
+		for dec.More() {
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err := dec.Token()
+		return list, err
+	}
+
+	return token, nil
+}
+
+func encodeJSON(payload interface{}, rc responseContext) ([]byte, error) {
+	return json.Marshal(payload)
+}
+
+// encodeXML writes the JSON value of the payload as XML: object fields
+// become elements named after them, list items become item elements and
+// null values are marked with a nil attribute.
+func encodeXML(payload interface{}, rc responseContext) ([]byte, error) {
+	value, err := toOrdered(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+
+	enc := xml.NewEncoder(&buf)
+	if err := writeXML(enc, xml.StartElement{Name: xml.Name{Local: "response"}}, value); err != nil {
+		return nil, err
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writeXML(enc *xml.Encoder, start xml.StartElement, value interface{}) error {
+	if value == nil {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "nil"}, Value: "true"})
+	}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case *orderedObject:
+		for _, key := range v.keys {
+			child := xml.StartElement{Name: xml.Name{Local: key}}
+			if !isXMLName(key) {
+				child = xml.StartElement{Name: xml.Name{Local: "entry"}, Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: key}}}
+			}
+			if err := writeXML(enc, child, v.values[key]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err := writeXML(enc, xml.StartElement{Name: xml.Name{Local: "item"}}, item); err != nil {
+				return err
+			}
+		}
+	case nil:
+	default:
+		if err := enc.EncodeToken(xml.CharData(scalarString(v))); err != nil {
+			return err
+		}
+	}
+
+	return enc.EncodeToken(start.End())
+}
+
+func isXMLName(name string) bool {
+	if name == "" || strings.HasPrefix(strings.ToLower(name), "xml") {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c == '_' || isLetter(c) || i > 0 && (isDigit(c) || c == '-' || c == '.')) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func scalarString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	}
+
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// encodeCSV writes a list of objects as CSV with a header row. Nested
+// objects are flattened into columns like rating.average, nested lists are
+// written as JSON. Other payloads have no CSV representation.
+func encodeCSV(payload interface{}, rc responseContext) ([]byte, error) {
+	value, err := toOrdered(unwrapList(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, errNotRepresentable
+	}
+
+	var columns []string
+	seen := map[string]bool{}
+	rows := make([]map[string]string, 0, len(list))
+
+	for _, item := range list {
+		object, ok := item.(*orderedObject)
+		if !ok {
+			return nil, errNotRepresentable
+		}
+
+		row := map[string]string{}
+		flattenCSV("", object, row, func(column string) {
+			if !seen[column] {
+				seen[column] = true
+				columns = append(columns, column)
+			}
+		})
+		rows = append(rows, row)
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if len(columns) > 0 {
+		w.Write(columns)
+	}
+	for _, row := range rows {
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			record[i] = row[column]
+		}
+		w.Write(record)
+	}
+	w.Flush()
+
+	return buf.Bytes(), w.Error()
+}
+
+func flattenCSV(prefix string, object *orderedObject, row map[string]string, addColumn func(string)) {
+	for _, key := range object.keys {
+		column := prefix + key
+		if nested, ok := object.values[key].(*orderedObject); ok {
+			flattenCSV(column+".", nested, row, addColumn)
+			continue
+		}
+
+		addColumn(column)
+		row[column] = scalarString(object.values[key])
+	}
+}
+
+// encodeMsgpack writes the JSON value of the payload as MessagePack, so it
+// has the same fields in the same order as the JSON representation.
+func encodeMsgpack(payload interface{}, rc responseContext) ([]byte, error) {
+	value, err := toOrdered(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := writeMsgpack(msgpack.NewEncoder(&buf), value); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writeMsgpack(enc *msgpack.Encoder, value interface{}) error {
+	switch v := value.(type) {
+	case *orderedObject:
+		if err := enc.EncodeMapLen(len(v.keys)); err != nil {
+			return err
+		}
+		for _, key := range v.keys {
+			if err := enc.EncodeString(key); err != nil {
+				return err
+			}
+			if err := writeMsgpack(enc, v.values[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		if err := enc.EncodeArrayLen(len(v)); err != nil {
+			return err
+		}
+		for _, item := range v {
+			if err := writeMsgpack(enc, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return enc.EncodeInt(n)
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		return enc.EncodeFloat64(f)
+	}
+
+	return enc.Encode(value)
+}
+
+func decodeMsgpack(body io.Reader, v interface{}) error {
+	dec := msgpack.NewDecoder(body)
+	dec.SetCustomStructTag("json")
+
+	return dec.Decode(v)
+}
+
+// encodeProtobuf writes products and lists of products as the messages of
+// the gRPC product service. Other payloads have no protobuf representation.
+func encodeProtobuf(payload interface{}, rc responseContext) ([]byte, error) {
+	switch v := unwrapList(payload).(type) {
+	case product:
+		return proto.Marshal(v.toProto())
+	case []product:
+		return proto.Marshal(productsToProto(v))
+	}
+
+	return nil, errNotRepresentable
+}
+
+// decodeProtobuf reads a product message. Only products can be decoded.
+func decodeProtobuf(body io.Reader, v interface{}) error {
+	p, ok := v.(*product)
+	if !ok {
+		return errUnsupportedMediaType
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	var message productpb.Product
+	if err := proto.Unmarshal(data, &message); err != nil {
+		return err
+	}
+
+	// keep the defaults set by the handler for fields missing in the message
+	decoded := productFromProto(&message)
+	if message.Published == nil {
+		decoded.Published = p.Published
+	}
+	*p = decoded
+
+	return nil
+}
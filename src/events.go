@@ -0,0 +1,70 @@
+package main
+
+import "sync"
+
+// Types of product events.
+const (
+	productCreated = "created"
+	productUpdated = "updated"
+	productDeleted = "deleted"
+)
+
+// productEvent is a change to a product of a tenant. Only the ID is set for
+// deleted products.
+type productEvent struct {
+	Type     string
+	TenantID int
+	Product  product
+}
+
+// productEventBuffer is the number of events a subscriber may fall behind
+// before it is dropped.
+const productEventBuffer = 64
+
+// productEventHub fans out product events to the subscribers of a tenant.
+// Publishing never blocks the handler making the change.
+type productEventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan productEvent]int
+}
+
+func newProductEventHub() *productEventHub {
+	return &productEventHub{subscribers: map[chan productEvent]int{}}
+}
+
+// subscribe returns a channel receiving the events of the tenant until it
+// is passed to unsubscribe. A subscriber falling more than
+// productEventBuffer events behind is dropped instead of missing events
+// silently: its channel is closed after the buffered events.
+func (h *productEventHub) subscribe(tenantID int) chan productEvent {
+	ch := make(chan productEvent, productEventBuffer)
+
+	h.mu.Lock()
+	h.subscribers[ch] = tenantID
+	h.mu.Unlock()
+
+	return ch
+}
+
+func (h *productEventHub) unsubscribe(ch chan productEvent) {
+	h.mu.Lock()
+	delete(h.subscribers, ch)
+	h.mu.Unlock()
+}
+
+func (h *productEventHub) publish(e productEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch, tenantID := range h.subscribers {
+		if tenantID != e.TenantID {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
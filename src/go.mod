@@ -1,8 +1,37 @@
 module github.com/mdumfart/go-mux
 
-go 1.18
+// Go 1.25 is the minimum of google.golang.org/grpc v1.84, which the gRPC
+// service is generated for. The listeners need Go 1.24 anyway for
+// http.Protocols, which serves HTTP/2 without TLS.
+go 1.25.0
 
 require (
-	github.com/gorilla/mux v1.8.0 // indirect
-	github.com/lib/pq v1.10.5 // indirect
+	github.com/99designs/gqlgen v0.17.94
+	github.com/andybalholm/brotli v1.2.5
+	github.com/gorilla/mux v1.8.0
+	github.com/lib/pq v1.10.5
+	github.com/vektah/gqlparser/v2 v2.5.36
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	google.golang.org/grpc v1.84.0
+	google.golang.org/protobuf v1.36.11
 )
+
+require (
+	github.com/agnivade/levenshtein v1.2.1 // indirect
+	github.com/go-viper/mapstructure/v2 v2.5.0 // indirect
+	github.com/goccy/go-yaml v1.19.2 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
+	github.com/sosodev/duration v1.4.0 // indirect
+	github.com/urfave/cli/v3 v3.10.1 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	golang.org/x/mod v0.38.0 // indirect
+	golang.org/x/net v0.57.0 // indirect
+	golang.org/x/sync v0.22.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+	golang.org/x/tools v0.48.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260706201446-f0a921348800 // indirect
+)
+
+tool github.com/99designs/gqlgen
@@ -0,0 +1,6 @@
+// Package graph contains the GraphQL executable schema of the product
+// catalog, generated by gqlgen from schema.graphqls. The resolvers are
+// implemented by the API.
+package graph
+
+//go:generate go tool gqlgen generate --config gqlgen.yml
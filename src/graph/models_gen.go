@@ -0,0 +1,53 @@
+// Code generated by github.com/99designs/gqlgen, DO NOT EDIT.
+
+package graph
+
+type Mutation struct {
+}
+
+type Product struct {
+	ID            int     `json:"id"`
+	Name          string  `json:"name"`
+	Price         float64 `json:"price"`
+	Stock         int     `json:"stock"`
+	Published     bool    `json:"published"`
+	Barcode       string  `json:"barcode"`
+	Weight        float64 `json:"weight"`
+	WeightUnit    string  `json:"weightUnit"`
+	Length        float64 `json:"length"`
+	Width         float64 `json:"width"`
+	Height        float64 `json:"height"`
+	DimensionUnit string  `json:"dimensionUnit"`
+	Rating        *Rating `json:"rating"`
+}
+
+type ProductInput struct {
+	Name          *string  `json:"name,omitempty"`
+	Price         *float64 `json:"price,omitempty"`
+	Stock         *int     `json:"stock,omitempty"`
+	Published     *bool    `json:"published,omitempty"`
+	Barcode       *string  `json:"barcode,omitempty"`
+	Weight        *float64 `json:"weight,omitempty"`
+	WeightUnit    *string  `json:"weightUnit,omitempty"`
+	Length        *float64 `json:"length,omitempty"`
+	Width         *float64 `json:"width,omitempty"`
+	Height        *float64 `json:"height,omitempty"`
+	DimensionUnit *string  `json:"dimensionUnit,omitempty"`
+}
+
+type Query struct {
+}
+
+// The average and count of the approved reviews of a product.
+type Rating struct {
+	Average float64 `json:"average"`
+	Count   int     `json:"count"`
+}
+
+type Relation struct {
+	Type     string `json:"type"`
+	Position int    `json:"position"`
+	Quantity int    `json:"quantity"`
+	// The ID of the related product, which is resolved by Relation.product.
+	RelatedID int `json:"-"`
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/99designs/gqlgen/complexity"
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/executor"
+	"github.com/99designs/gqlgen/graphql/handler/extension"
+	"github.com/99designs/gqlgen/graphql/handler/lru"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+
+	"github.com/mdumfart/go-mux/graph"
+)
+
+// graphqlMaxComplexity caps the estimated cost of a GraphQL operation: one
+// per field, with the fields below a list counted once per expected item.
+const graphqlMaxComplexity = 1000
+
+// graphqlDefaultListSize is the number of items expected of a list field
+// without a count argument.
+const graphqlDefaultListSize = 10
+
+// graphqlMaxDepth caps the nesting of the selections of an operation.
+const graphqlMaxDepth = 8
+
+// gqlLoaderWait is how long a gqlLoader collects keys before fetching them.
+const gqlLoaderWait = time.Millisecond
+
+type gqlResponse struct {
+	Data   json.RawMessage `json:"data,omitempty"`
+	Errors gqlerror.List   `json:"errors,omitempty"`
+}
+
+// newGraphQLExecutor returns the executor of the schema in package graph,
+// resolved by the app.
+func (a *App) newGraphQLExecutor() *executor.Executor {
+	schema := gqlCostSchema{graph.NewExecutableSchema(graph.Config{Resolvers: &gqlResolver{app: a}})}
+
+	exec := executor.New(schema)
+	exec.SetQueryCache(lru.New[*ast.QueryDocument](1000))
+	exec.Use(extension.Introspection{})
+	exec.Use(gqlLimits{schema: schema})
+
+	return exec
+}
+
+// gqlCostSchema estimates the complexity of fields like the REST endpoints
+// serve them: lists with a count argument return at most a page of the
+// tenant, other lists are expected to have graphqlDefaultListSize items.
+type gqlCostSchema struct {
+	graphql.ExecutableSchema
+}
+
+func (s gqlCostSchema) Complexity(ctx context.Context, typeName, fieldName string, childComplexity int, args map[string]any) (int, bool) {
+	def := s.Schema().Types[typeName]
+	if def == nil || strings.HasPrefix(typeName, "__") {
+		return 0, false
+	}
+	field := def.Fields.ForName(fieldName)
+	if field == nil {
+		return 0, false
+	}
+
+	items := 1
+	if field.Arguments.ForName("count") != nil {
+		count, _ := graphql.UnmarshalInt(args["count"])
+		items = tenantFromContext(ctx).pageSize(count)
+	} else if field.Type.Elem != nil {
+		items = graphqlDefaultListSize
+	}
+
+	return saturatingCost(1, items, childComplexity), true
+}
+
+// saturatingCost adds the costs of n items of the given cost to a total,
+// saturating above graphqlMaxComplexity so that the sum cannot overflow.
+func saturatingCost(total, n, cost int) int {
+	if cost > 0 && n > (graphqlMaxComplexity+1-total)/cost {
+		return graphqlMaxComplexity + 1
+	}
+
+	return total + n*cost
+}
+
+// gqlLimits refuses operations nested deeper than graphqlMaxDepth or more
+// complex than graphqlMaxComplexity before they are executed.
+type gqlLimits struct {
+	schema graphql.ExecutableSchema
+}
+
+func (gqlLimits) ExtensionName() string { return "Limits" }
+
+func (gqlLimits) Validate(schema graphql.ExecutableSchema) error { return nil }
+
+func (l gqlLimits) MutateOperationContext(ctx context.Context, opCtx *graphql.OperationContext) *gqlerror.Error {
+	if selectionDepth(opCtx.Operation.SelectionSet) > graphqlMaxDepth {
+		return gqlerror.Errorf("Query depth exceeds the limit of %d", graphqlMaxDepth)
+	}
+	if complexity.Calculate(ctx, l.schema, opCtx.Operation, opCtx.Variables) > graphqlMaxComplexity {
+		return gqlerror.Errorf("Query complexity exceeds the limit of %d", graphqlMaxComplexity)
+	}
+
+	return nil
+}
+
+// selectionDepth returns the nesting of the fields of a selection set.
+// Fragments don't add to it, and introspection fields count as one.
+func selectionDepth(set ast.SelectionSet) int {
+	depth := 0
+	for _, sel := range set {
+		var d int
+		switch sel := sel.(type) {
+		case *ast.Field:
+			d = 1
+			if !strings.HasPrefix(sel.Name, "__") {
+				d += selectionDepth(sel.SelectionSet)
+			}
+		case *ast.InlineFragment:
+			d = selectionDepth(sel.SelectionSet)
+		case *ast.FragmentSpread:
+			d = selectionDepth(sel.Definition.SelectionSet)
+		}
+		depth = max(depth, d)
+	}
+
+	return depth
+}
+
+// gqlResolver resolves the schema in package graph from the tenant's
+// database.
+type gqlResolver struct {
+	app *App
+}
+
+func (r *gqlResolver) Query() graph.QueryResolver       { return gqlQuery{r} }
+func (r *gqlResolver) Mutation() graph.MutationResolver { return gqlMutation{r} }
+func (r *gqlResolver) Product() graph.ProductResolver   { return gqlProduct{r} }
+func (r *gqlResolver) Relation() graph.RelationResolver { return gqlRelation{r} }
+
+type gqlQuery struct{ *gqlResolver }
+type gqlMutation struct{ *gqlResolver }
+type gqlProduct struct{ *gqlResolver }
+type gqlRelation struct{ *gqlResolver }
+
+func (r *gqlResolver) db(ctx context.Context) *sql.DB {
+	return r.app.tenantDB(tenantFromContext(ctx).ID)
+}
+
+// channel resolves the channel argument like the channel query parameter of
+// the REST endpoints.
+func (r *gqlResolver) channel(ctx context.Context, code *string) (int, error) {
+	if code == nil || *code == "" {
+		return 0, nil
+	}
+
+	c := channel{Code: *code}
+	if err := c.getChannelByCode(r.db(ctx)); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, errors.New("Channel not found")
+		}
+		return 0, err
+	}
+
+	return c.ID, nil
+}
+
+func (r gqlQuery) Product(ctx context.Context, id int, channel *string) (*graph.Product, error) {
+	channelID, err := r.channel(ctx, channel)
+	if err != nil {
+		return nil, err
+	}
+
+	p := product{ID: id}
+	switch err := p.getChannelProduct(r.db(ctx), channelID, nil); err {
+	case nil:
+		return p.toGraph(), nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (r gqlQuery) Products(ctx context.Context, start, count *int, minRating *float64, sort, channel *string) ([]*graph.Product, error) {
+	channelID, err := r.channel(ctx, channel)
+	if err != nil {
+		return nil, err
+	}
+
+	f := productFilter{Channel: channelID}
+	if start != nil && *start > 0 {
+		f.Start = *start
+	}
+	if count != nil {
+		f.Count = *count
+	}
+	if minRating != nil {
+		if *minRating < minReviewRating || *minRating > maxReviewRating {
+			return nil, errors.New("Invalid minimum rating")
+		}
+		f.MinRating = *minRating
+	}
+	if sort != nil {
+		f.Sort = *sort
+	}
+
+	f.Count = tenantFromContext(ctx).pageSize(f.Count)
+	if _, ok := productSortOrders[f.Sort]; f.Sort != "" && !ok {
+		return nil, errors.New("Invalid sort order")
+	}
+
+	products, err := getProducts(r.db(ctx), f)
+	if err != nil {
+		return nil, err
+	}
+
+	return productsToGraph(products), nil
+}
+
+func (r gqlQuery) SearchProducts(ctx context.Context, name string, start, count *int, channel *string) ([]*graph.Product, error) {
+	if name == "" {
+		return nil, errors.New("Invalid search term for name")
+	}
+
+	channelID, err := r.channel(ctx, channel)
+	if err != nil {
+		return nil, err
+	}
+
+	from, n := 0, 0
+	if start != nil && *start > 0 {
+		from = *start
+	}
+	if count != nil {
+		n = *count
+	}
+
+	p := product{Name: name}
+	products, err := p.searchProducts(r.db(ctx), channelID, nil, from, tenantFromContext(ctx).pageSize(n))
+	if err != nil {
+		return nil, err
+	}
+
+	return productsToGraph(products), nil
+}
+
+func (r gqlQuery) ProductCount(ctx context.Context, channel *string) (int, error) {
+	channelID, err := r.channel(ctx, channel)
+	if err != nil {
+		return 0, err
+	}
+
+	return (&product{}).getNumberOfProducts(r.db(ctx), channelID)
+}
+
+func (r gqlMutation) CreateProduct(ctx context.Context, input graph.ProductInput) (*graph.Product, error) {
+	// products are published unless the input says otherwise
+	p := product{Published: true}
+	applyProductInput(&p, input)
+
+	if err := r.app.addProduct(r.db(ctx), tenantFromContext(ctx), &p); err != nil {
+		return nil, err
+	}
+
+	return p.toGraph(), nil
+}
+
+func (r gqlMutation) UpdateProduct(ctx context.Context, id int, input graph.ProductInput) (*graph.Product, error) {
+	db := r.db(ctx)
+
+	p := product{ID: id}
+	if err := p.getProduct(db); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	applyProductInput(&p, input)
+
+	if err := r.app.saveProduct(db, tenantFromContext(ctx), &p); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return p.toGraph(), nil
+}
+
+func (r gqlMutation) DeleteProduct(ctx context.Context, id int) (bool, error) {
+	if err := r.app.removeProduct(r.db(ctx), tenantFromContext(ctx), id); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (r gqlProduct) Related(ctx context.Context, obj *graph.Product, relationType *string) ([]*graph.Relation, error) {
+	key := relationKey{productID: obj.ID}
+	if relationType != nil {
+		key.relationType = *relationType
+	}
+	if key.relationType != "" && !relationTypes[key.relationType] {
+		return nil, errors.New("Invalid relation type")
+	}
+
+	relations, err := gqlLoadersFromContext(ctx).relations.load(key)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]*graph.Relation, len(relations))
+	for i, rel := range relations {
+		values[i] = &graph.Relation{Type: rel.Type, Position: rel.Position, Quantity: rel.Quantity, RelatedID: rel.RelatedID}
+	}
+
+	return values, nil
+}
+
+func (r gqlRelation) Product(ctx context.Context, obj *graph.Relation) (*graph.Product, error) {
+	p, err := gqlLoadersFromContext(ctx).products.load(obj.RelatedID)
+	if err != nil || p == nil {
+		return nil, err
+	}
+
+	return p.toGraph(), nil
+}
+
+func (p product) toGraph() *graph.Product {
+	g := &graph.Product{
+		ID:            p.ID,
+		Name:          p.Name,
+		Price:         p.Price,
+		Stock:         p.Stock,
+		Published:     p.Published,
+		Barcode:       p.Barcode,
+		Weight:        p.Weight,
+		WeightUnit:    p.WeightUnit,
+		Length:        p.Length,
+		Width:         p.Width,
+		Height:        p.Height,
+		DimensionUnit: p.DimensionUnit,
+		Rating:        &graph.Rating{},
+	}
+	if p.Rating != nil {
+		g.Rating = &graph.Rating{Average: p.Rating.Average, Count: p.Rating.Count}
+	}
+
+	return g
+}
+
+func productsToGraph(products []product) []*graph.Product {
+	list := make([]*graph.Product, len(products))
+	for i, p := range products {
+		list[i] = p.toGraph()
+	}
+
+	return list
+}
+
+// applyProductInput copies the fields given in a ProductInput to p.
+func applyProductInput(p *product, input graph.ProductInput) {
+	if input.Name != nil {
+		p.Name = *input.Name
+	}
+	if input.Price != nil {
+		p.Price = *input.Price
+	}
+	if input.Stock != nil {
+		p.Stock = *input.Stock
+	}
+	if input.Published != nil {
+		p.Published = *input.Published
+	}
+	if input.Barcode != nil {
+		p.Barcode = *input.Barcode
+	}
+	if input.Weight != nil {
+		p.Weight = *input.Weight
+	}
+	if input.WeightUnit != nil {
+		p.WeightUnit = *input.WeightUnit
+	}
+	if input.Length != nil {
+		p.Length = *input.Length
+	}
+	if input.Width != nil {
+		p.Width = *input.Width
+	}
+	if input.Height != nil {
+		p.Height = *input.Height
+	}
+	if input.DimensionUnit != nil {
+		p.DimensionUnit = *input.DimensionUnit
+	}
+}
+
+// gqlLoader batches the loads of a GraphQL request like a dataloader: the
+// keys loaded by the fields resolved concurrently within gqlLoaderWait are
+// fetched at once, and every key is fetched once per request.
+type gqlLoader[K comparable, V any] struct {
+	fetch func(keys []K) (map[K]V, error)
+
+	mu      sync.Mutex
+	pending *gqlBatch[K, V]
+	batches map[K]*gqlBatch[K, V]
+}
+
+type gqlBatch[K comparable, V any] struct {
+	keys   []K
+	values map[K]V
+	err    error
+	done   chan struct{}
+}
+
+func newGQLLoader[K comparable, V any](fetch func(keys []K) (map[K]V, error)) *gqlLoader[K, V] {
+	return &gqlLoader[K, V]{fetch: fetch, batches: map[K]*gqlBatch[K, V]{}}
+}
+
+func (l *gqlLoader[K, V]) load(key K) (V, error) {
+	l.mu.Lock()
+	b, ok := l.batches[key]
+	if !ok {
+		if l.pending == nil {
+			l.pending = &gqlBatch[K, V]{done: make(chan struct{})}
+			time.AfterFunc(gqlLoaderWait, l.run)
+		}
+		b = l.pending
+		b.keys = append(b.keys, key)
+		l.batches[key] = b
+	}
+	l.mu.Unlock()
+
+	<-b.done
+
+	return b.values[key], b.err
+}
+
+func (l *gqlLoader[K, V]) run() {
+	l.mu.Lock()
+	b := l.pending
+	l.pending = nil
+	l.mu.Unlock()
+
+	b.values, b.err = l.fetch(b.keys)
+	close(b.done)
+}
+
+type relationKey struct {
+	productID    int
+	relationType string
+}
+
+// gqlLoaders are the loaders of a GraphQL request.
+type gqlLoaders struct {
+	relations *gqlLoader[relationKey, []productRelation]
+	products  *gqlLoader[int, *product]
+}
+
+type gqlLoadersKey struct{}
+
+func newGQLLoaders(db *sql.DB) *gqlLoaders {
+	return &gqlLoaders{
+		// the relations of all products of a type are read in one query
+		relations: newGQLLoader(func(keys []relationKey) (map[relationKey][]productRelation, error) {
+			byType := map[string][]int{}
+			for _, key := range keys {
+				byType[key.relationType] = append(byType[key.relationType], key.productID)
+			}
+
+			values := map[relationKey][]productRelation{}
+			for relationType, ids := range byType {
+				relations, err := getRelationsOfProducts(db, ids, relationType)
+				if err != nil {
+					return nil, err
+				}
+				for _, rel := range relations {
+					key := relationKey{productID: rel.ProductID, relationType: relationType}
+					values[key] = append(values[key], rel)
+				}
+			}
+			return values, nil
+		}),
+		products: newGQLLoader(func(ids []int) (map[int]*product, error) {
+			products, err := getProductsByIDs(db, ids)
+			if err != nil {
+				return nil, err
+			}
+
+			values := map[int]*product{}
+			for i := range products {
+				values[products[i].ID] = &products[i]
+			}
+			return values, nil
+		}),
+	}
+}
+
+func gqlLoadersFromContext(ctx context.Context) *gqlLoaders {
+	return ctx.Value(gqlLoadersKey{}).(*gqlLoaders)
+}
+
+func respondWithGraphQLError(w http.ResponseWriter, code int, message string) {
+	respondWithJSON(w, code, gqlResponse{Errors: gqlerror.List{{Message: message}}})
+}
+
+// graphql serves GraphQL operations sent as JSON in a POST body, or as query
+// parameters of a GET request, which may not contain mutations.
+func (a *App) graphql(w http.ResponseWriter, r *http.Request) {
+	var params graphql.RawParams
+	start := graphql.Now()
+
+	if r.Method == http.MethodGet {
+		params.Query = r.FormValue("query")
+		params.OperationName = r.FormValue("operationName")
+		if v := r.FormValue("variables"); v != "" {
+			decoder := json.NewDecoder(strings.NewReader(v))
+			decoder.UseNumber()
+			if err := decoder.Decode(&params.Variables); err != nil {
+				respondWithGraphQLError(w, http.StatusBadRequest, "Invalid variables")
+				return
+			}
+		}
+	} else {
+		decoder := json.NewDecoder(r.Body)
+		decoder.UseNumber()
+		if err := decoder.Decode(&params); err != nil {
+			respondWithGraphQLError(w, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+		defer r.Body.Close()
+	}
+	params.ReadTime = graphql.TraceTiming{Start: start, End: graphql.Now()}
+
+	ctx := graphql.StartOperationTrace(r.Context())
+	ctx = context.WithValue(ctx, gqlLoadersKey{}, newGQLLoaders(a.db(r)))
+
+	opCtx, errs := a.gqlExecutor.CreateOperationContext(ctx, &params)
+	if errs != nil {
+		respondWithJSON(w, http.StatusBadRequest, gqlResponse{Errors: errs})
+		return
+	}
+	if opCtx.Operation.Operation == ast.Mutation && r.Method == http.MethodGet {
+		w.Header().Set("Allow", http.MethodPost)
+		respondWithGraphQLError(w, http.StatusMethodNotAllowed, "Mutations require POST")
+		return
+	}
+
+	responses, ctx := a.gqlExecutor.DispatchOperation(ctx, opCtx)
+	response := responses(ctx)
+	if response == nil {
+		// the request was cancelled
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, gqlResponse{Data: response.Data, Errors: response.Errors})
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/mdumfart/go-mux/productpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// productServer implements the gRPC ProductService on top of the same model
+// code as the HTTP handlers.
+type productServer struct {
+	productpb.UnimplementedProductServiceServer
+	app *App
+}
+
+// NewGRPCServer returns a gRPC server with the product service, the health
+// service and server reflection registered. Calls are resolved to a tenant
+// like HTTP requests, see tenantMetadata, and panics are recovered like
+// those of HTTP handlers.
+func (a *App) NewGRPCServer() *grpc.Server {
+	s := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(a.recoverPanicsUnary, a.identifyTenantUnary),
+		grpc.ChainStreamInterceptor(a.recoverPanicsStream, a.identifyTenantStream),
+	)
+
+	productpb.RegisterProductServiceServer(s, &productServer{app: a})
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	healthServer.SetServingStatus(productpb.ProductService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(s, healthServer)
+
+	reflection.Register(s)
+
+	return s
+}
+
+// RunGRPC serves the gRPC API on addr in the background, alongside the HTTP
+// server, until Run stops it.
+func (a *App) RunGRPC(addr string) (*grpc.Server, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := a.NewGRPCServer()
+	a.grpcServer = s
+	go func() {
+		if err := s.Serve(lis); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	return s, nil
+}
+
+// stopGRPC stops the server of RunGRPC, if any, letting the calls in
+// progress finish for up to shutdownTimeout before cancelling them.
+func (a *App) stopGRPC() {
+	if a.grpcServer == nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		a.grpcServer.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+		// Watch streams only end with their calls
+		a.grpcServer.Stop()
+		<-done
+	}
+}
+
+// tenantMetadata identifies the tenant of a call from the x-tenant key or a
+// bearer token in the authorization key of its metadata. Calls without
+// either belong to the default tenant. Like tenantSlug, it ignores x-tenant
+// once TenantTokenSecret is set.
+func (a *App) tenantMetadata(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	if slugs := md.Get(strings.ToLower(tenantHeader)); len(slugs) > 0 && slugs[0] != "" && len(a.TenantTokenSecret) == 0 {
+		return slugs[0], nil
+	}
+
+	if auth := md.Get("authorization"); len(auth) > 0 && strings.HasPrefix(auth[0], "Bearer ") {
+		return a.tenantClaim(strings.TrimPrefix(auth[0], "Bearer "))
+	}
+
+	return defaultTenantSlug, nil
+}
+
+// tenantContext returns ctx with the tenant of the call stored in it, the
+// way identifyTenant does for HTTP requests.
+func (a *App) tenantContext(ctx context.Context) (context.Context, error) {
+	slug, err := a.tenantMetadata(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid tenant token")
+	}
+
+	t, err := a.tenantBySlug(slug)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			return nil, status.Error(codes.NotFound, "Tenant not found")
+		default:
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	return context.WithValue(ctx, tenantContextKey{}, t), nil
+}
+
+func (a *App) identifyTenantUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := a.tenantContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (a *App) identifyTenantStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := a.tenantContext(ss.Context())
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, &tenantServerStream{ServerStream: ss, ctx: ctx})
+}
+
+// recoverPanic answers a call whose handler panicked with codes.Internal,
+// after reporting the panic like recoverPanics does. It must be deferred.
+func (a *App) recoverPanic(method string, err *error) {
+	v := recover()
+	if v == nil {
+		return
+	}
+
+	report := panicReport{
+		RequestID: newRequestID(),
+		Time:      time.Now(),
+		Method:    "POST",
+		Path:      method,
+		Route:     method,
+		Value:     fmt.Sprint(v),
+		Stack:     string(debug.Stack()),
+	}
+	a.reportPanic(report)
+
+	*err = status.Errorf(codes.Internal, "The server failed to handle the call, request %s", report.RequestID)
+}
+
+func (a *App) recoverPanicsUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer a.recoverPanic(info.FullMethod, &err)
+
+	return handler(ctx, req)
+}
+
+func (a *App) recoverPanicsStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer a.recoverPanic(info.FullMethod, &err)
+
+	return handler(srv, ss)
+}
+
+// tenantServerStream overrides the context of a stream with one carrying
+// its tenant.
+type tenantServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tenantServerStream) Context() context.Context { return s.ctx }
+
+func (s *productServer) db(ctx context.Context) *sql.DB {
+	return s.app.tenantDB(tenantFromContext(ctx).ID)
+}
+
+// channel returns the ID of the channel with the given code, or 0 if code is
+// empty.
+func (s *productServer) channel(ctx context.Context, code string) (int, error) {
+	if code == "" {
+		return 0, nil
+	}
+
+	c := channel{Code: code}
+	if err := c.getChannelByCode(s.db(ctx)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			return 0, status.Error(codes.NotFound, "Channel not found")
+		default:
+			return 0, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	return c.ID, nil
+}
+
+func (s *productServer) Get(ctx context.Context, req *productpb.GetProductRequest) (*productpb.Product, error) {
+	channelID, err := s.channel(ctx, req.Channel)
+	if err != nil {
+		return nil, err
+	}
+
+	p := product{ID: int(req.Id)}
+	if err := p.getChannelProduct(s.db(ctx), channelID, nil); err != nil {
+		return nil, productStatus(err)
+	}
+
+	s.app.Views.record(p.ID)
+
+	return p.toProto(), nil
+}
+
+func (s *productServer) List(ctx context.Context, req *productpb.ListProductsRequest) (*productpb.ListProductsResponse, error) {
+	start := int(req.Start)
+	if start < 0 {
+		start = 0
+	}
+
+	if req.MinRating != 0 && (req.MinRating < minReviewRating || req.MinRating > maxReviewRating) {
+		return nil, status.Error(codes.InvalidArgument, "Invalid minimum rating")
+	}
+	if _, ok := productSortOrders[req.Sort]; req.Sort != "" && !ok {
+		return nil, status.Error(codes.InvalidArgument, "Invalid sort order")
+	}
+
+	channelID, err := s.channel(ctx, req.Channel)
+	if err != nil {
+		return nil, err
+	}
+
+	products, err := getProducts(s.db(ctx), productFilter{
+		Start:     start,
+		Count:     tenantFromContext(ctx).pageSize(int(req.Count)),
+		MinRating: req.MinRating,
+		Sort:      req.Sort,
+		Channel:   channelID,
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return productsToProto(products), nil
+}
+
+func (s *productServer) Search(ctx context.Context, req *productpb.SearchProductsRequest) (*productpb.ListProductsResponse, error) {
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "Invalid search term for name")
+	}
+
+	channelID, err := s.channel(ctx, req.Channel)
+	if err != nil {
+		return nil, err
+	}
+
+	p := product{Name: req.Name}
+	products, err := p.searchProducts(s.db(ctx), channelID, nil, 0, 0)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return productsToProto(products), nil
+}
+
+func (s *productServer) Count(ctx context.Context, req *productpb.CountProductsRequest) (*productpb.CountProductsResponse, error) {
+	channelID, err := s.channel(ctx, req.Channel)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := (&product{}).getNumberOfProducts(s.db(ctx), channelID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &productpb.CountProductsResponse{Count: int32(count)}, nil
+}
+
+func (s *productServer) Create(ctx context.Context, req *productpb.CreateProductRequest) (*productpb.Product, error) {
+	if req.Product == nil {
+		return nil, status.Error(codes.InvalidArgument, "Missing product")
+	}
+
+	p := productFromProto(req.Product)
+	if err := s.app.addProduct(s.db(ctx), tenantFromContext(ctx), &p); err != nil {
+		return nil, productStatus(err)
+	}
+
+	return p.toProto(), nil
+}
+
+func (s *productServer) Update(ctx context.Context, req *productpb.UpdateProductRequest) (*productpb.Product, error) {
+	if req.Product == nil {
+		return nil, status.Error(codes.InvalidArgument, "Missing product")
+	}
+
+	p := productFromProto(req.Product)
+	if err := s.app.saveProduct(s.db(ctx), tenantFromContext(ctx), &p); err != nil {
+		return nil, productStatus(err)
+	}
+
+	return p.toProto(), nil
+}
+
+func (s *productServer) Delete(ctx context.Context, req *productpb.DeleteProductRequest) (*productpb.DeleteProductResponse, error) {
+	if err := s.app.removeProduct(s.db(ctx), tenantFromContext(ctx), int(req.Id)); err != nil {
+		return nil, productStatus(err)
+	}
+
+	return &productpb.DeleteProductResponse{}, nil
+}
+
+// productEventTypes maps the types of product events to their protobuf
+// enum values.
+var productEventTypes = map[string]productpb.ProductEvent_Type{
+	productCreated: productpb.ProductEvent_CREATED,
+	productUpdated: productpb.ProductEvent_UPDATED,
+	productDeleted: productpb.ProductEvent_DELETED,
+}
+
+func (s *productServer) Watch(req *productpb.WatchProductsRequest, stream grpc.ServerStreamingServer[productpb.ProductEvent]) error {
+	ctx := stream.Context()
+
+	events := s.app.events.subscribe(tenantFromContext(ctx).ID)
+	defer s.app.events.unsubscribe(events)
+
+	// tell the client the subscription is in place, so no change made after
+	// the call returned headers is missed
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e, ok := <-events:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "The watch fell behind the product events and missed some of them")
+			}
+			err := stream.Send(&productpb.ProductEvent{Type: productEventTypes[e.Type], Product: e.Product.toProto()})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// productStatus converts an error reading or changing a product to a gRPC
+// status.
+func productStatus(err error) error {
+	if _, ok := err.(*invalidProductError); ok {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	switch err {
+	case errProductLimit:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case sql.ErrNoRows:
+		return status.Error(codes.NotFound, "Product not found")
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func (p product) toProto() *productpb.Product {
+	pb := &productpb.Product{
+		Id:            int32(p.ID),
+		Name:          p.Name,
+		Price:         p.Price,
+		Stock:         int32(p.Stock),
+		Barcode:       p.Barcode,
+		Weight:        p.Weight,
+		WeightUnit:    p.WeightUnit,
+		Length:        p.Length,
+		Width:         p.Width,
+		Height:        p.Height,
+		DimensionUnit: p.DimensionUnit,
+	}
+	if p.fields.has("published") {
+		published := p.Published
+		pb.Published = &published
+	}
+	if p.Rating != nil {
+		pb.Rating = &productpb.Rating{Average: p.Rating.Average, Count: int32(p.Rating.Count)}
+	}
+
+	return pb
+}
+
+// productFromProto converts a product of a create or update call. Products
+// are published unless the message says otherwise.
+func productFromProto(pb *productpb.Product) product {
+	p := product{
+		ID:            int(pb.Id),
+		Name:          pb.Name,
+		Price:         pb.Price,
+		Stock:         int(pb.Stock),
+		Published:     true,
+		Barcode:       pb.Barcode,
+		Weight:        pb.Weight,
+		WeightUnit:    pb.WeightUnit,
+		Length:        pb.Length,
+		Width:         pb.Width,
+		Height:        pb.Height,
+		DimensionUnit: pb.DimensionUnit,
+	}
+	if pb.Published != nil {
+		p.Published = *pb.Published
+	}
+
+	return p
+}
+
+func productsToProto(products []product) *productpb.ListProductsResponse {
+	resp := &productpb.ListProductsResponse{Products: make([]*productpb.Product, 0, len(products))}
+	for _, p := range products {
+		resp.Products = append(resp.Products, p.toProto())
+	}
+
+	return resp
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// productLinkRoutes are the named routes linked from every product, by the
+// name of the link.
+var productLinkRoutes = []struct {
+	link  string
+	route string
+}{
+	{"relations", "product-relations"},
+	{"reviews", "product-reviews"},
+	{"suppliers", "product-suppliers"},
+	{"recommendations", "product-recommendations"},
+}
+
+// pagedRoutes are the named routes taking start and count parameters, whose
+// lists get next and prev links.
+var pagedRoutes = map[string]bool{
+	"products": true,
+}
+
+// routeName splits the name of the current route into the prefix naming its
+// version tree, like "v2/", and the name of the route within it.
+func (rc responseContext) routeName() (prefix, name string) {
+	if rc.request == nil {
+		return "", ""
+	}
+	route := mux.CurrentRoute(rc.request)
+	if route == nil {
+		return "", ""
+	}
+
+	name = route.GetName()
+	if i := strings.Index(name, "/"); i >= 0 {
+		return name[:i+1], name[i+1:]
+	}
+
+	return "", name
+}
+
+// routeURL returns the path of a named route in the version tree of the
+// request, or "" if it doesn't exist.
+func (rc responseContext) routeURL(name string, pairs ...string) string {
+	if rc.router == nil {
+		return ""
+	}
+	prefix, _ := rc.routeName()
+	route := rc.router.Get(prefix + name)
+	if route == nil {
+		return ""
+	}
+
+	u, err := route.URL(pairs...)
+	if err != nil {
+		return ""
+	}
+
+	return u.String()
+}
+
+// selfURL rebuilds the URL of the request from its named route, or returns
+// it as requested for unnamed routes.
+func (rc responseContext) selfURL() *url.URL {
+	if rc.request == nil {
+		return nil
+	}
+
+	self := *rc.request.URL
+	if route := mux.CurrentRoute(rc.request); route != nil && route.GetName() != "" {
+		var pairs []string
+		for k, v := range mux.Vars(rc.request) {
+			pairs = append(pairs, k, v)
+		}
+		if u, err := route.URL(pairs...); err == nil {
+			self.Path = u.Path
+		}
+	}
+
+	return &url.URL{Path: self.Path, RawQuery: self.RawQuery}
+}
+
+// pageLinks returns the next and prev links of a page of a paged route with
+// the given number of items. A full page is assumed to have a next page.
+func (rc responseContext) pageLinks(items int) (next, prev string) {
+	self := rc.selfURL()
+	_, name := rc.routeName()
+	if self == nil || !pagedRoutes[name] {
+		return "", ""
+	}
+
+	query := self.Query()
+	start, _ := strconv.Atoi(query.Get("start"))
+	count, _ := strconv.Atoi(query.Get("count"))
+	count = tenantFromRequest(rc.request).pageSize(count)
+	if start < 0 {
+		start = 0
+	}
+
+	page := func(start int) string {
+		query.Set("start", strconv.Itoa(start))
+		query.Set("count", strconv.Itoa(count))
+		u := *self
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+
+	if items >= count {
+		next = page(start + count)
+	}
+	if start > 0 {
+		prev = page(max(0, start-count))
+	}
+
+	return next, prev
+}
+
+// productResources returns the JSON values of the products in a payload,
+// and whether the payload is a list. Payloads of other types yield nil.
+func productResources(payload interface{}) ([]*orderedObject, bool, error) {
+	payload = unwrapList(payload)
+	switch payload.(type) {
+	case product, *product:
+		value, err := toOrdered(payload)
+		if err != nil {
+			return nil, false, err
+		}
+		return []*orderedObject{value.(*orderedObject)}, false, nil
+	case []product, []trendingProduct:
+		value, err := toOrdered(payload)
+		if err != nil {
+			return nil, false, err
+		}
+		resources := []*orderedObject{}
+		for _, item := range value.([]interface{}) {
+			resources = append(resources, item.(*orderedObject))
+		}
+		return resources, true, nil
+	}
+
+	return nil, false, nil
+}
+
+// productLinks returns the links of a product resource by name, self first.
+func (rc responseContext) productLinks(id string) *orderedObject {
+	links := newOrderedObject()
+	if self := rc.routeURL("product", "id", id); self != "" {
+		links.set("self", self)
+	}
+	for _, l := range productLinkRoutes {
+		if href := rc.routeURL(l.route, "id", id); href != "" {
+			links.set(l.link, href)
+		}
+	}
+
+	return links
+}
+
+// documentLinks returns the self, next and prev links of a response.
+func (rc responseContext) documentLinks(items int, list bool) *orderedObject {
+	links := newOrderedObject()
+	if self := rc.selfURL(); self != nil {
+		links.set("self", self.String())
+	}
+	if list {
+		next, prev := rc.pageLinks(items)
+		if next != "" {
+			links.set("next", next)
+		}
+		if prev != "" {
+			links.set("prev", prev)
+		}
+	}
+
+	return links
+}
+
+// encodeJSONAPI writes products as JSON:API resources of type products and
+// errors as JSON:API error objects. Other payloads are sent as the meta
+// member of the document.
+func encodeJSONAPI(payload interface{}, rc responseContext) ([]byte, error) {
+	value, err := toOrdered(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if object, ok := value.(*orderedObject); ok && rc.code >= 400 {
+		if message, ok := object.values["error"].(string); ok {
+			return json.Marshal(map[string]interface{}{"errors": jsonAPIErrors(rc.code, message, object.values["details"])})
+		}
+	}
+
+	resources, list, err := productResources(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	document := newOrderedObject()
+	switch {
+	case resources == nil:
+		if _, ok := value.(*orderedObject); !ok {
+			value = map[string]interface{}{"items": value}
+		}
+		document.set("meta", value)
+	case list:
+		data := make([]interface{}, 0, len(resources))
+		for _, r := range resources {
+			data = append(data, rc.jsonAPIResource(r))
+		}
+		document.set("data", data)
+	default:
+		document.set("data", rc.jsonAPIResource(resources[0]))
+	}
+
+	document.set("links", rc.documentLinks(len(resources), list))
+
+	return json.Marshal(document)
+}
+
+// jsonAPIResource converts the JSON value of a product to a resource object,
+// with links to its related collections as relationships.
+func (rc responseContext) jsonAPIResource(p *orderedObject) *orderedObject {
+	id := scalarString(p.values["id"])
+
+	attributes := newOrderedObject()
+	for _, key := range p.keys {
+		if key != "id" {
+			attributes.set(key, p.values[key])
+		}
+	}
+
+	links := rc.productLinks(id)
+
+	relationships := newOrderedObject()
+	for _, l := range productLinkRoutes {
+		if href, ok := links.values[l.link]; ok {
+			relationships.set(l.link, map[string]interface{}{"links": map[string]interface{}{"related": href}})
+		}
+	}
+
+	resource := newOrderedObject()
+	resource.set("type", "products")
+	resource.set("id", id)
+	resource.set("attributes", attributes)
+	if len(relationships.keys) > 0 {
+		resource.set("relationships", relationships)
+	}
+	if self, ok := links.values["self"]; ok {
+		resource.set("links", map[string]interface{}{"self": self})
+	}
+
+	return resource
+}
+
+// jsonAPIErrors returns one error object per detail of an error response,
+// or a single one if it has none.
+func jsonAPIErrors(code int, message string, details interface{}) []map[string]string {
+	status := strconv.Itoa(code)
+
+	list, _ := details.([]interface{})
+	if len(list) == 0 {
+		return []map[string]string{{"status": status, "title": message}}
+	}
+
+	errs := make([]map[string]string, 0, len(list))
+	for _, detail := range list {
+		errs = append(errs, map[string]string{"status": status, "title": message, "detail": scalarString(detail)})
+	}
+
+	return errs
+}
+
+// encodeHAL writes products as HAL resources with _links, and lists of
+// products embedded as products. Other objects get a self link, other lists
+// are embedded as items.
+func encodeHAL(payload interface{}, rc responseContext) ([]byte, error) {
+	resources, list, err := productResources(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if resources != nil && !list {
+		return json.Marshal(rc.halProduct(resources[0]))
+	}
+
+	document := newOrderedObject()
+	switch {
+	case list:
+		embedded := make([]interface{}, 0, len(resources))
+		for _, r := range resources {
+			embedded = append(embedded, rc.halProduct(r))
+		}
+		document.set("_links", halLinks(rc.documentLinks(len(resources), true)))
+		document.set("_embedded", map[string]interface{}{"products": embedded})
+	default:
+		value, err := toOrdered(payload)
+		if err != nil {
+			return nil, err
+		}
+		if object, ok := value.(*orderedObject); ok {
+			document = object
+		} else {
+			document.set("_embedded", map[string]interface{}{"items": value})
+		}
+		document.set("_links", halLinks(rc.documentLinks(0, false)))
+	}
+
+	return json.Marshal(document)
+}
+
+func (rc responseContext) halProduct(p *orderedObject) *orderedObject {
+	p.set("_links", halLinks(rc.productLinks(scalarString(p.values["id"]))))
+
+	return p
+}
+
+// halLinks converts links by name to HAL link objects.
+func halLinks(links *orderedObject) *orderedObject {
+	hal := newOrderedObject()
+	for _, key := range links.keys {
+		hal.set(key, map[string]interface{}{"href": links.values[key]})
+	}
+
+	return hal
+}
+
+// decodeJSONAPI reads the attributes of a JSON:API resource object of type
+// products.
+func decodeJSONAPI(body io.Reader, v interface{}) error {
+	var document struct {
+		Data struct {
+			Type       string          `json:"type"`
+			Attributes json.RawMessage `json:"attributes"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(body).Decode(&document); err != nil {
+		return err
+	}
+
+	if document.Data.Type != "products" || document.Data.Attributes == nil {
+		return errors.New("expected a resource object of type products")
+	}
+
+	return json.Unmarshal(document.Data.Attributes, v)
+}
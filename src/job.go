@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// periodicJob runs a background task at a fixed interval. Runs never
+// overlap; a run requested while another is in progress waits for it.
+type periodicJob struct {
+	name     string
+	interval time.Duration
+	task     func() error
+
+	mu   sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newPeriodicJob(name string, interval time.Duration, task func() error) *periodicJob {
+	return &periodicJob{name: name, interval: interval, task: task}
+}
+
+func (j *periodicJob) start() {
+	j.stop = make(chan struct{})
+	j.done = make(chan struct{})
+
+	go func() {
+		defer close(j.done)
+
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := j.run(); err != nil {
+					log.Printf("job %s: %v", j.name, err)
+				}
+			case <-j.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (j *periodicJob) close() {
+	close(j.stop)
+	<-j.done
+}
+
+func (j *periodicJob) run() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.task()
+}
+
+// runJob runs the named job immediately and waits for it to finish.
+func (a *App) runJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.Jobs[mux.Vars(r)["name"]]
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Job not found")
+		return
+	}
+
+	if err := job.run(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, map[string]string{"result": "success"})
+}
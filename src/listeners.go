@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenerSpec is a listener of the API, parsed from a URL:
+//
+//	tcp://:8010?h2c=true
+//	unix:///run/catalog/api.sock?mode=0660
+//	systemd://api?tls=false
+//
+// systemd listeners are inherited by socket activation and named like in
+// FileDescriptorName, or numbered from 0 in the order of the sockets. The
+// tls option defaults to whether TLSCertFile is set; h2c serves HTTP/2
+// without TLS.
+type listenerSpec struct {
+	network string
+	address string
+	mode    os.FileMode
+	tls     bool
+	h2c     bool
+}
+
+func parseListenerSpec(spec string, tlsDefault bool) (listenerSpec, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return listenerSpec{}, err
+	}
+
+	s := listenerSpec{network: u.Scheme, tls: tlsDefault}
+	switch u.Scheme {
+	case "tcp", "systemd":
+		s.address = u.Host
+	case "unix":
+		s.address = u.Path
+	default:
+		return s, fmt.Errorf("listener %s: unknown network %q", spec, u.Scheme)
+	}
+
+	query := u.Query()
+	for name := range query {
+		value := query.Get(name)
+		switch name {
+		case "tls":
+			s.tls, err = strconv.ParseBool(value)
+		case "h2c":
+			s.h2c, err = strconv.ParseBool(value)
+		case "mode":
+			var mode uint64
+			mode, err = strconv.ParseUint(value, 8, 32)
+			s.mode = os.FileMode(mode)
+		default:
+			err = fmt.Errorf("unknown option %q", name)
+		}
+		if err != nil {
+			return s, fmt.Errorf("listener %s: %v", spec, err)
+		}
+	}
+
+	return s, nil
+}
+
+func (s listenerSpec) listen() (net.Listener, error) {
+	switch s.network {
+	case "unix":
+		// a socket left behind by a previous run would fail the listen
+		if info, err := os.Stat(s.address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(s.address)
+		}
+		if s.mode != 0 {
+			return listenUnix(s.address, s.mode)
+		}
+		return net.Listen("unix", s.address)
+	case "systemd":
+		return systemdListener(s.address)
+	}
+
+	return net.Listen(s.network, s.address)
+}
+
+// listenUnix listens on a unix socket with the given mode. The socket is
+// created in a private directory and moved into place after the chmod, so
+// it is never reachable with the mode of the umask.
+func listenUnix(address string, mode os.FileMode) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(address), ".listen-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, filepath.Base(address))
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(tmp, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, address); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return &unixListener{Listener: l, address: address}, nil
+}
+
+// unixListener removes its socket on Close, which a net.UnixListener would
+// do for the path it was created on only.
+type unixListener struct {
+	net.Listener
+	address string
+}
+
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	os.Remove(l.address)
+
+	return err
+}
+
+var (
+	systemdOnce      sync.Once
+	systemdListeners []net.Listener
+	systemdNames     []string
+	systemdErr       error
+)
+
+// systemdListener returns a socket passed by systemd socket activation, by
+// name or number.
+func systemdListener(name string) (net.Listener, error) {
+	systemdOnce.Do(func() {
+		if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+			systemdErr = errors.New("no sockets passed by systemd")
+			return
+		}
+		count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil {
+			systemdErr = err
+			return
+		}
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+		// the sockets are not meant for child processes
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+
+		// passed file descriptors start after stdin, stdout and stderr
+		for i := 0; i < count; i++ {
+			f := os.NewFile(uintptr(3+i), "systemd socket "+strconv.Itoa(i))
+			l, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				systemdErr = err
+				return
+			}
+			systemdListeners = append(systemdListeners, l)
+			if i < len(names) {
+				systemdNames = append(systemdNames, names[i])
+			} else {
+				systemdNames = append(systemdNames, "")
+			}
+		}
+	})
+	if systemdErr != nil {
+		return nil, systemdErr
+	}
+
+	for i, n := range systemdNames {
+		if n == name || strconv.Itoa(i) == name {
+			return systemdListeners[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no socket %q passed by systemd", name)
+}
+
+// Serve serves the API on the listeners until ctx is done. It returns the
+// first error of a listener, after shutting down the others. Shutting down
+// waits for the requests in progress.
+func (a *App) Serve(ctx context.Context, specs []string) error {
+	config, err := a.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	var servers []*http.Server
+	var listeners []net.Listener
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+		for _, srv := range servers {
+			srv.Close()
+		}
+	}
+
+	for _, spec := range specs {
+		s, err := parseListenerSpec(spec, config != nil)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		if s.tls && config == nil {
+			closeAll()
+			return fmt.Errorf("listener %s: TLS needs a certificate", spec)
+		}
+
+		l, err := s.listen()
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, l)
+
+		srv := &http.Server{Handler: a.Router, Protocols: new(http.Protocols)}
+		srv.Protocols.SetHTTP1(true)
+		if s.tls {
+			srv.TLSConfig = config
+			srv.Protocols.SetHTTP2(true)
+		}
+		srv.Protocols.SetUnencryptedHTTP2(s.h2c)
+		servers = append(servers, srv)
+	}
+
+	errs := make(chan error, len(servers))
+	for i, srv := range servers {
+		go func(srv *http.Server, l net.Listener) {
+			if srv.TLSConfig != nil {
+				errs <- srv.ServeTLS(l, "", "")
+				return
+			}
+			errs <- srv.Serve(l)
+		}(srv, listeners[i])
+	}
+
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+	}
+
+	// let the requests in progress finish, for up to shutdownTimeout, before
+	// the connections left are closed
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Go(func() { srv.Shutdown(shutdownCtx) })
+	}
+	wg.Wait()
+	closeAll()
+
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
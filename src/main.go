@@ -1,6 +1,16 @@
 package main
 
-import "os"
+import (
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
 
 func main() {
 	a := App{}
@@ -9,5 +19,130 @@ func main() {
 		os.Getenv("APP_DB_PASSWORD"),
 		os.Getenv("APP_DB_NAME"))
 
+	if path := os.Getenv("APP_SHIPPING_RATES"); path != "" {
+		carriers, err := loadCarriers(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.Carriers = carriers
+	}
+
+	if addr := os.Getenv("APP_SMTP_ADDR"); addr != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		a.Notifiers["email"] = emailNotifier{
+			addr: addr,
+			from: os.Getenv("APP_SMTP_FROM"),
+			auth: smtp.PlainAuth("", os.Getenv("APP_SMTP_USERNAME"), os.Getenv("APP_SMTP_PASSWORD"), host),
+		}
+	}
+
+	a.TenantBaseDomain = os.Getenv("APP_TENANT_BASE_DOMAIN")
+	if secret := os.Getenv("APP_TENANT_TOKEN_SECRET"); secret != "" {
+		a.TenantTokenSecret = []byte(secret)
+	}
+
+	if ttl := os.Getenv("APP_TENANT_CACHE_TTL"); ttl != "" {
+		seconds, err := strconv.Atoi(ttl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.TenantCacheTTL = time.Duration(seconds) * time.Second
+	}
+
+	a.AdminToken = os.Getenv("APP_ADMIN_TOKEN")
+	if identities := os.Getenv("APP_ADMIN_IDENTITIES"); identities != "" {
+		a.AdminIdentities = splitList(identities)
+	}
+
+	a.APIValidation = os.Getenv("APP_API_VALIDATION")
+
+	if path := os.Getenv("APP_API_DEPRECATIONS"); path != "" {
+		deprecations, err := loadDeprecations(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.Deprecations = deprecations
+	}
+
+	a.TLSCertFile = os.Getenv("APP_TLS_CERT")
+	a.TLSKeyFile = os.Getenv("APP_TLS_KEY")
+	a.TLSClientCAFile = os.Getenv("APP_TLS_CLIENT_CA")
+	a.TLSRequireClientCert = os.Getenv("APP_TLS_REQUIRE_CLIENT_CERT") == "true"
+	a.TLSRedirectAddr = os.Getenv("APP_TLS_REDIRECT_ADDR")
+	if path := os.Getenv("APP_TLS_CLIENT_IDENTITIES"); path != "" {
+		identities, err := loadClientIdentities(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.ClientIdentities = identities
+	}
+
+	if listeners := os.Getenv("APP_LISTEN"); listeners != "" {
+		a.Listeners = splitList(listeners)
+	}
+
+	if origins := os.Getenv("APP_CORS_ORIGINS"); origins != "" {
+		a.CORSOrigins = splitList(origins)
+	}
+	if methods := os.Getenv("APP_CORS_METHODS"); methods != "" {
+		a.CORSMethods = splitList(methods)
+	}
+	if headers := os.Getenv("APP_CORS_HEADERS"); headers != "" {
+		a.CORSHeaders = splitList(headers)
+	}
+	a.CORSCredentials = os.Getenv("APP_CORS_CREDENTIALS") == "true"
+	if a.CORSCredentials && containsFold(a.CORSOrigins, "*") {
+		log.Fatal("APP_CORS_CREDENTIALS cannot be combined with the origin *")
+	}
+	if maxAge := os.Getenv("APP_CORS_MAX_AGE"); maxAge != "" {
+		seconds, err := strconv.Atoi(maxAge)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.CORSMaxAge = time.Duration(seconds) * time.Second
+	}
+
+	if size := os.Getenv("APP_COMPRESSION_MIN_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.CompressionMinSize = n
+	}
+	if types := os.Getenv("APP_COMPRESSIBLE_TYPES"); types != "" {
+		a.CompressibleTypes = splitList(types)
+	}
+	if size := os.Getenv("APP_MAX_DECOMPRESSED_SIZE"); size != "" {
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.MaxDecompressedSize = n
+	}
+
+	a.ErrorSinkURL = os.Getenv("APP_ERROR_SINK_URL")
+
+	if addr := os.Getenv("APP_METRICS_ADDR"); addr != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(addr, expvar.Handler()))
+		}()
+	}
+
+	if addr := os.Getenv("APP_GRPC_ADDR"); addr != "" {
+		if _, err := a.RunGRPC(addr); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	a.Run(":8010")
-}
\ No newline at end of file
+}
+
+// splitList splits a comma-separated list of an environment variable.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		items = append(items, strings.TrimSpace(item))
+	}
+
+	return items
+}
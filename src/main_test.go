@@ -2,37 +2,300 @@ package main_test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"expvar"
 	"fmt"
 	"github.com/mdumfart/go-mux"
+	"io"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mdumfart/go-mux/productpb"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
 )
 
 var a main.App
 
-const tableCreationQuery = `CREATE TABLE IF NOT EXISTS products
+const tableCreationQuery = `CREATE TABLE IF NOT EXISTS tenants
 (
     id SERIAL,
+    slug TEXT NOT NULL UNIQUE,
+    name TEXT NOT NULL,
+    max_products INTEGER NOT NULL DEFAULT 0,
+    max_page_size INTEGER NOT NULL DEFAULT 10,
+    settings JSONB NOT NULL DEFAULT '{}',
+    CONSTRAINT tenants_pkey PRIMARY KEY (id)
+);
+INSERT INTO tenants(slug, name) VALUES('default', 'Default') ON CONFLICT DO NOTHING;
+CREATE OR REPLACE FUNCTION current_tenant_id() RETURNS INTEGER AS $$
+    SELECT COALESCE(NULLIF(current_setting('app.tenant_id', true), '')::INTEGER, 1)
+$$ LANGUAGE SQL STABLE;
+CREATE TABLE IF NOT EXISTS products
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
     name TEXT NOT NULL,
     price NUMERIC(10,2) NOT NULL DEFAULT 0.00,
+    stock INTEGER NOT NULL DEFAULT 0 CHECK (stock >= 0),
+    published BOOLEAN NOT NULL DEFAULT true,
+    barcode TEXT NOT NULL DEFAULT '',
+    weight NUMERIC(10,3) NOT NULL DEFAULT 0,
+    weight_unit TEXT NOT NULL DEFAULT 'kg',
+    length NUMERIC(10,2) NOT NULL DEFAULT 0,
+    width NUMERIC(10,2) NOT NULL DEFAULT 0,
+    height NUMERIC(10,2) NOT NULL DEFAULT 0,
+    dimension_unit TEXT NOT NULL DEFAULT 'cm',
     CONSTRAINT products_pkey PRIMARY KEY (id)
-)`
+);
+CREATE TABLE IF NOT EXISTS product_relations
+(
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    related_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    relation_type TEXT NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0,
+    quantity INTEGER NOT NULL DEFAULT 1,
+    CONSTRAINT product_relations_pkey PRIMARY KEY (product_id, related_id, relation_type)
+);
+CREATE TABLE IF NOT EXISTS suppliers
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    name TEXT NOT NULL,
+    contact_name TEXT NOT NULL DEFAULT '',
+    email TEXT NOT NULL DEFAULT '',
+    phone TEXT NOT NULL DEFAULT '',
+    CONSTRAINT suppliers_pkey PRIMARY KEY (id)
+);
+CREATE TABLE IF NOT EXISTS supplier_products
+(
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    supplier_id INTEGER NOT NULL REFERENCES suppliers (id) ON DELETE CASCADE,
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    supplier_sku TEXT NOT NULL DEFAULT '',
+    cost_price NUMERIC(10,2) NOT NULL DEFAULT 0.00,
+    lead_time_days INTEGER NOT NULL DEFAULT 0,
+    CONSTRAINT supplier_products_pkey PRIMARY KEY (supplier_id, product_id)
+);
+CREATE TABLE IF NOT EXISTS reviews
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    rating INTEGER NOT NULL CHECK (rating BETWEEN 1 AND 5),
+    text TEXT NOT NULL DEFAULT '',
+    author TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT reviews_pkey PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS reviews_product_id_idx ON reviews (product_id, status);
+CREATE TABLE IF NOT EXISTS carts
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    customer TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT carts_pkey PRIMARY KEY (id)
+);
+CREATE TABLE IF NOT EXISTS cart_items
+(
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    cart_id INTEGER NOT NULL REFERENCES carts (id) ON DELETE CASCADE,
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    unit_price NUMERIC(10,2) NOT NULL,
+    CONSTRAINT cart_items_pkey PRIMARY KEY (cart_id, product_id)
+);
+CREATE TABLE IF NOT EXISTS orders
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    customer TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    total NUMERIC(12,2) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT orders_pkey PRIMARY KEY (id)
+);
+CREATE TABLE IF NOT EXISTS order_items
+(
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    order_id INTEGER NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+    product_id INTEGER REFERENCES products (id) ON DELETE SET NULL,
+    name TEXT NOT NULL,
+    quantity INTEGER NOT NULL,
+    unit_price NUMERIC(10,2) NOT NULL
+);
+CREATE TABLE IF NOT EXISTS wishlist_items
+(
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    customer TEXT NOT NULL,
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    added_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT wishlist_items_pkey PRIMARY KEY (customer, product_id)
+);
+CREATE TABLE IF NOT EXISTS price_watches
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    customer TEXT NOT NULL,
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    target_price NUMERIC(10,2) NOT NULL,
+    channel TEXT NOT NULL DEFAULT 'log',
+    address TEXT NOT NULL DEFAULT '',
+    triggered_at TIMESTAMPTZ,
+    CONSTRAINT price_watches_pkey PRIMARY KEY (id)
+);
+CREATE TABLE IF NOT EXISTS product_views
+(
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    bucket TIMESTAMPTZ NOT NULL,
+    views INTEGER NOT NULL DEFAULT 0,
+    CONSTRAINT product_views_pkey PRIMARY KEY (product_id, bucket)
+);
+CREATE TABLE IF NOT EXISTS product_cooccurrences
+(
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    other_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    count INTEGER NOT NULL,
+    score DOUBLE PRECISION NOT NULL,
+    CONSTRAINT product_cooccurrences_pkey PRIMARY KEY (product_id, other_id)
+);
+CREATE TABLE IF NOT EXISTS product_duplicates
+(
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    duplicate_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    score DOUBLE PRECISION NOT NULL,
+    reason TEXT NOT NULL,
+    CONSTRAINT product_duplicates_pkey PRIMARY KEY (product_id, duplicate_id)
+);
+CREATE TABLE IF NOT EXISTS channels
+(
+    id SERIAL,
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    code TEXT NOT NULL,
+    name TEXT NOT NULL,
+    CONSTRAINT channels_pkey PRIMARY KEY (id),
+    CONSTRAINT channels_code_key UNIQUE (tenant_id, code)
+);
+CREATE TABLE IF NOT EXISTS channel_products
+(
+    tenant_id INTEGER NOT NULL DEFAULT current_tenant_id() REFERENCES tenants (id),
+    channel_id INTEGER NOT NULL REFERENCES channels (id) ON DELETE CASCADE,
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    visible BOOLEAN NOT NULL DEFAULT true,
+    price NUMERIC(10,2),
+    CONSTRAINT channel_products_pkey PRIMARY KEY (channel_id, product_id)
+);
+DO $$
+BEGIN
+    CREATE ROLE catalog_app NOLOGIN;
+EXCEPTION WHEN duplicate_object THEN NULL;
+END
+$$;
+GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO catalog_app;
+GRANT USAGE, SELECT ON ALL SEQUENCES IN SCHEMA public TO catalog_app;
+ALTER TABLE products ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenant_isolation ON products;
+CREATE POLICY tenant_isolation ON products USING (tenant_id = current_tenant_id());
+ALTER TABLE product_relations ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenant_isolation ON product_relations;
+CREATE POLICY tenant_isolation ON product_relations USING (tenant_id = current_tenant_id());
+ALTER TABLE suppliers ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenant_isolation ON suppliers;
+CREATE POLICY tenant_isolation ON suppliers USING (tenant_id = current_tenant_id());
+ALTER TABLE supplier_products ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenant_isolation ON supplier_products;
+CREATE POLICY tenant_isolation ON supplier_products USING (tenant_id = current_tenant_id());
+ALTER TABLE reviews ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenant_isolation ON reviews;
+CREATE POLICY tenant_isolation ON reviews USING (tenant_id = current_tenant_id());
+ALTER TABLE carts ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenant_isolation ON carts;
+CREATE POLICY tenant_isolation ON carts USING (tenant_id = current_tenant_id());
+ALTER TABLE cart_items ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenant_isolation ON cart_items;
+CREATE POLICY tenant_isolation ON cart_items USING (tenant_id = current_tenant_id());
+ALTER TABLE orders ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenant_isolation ON orders;
+CREATE POLICY tenant_isolation ON orders USING (tenant_id = current_tenant_id());
+ALTER TABLE order_items ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenant_isolation ON order_items;
+CREATE POLICY tenant_isolation ON order_items USING (tenant_id = current_tenant_id());
+ALTER TABLE wishlist_items ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenant_isolation ON wishlist_items;
+CREATE POLICY tenant_isolation ON wishlist_items USING (tenant_id = current_tenant_id());
+ALTER TABLE price_watches ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenant_isolation ON price_watches;
+CREATE POLICY tenant_isolation ON price_watches USING (tenant_id = current_tenant_id());
+ALTER TABLE product_views ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenant_isolation ON product_views;
+CREATE POLICY tenant_isolation ON product_views USING (tenant_id = current_tenant_id());
+ALTER TABLE product_cooccurrences ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenant_isolation ON product_cooccurrences;
+CREATE POLICY tenant_isolation ON product_cooccurrences USING (tenant_id = current_tenant_id());
+ALTER TABLE product_duplicates ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenant_isolation ON product_duplicates;
+CREATE POLICY tenant_isolation ON product_duplicates USING (tenant_id = current_tenant_id());
+ALTER TABLE channels ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenant_isolation ON channels;
+CREATE POLICY tenant_isolation ON channels USING (tenant_id = current_tenant_id());
+ALTER TABLE channel_products ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenant_isolation ON channel_products;
+CREATE POLICY tenant_isolation ON channel_products USING (tenant_id = current_tenant_id())`
 
 func TestMain(m *testing.M) {
 	a.Initialize(
 		os.Getenv("APP_DB_USERNAME"),
 		os.Getenv("APP_DB_PASSWORD"),
 		os.Getenv("APP_DB_NAME"))
+	a.APIValidation = "strict"
+	a.AdminToken = adminToken
+	// the tests replace tenants by SQL
+	a.TenantCacheTTL = 0
 
 	ensureTableExists()
 	code := m.Run()
 	clearTable()
+	a.Close()
 	os.Exit(code)
 }
 
@@ -82,6 +345,19 @@ func TestDeleteProduct(t *testing.T) {
 	checkResponseCode(t, http.StatusNotFound, response.Code)
 }
 
+func TestChangeNonExistentProduct(t *testing.T) {
+	clearTable()
+
+	req, _ := http.NewRequest("PUT", "/product/11", bytes.NewBufferString(`{"name":"test product - updated name", "price": 11.22}`))
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	req, _ = http.NewRequest("DELETE", "/product/11", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
 func TestUpdateProduct(t *testing.T) {
 	clearTable()
 	addProducts(1)
@@ -241,27 +517,2739 @@ func TestEmptyTable(t *testing.T) {
 	}
 }
 
-func ensureTableExists() {
-	if _, err := a.DB.Exec(tableCreationQuery); err != nil {
-		log.Fatal(err)
+func TestCreateRelation(t *testing.T) {
+	clearTable()
+	addProducts(2)
+
+	var jsonStr = []byte(`{"related_id": 2, "type": "accessory"}`)
+	req, _ := http.NewRequest("POST", "/product/1/relations", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("GET", "/product/1/relations?type=accessory", nil)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	checkLength(t, m, 1)
+}
+
+func TestCreateRelation_Duplicate(t *testing.T) {
+	clearTable()
+	addProducts(2)
+
+	for _, expected := range []int{http.StatusCreated, http.StatusConflict} {
+		var jsonStr = []byte(`{"related_id": 2, "type": "accessory"}`)
+		req, _ := http.NewRequest("POST", "/product/1/relations", bytes.NewBuffer(jsonStr))
+		response := executeRequest(req)
+
+		checkResponseCode(t, expected, response.Code)
 	}
 }
 
-func clearTable() {
-	a.DB.Exec("DELETE FROM products")
-	a.DB.Exec("ALTER SEQUENCE products_id_seq RESTART WITH 1")
+func TestCreateRelation_InvalidType(t *testing.T) {
+	clearTable()
+	addProducts(2)
+
+	var jsonStr = []byte(`{"related_id": 2, "type": "something"}`)
+	req, _ := http.NewRequest("POST", "/product/1/relations", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
 }
 
-func addProducts(count int) {
-	if count < 1 {
-		count = 1
+func TestGetProduct_IncludeRelated(t *testing.T) {
+	clearTable()
+	addProducts(3)
+	addRelation(1, 2, "accessory")
+	addRelation(1, 3, "replacement_part")
+
+	req, _ := http.NewRequest("GET", "/product/1?include=related", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	related, _ := m["related"].([]interface{})
+	if len(related) != 2 {
+		t.Errorf("Expected 2 related products. Got %d", len(related))
+	}
+}
+
+func TestGetBundle(t *testing.T) {
+	clearTable()
+	addProducts(3)
+	addRelation(1, 2, "bundle_component")
+	addRelation(1, 3, "bundle_component")
+
+	req, _ := http.NewRequest("GET", "/product/1/bundle", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	// products 2 and 3 cost 20 and 30
+	if m["price"] != 50.0 {
+		t.Errorf("Expected bundle price to be '50'. Got '%v'", m["price"])
 	}
+}
 
-	for i := 0; i < count; i++ {
-		a.DB.Exec("INSERT INTO products(name, price) VALUES($1, $2)", "Product "+strconv.Itoa(i), (i+1.0)*10)
+func TestGetBundle_NotABundle(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	req, _ := http.NewRequest("GET", "/product/1/bundle", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestCreateSupplier(t *testing.T) {
+	clearTable()
+
+	var jsonStr = []byte(`{"name":"test supplier", "email": "sales@example.com"}`)
+	req, _ := http.NewRequest("POST", "/supplier", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	if m["name"] != "test supplier" {
+		t.Errorf("Expected supplier name to be 'test supplier'. Got '%v'", m["name"])
+	}
+
+	if m["id"] != 1.0 {
+		t.Errorf("Expected supplier ID to be '1'. Got '%v'", m["id"])
+	}
+}
+
+func TestUpdateSupplier(t *testing.T) {
+	clearTable()
+	addSupplier()
+
+	var jsonStr = []byte(`{"name":""}`)
+	req, _ := http.NewRequest("PUT", "/supplier/1", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	jsonStr = []byte(`{"name":"renamed supplier"}`)
+	req, _ = http.NewRequest("PUT", "/supplier/11", bytes.NewBuffer(jsonStr))
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestDeleteSupplier(t *testing.T) {
+	clearTable()
+	addSupplier()
+
+	for _, expected := range []int{http.StatusOK, http.StatusNotFound} {
+		req, _ := http.NewRequest("DELETE", "/supplier/1", nil)
+		response := executeRequest(req)
+
+		checkResponseCode(t, expected, response.Code)
+	}
+}
+
+func TestSaveSupplierProduct_NonExistentProduct(t *testing.T) {
+	clearTable()
+	addSupplier()
+
+	var jsonStr = []byte(`{"product_id": 11, "supplier_sku": "SKU-11", "cost_price": 5}`)
+	req, _ := http.NewRequest("POST", "/supplier/1/products", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestGetProductMargins(t *testing.T) {
+	clearTable()
+	addProducts(2)
+	addSupplier()
+
+	var jsonStr = []byte(`{"product_id": 1, "supplier_sku": "SKU-1", "cost_price": 4, "lead_time_days": 3}`)
+	req, _ := http.NewRequest("POST", "/supplier/1/products", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/products/margins", nil)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	checkLength(t, m, 2)
+
+	if m[0]["margin"] != 6.0 {
+		t.Errorf("Expected margin of product 1 to be '6'. Got '%v'", m[0]["margin"])
+	}
+
+	if m[1]["margin"] != nil {
+		t.Errorf("Expected margin of product 2 to be null. Got '%v'", m[1]["margin"])
+	}
+}
+
+func TestCreateReview(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	var jsonStr = []byte(`{"rating": 4, "text": "solid", "author": "tester"}`)
+	req, _ := http.NewRequest("POST", "/product/1/reviews", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	if m["status"] != "pending" {
+		t.Errorf("Expected review status to be 'pending'. Got '%v'", m["status"])
+	}
+}
+
+func TestCreateReview_InvalidRating(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	var jsonStr = []byte(`{"rating": 6, "author": "tester"}`)
+	req, _ := http.NewRequest("POST", "/product/1/reviews", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestGetReviews_OnlyApproved(t *testing.T) {
+	clearTable()
+	addProducts(1)
+	addReview(1, 5, "approved")
+	addReview(1, 1, "pending")
+
+	req, _ := http.NewRequest("GET", "/product/1/reviews?sort=lowest", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	checkLength(t, m, 1)
+}
+
+func TestModerateReviewRequiresAdmin(t *testing.T) {
+	clearTable()
+	addProducts(1)
+	addReview(1, 1, "pending")
+
+	var jsonStr = []byte(`{"status": "approved"}`)
+	req, _ := http.NewRequest("PUT", "/review/1/status", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("DELETE", "/review/1", nil)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("GET", "/product/1/reviews?status=pending", nil)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("GET", "/product/1/reviews?status=pending", nil)
+	req.Header.Set("X-Admin-Token", adminToken)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("PUT", "/review/1/status", bytes.NewBuffer(jsonStr))
+	req.Header.Set("X-Admin-Token", adminToken)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+}
+
+func TestGetProduct_Rating(t *testing.T) {
+	clearTable()
+	addProducts(1)
+	addReview(1, 5, "approved")
+	addReview(1, 4, "approved")
+	addReview(1, 1, "rejected")
+
+	req, _ := http.NewRequest("GET", "/product/1", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	rating, _ := m["rating"].(map[string]interface{})
+	if rating["average"] != 4.5 || rating["count"] != 2.0 {
+		t.Errorf("Expected rating average 4.5 of 2 reviews. Got '%v'", rating)
+	}
+}
+
+func TestGetProducts_MinRating(t *testing.T) {
+	clearTable()
+	addProducts(3)
+	addReview(1, 5, "approved")
+	addReview(2, 2, "approved")
+
+	req, _ := http.NewRequest("GET", "/products?min_rating=4", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	checkLength(t, m, 1)
+}
+
+func TestGetProduct_ConvertUnits(t *testing.T) {
+	clearTable()
+
+	var jsonStr = []byte(`{"name":"parcel", "price": 5, "weight": 2, "weight_unit": "kg", "length": 10, "width": 10, "height": 10, "dimension_unit": "cm"}`)
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("GET", "/product/1?weight_unit=g&dimension_unit=mm", nil)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	if m["weight"] != 2000.0 || m["length"] != 100.0 {
+		t.Errorf("Expected 2000 g and 100 mm. Got '%v' and '%v'", m["weight"], m["length"])
 	}
 }
 
+func TestCreateProduct_InvalidUnit(t *testing.T) {
+	clearTable()
+
+	var jsonStr = []byte(`{"name":"parcel", "price": 5, "weight": 2, "weight_unit": "stone"}`)
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestEstimateShipping(t *testing.T) {
+	clearTable()
+	a.DB.Exec("INSERT INTO products(name, price, weight, length, width, height) VALUES('Box', 10, 1, 50, 40, 30)")
+
+	var jsonStr = []byte(`{"items": [{"product_id": 1, "quantity": 1}], "carrier": "standard"}`)
+	req, _ := http.NewRequest("POST", "/shipping/estimate", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	checkLength(t, m, 1)
+
+	// 50x40x30 cm / 5000 = 12 kg volumetric, which falls into the 31.5 kg band
+	if len(m) == 1 && (m[0]["chargeable_weight_kg"] != 12.0 || m[0]["cost"] != 19.9) {
+		t.Errorf("Expected 12 kg chargeable at 19.9. Got '%v'", m[0])
+	}
+}
+
+func TestPlaceOrder(t *testing.T) {
+	clearTable()
+	addProducts(2)
+	a.DB.Exec("UPDATE products SET stock = 5")
+	cartID := addCart(map[int]int{1: 2, 2: 1})
+
+	req, _ := http.NewRequest("POST", "/cart/"+strconv.Itoa(cartID)+"/order", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	// 2 x 10 + 1 x 20
+	if m["total"] != 40.0 {
+		t.Errorf("Expected order total to be '40'. Got '%v'", m["total"])
+	}
+
+	if m["status"] != "pending" {
+		t.Errorf("Expected order status to be 'pending'. Got '%v'", m["status"])
+	}
+
+	var stock int
+	a.DB.QueryRow("SELECT stock FROM products WHERE id=1").Scan(&stock)
+	if stock != 3 {
+		t.Errorf("Expected stock of product 1 to be 3. Got %d", stock)
+	}
+}
+
+func TestPlaceOrder_PriceChanged(t *testing.T) {
+	clearTable()
+	addProducts(1)
+	a.DB.Exec("UPDATE products SET stock = 5")
+	cartID := addCart(map[int]int{1: 1})
+	a.DB.Exec("UPDATE products SET price = 99")
+
+	req, _ := http.NewRequest("POST", "/cart/"+strconv.Itoa(cartID)+"/order", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusConflict, response.Code)
+}
+
+func TestPlaceOrder_InsufficientStock(t *testing.T) {
+	clearTable()
+	addProducts(1)
+	cartID := addCart(map[int]int{1: 1})
+
+	req, _ := http.NewRequest("POST", "/cart/"+strconv.Itoa(cartID)+"/order", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusConflict, response.Code)
+}
+
+func TestPlaceOrder_Concurrently(t *testing.T) {
+	clearTable()
+	addProducts(1)
+	a.DB.Exec("UPDATE products SET stock = 5")
+	cartID := addCart(map[int]int{1: 1})
+
+	codes := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			req, _ := http.NewRequest("POST", "/cart/"+strconv.Itoa(cartID)+"/order", nil)
+			codes <- executeRequest(req).Code
+		}()
+	}
+
+	created := 0
+	for i := 0; i < 2; i++ {
+		if <-codes == http.StatusCreated {
+			created++
+		}
+	}
+	if created != 1 {
+		t.Errorf("Expected the cart to be ordered once. Got %d orders", created)
+	}
+
+	var stock int
+	a.DB.QueryRow("SELECT stock FROM products WHERE id=1").Scan(&stock)
+	if stock != 4 {
+		t.Errorf("Expected stock of product 1 to be 4. Got %d", stock)
+	}
+}
+
+func TestUpdateOrderStatus_InvalidTransition(t *testing.T) {
+	clearTable()
+	addProducts(1)
+	a.DB.Exec("UPDATE products SET stock = 5")
+	cartID := addCart(map[int]int{1: 1})
+
+	req, _ := http.NewRequest("POST", "/cart/"+strconv.Itoa(cartID)+"/order", nil)
+	executeRequest(req)
+
+	var jsonStr = []byte(`{"status": "delivered"}`)
+	req, _ = http.NewRequest("PUT", "/order/1/status", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	jsonStr = []byte(`{"status": "cancelled"}`)
+	req, _ = http.NewRequest("PUT", "/order/1/status", bytes.NewBuffer(jsonStr))
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+}
+
+func TestWishlist(t *testing.T) {
+	clearTable()
+	addProducts(2)
+
+	req, _ := http.NewRequest("PUT", "/wishlist/customer/2", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/wishlist/customer", nil)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	checkLength(t, m, 1)
+}
+
+func TestPriceWatch_TriggeredOnPriceDrop(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	var jsonStr = []byte(`{"customer": "customer", "product_id": 1, "target_price": 8}`)
+	req, _ := http.NewRequest("POST", "/price-watch", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	jsonStr = []byte(`{"name":"Product 0", "price": 7.5}`)
+	req, _ = http.NewRequest("PUT", "/product/1", bytes.NewBuffer(jsonStr))
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/price-watches?customer=customer", nil)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("GET", "/price-watches?customer=customer", nil)
+	req.Header.Set("X-Admin-Token", adminToken)
+	response = executeRequest(req)
+
+	var m []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	checkLength(t, m, 1)
+
+	if len(m) == 1 && m[0]["triggered_at"] == nil {
+		t.Errorf("Expected the price watch to be triggered")
+	}
+}
+
+func TestDeletePriceWatch(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	var jsonStr = []byte(`{"customer": "customer", "product_id": 1, "target_price": 8}`)
+	req, _ := http.NewRequest("POST", "/price-watch", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	id := fmt.Sprint(m["id"])
+
+	req, _ = http.NewRequest("DELETE", "/price-watch/"+id, nil)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	for _, expected := range []int{http.StatusOK, http.StatusNotFound} {
+		req, _ = http.NewRequest("DELETE", "/price-watch/"+id, nil)
+		req.Header.Set("X-Admin-Token", adminToken)
+		response = executeRequest(req)
+
+		checkResponseCode(t, expected, response.Code)
+	}
+}
+
+func TestDeleteWishlistItem_NotFound(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	req, _ := http.NewRequest("DELETE", "/wishlist/customer/1", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestCreatePriceWatch_UnsupportedChannel(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	var jsonStr = []byte(`{"customer": "customer", "product_id": 1, "target_price": 8, "channel": "pigeon"}`)
+	req, _ := http.NewRequest("POST", "/price-watch", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestCreatePriceWatch_InvalidAddress(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	for address, expected := range map[string]string{
+		`"webhook", "address": "http://example.com/alerts"`:     "Webhook address must be an https URL",
+		`"webhook", "address": "https://127.0.0.1/alerts"`:      "Webhook address must be public",
+		`"webhook", "address": "https://10.0.0.5/alerts"`:       "Webhook address must be public",
+		`"webhook", "address": "https://100.64.0.1/alerts"`:     "Webhook address must be public",
+		`"webhook", "address": "https://0.1.2.3/alerts"`:        "Webhook address must be public",
+		`"webhook", "address": "https://localhost/alerts"`:      "Webhook address must be public",
+		`"email", "address": "customer"`:                        "Invalid email address",
+		`"email", "address": "Customer <customer@example.com>"`: "Invalid email address",
+	} {
+		var jsonStr = []byte(`{"customer": "customer", "product_id": 1, "target_price": 8, "channel": ` + address + `}`)
+		req, _ := http.NewRequest("POST", "/price-watch", bytes.NewBuffer(jsonStr))
+		response := executeRequest(req)
+
+		checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+		var m map[string]string
+		json.Unmarshal(response.Body.Bytes(), &m)
+
+		if m["error"] != expected {
+			t.Errorf("Expected the error '%s' for %s. Got '%s'", expected, address, m["error"])
+		}
+	}
+}
+
+func TestGetProducts_SortPopular(t *testing.T) {
+	clearTable()
+	addProducts(3)
+	addViews(2, 50, 1)
+	addViews(3, 200, 240)
+
+	req, _ := http.NewRequest("GET", "/products?sort=popular", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	checkLength(t, m, 3)
+
+	// the older views of product 3 have decayed below the recent ones of product 2
+	if len(m) == 3 && m[0]["id"] != 2.0 {
+		t.Errorf("Expected product 2 to be the most popular. Got '%v'", m[0]["id"])
+	}
+}
+
+func TestGetProducts_InvalidSort(t *testing.T) {
+	clearTable()
+
+	req, _ := http.NewRequest("GET", "/products?sort=something", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestGetTrendingProducts(t *testing.T) {
+	clearTable()
+	addProducts(3)
+	addViews(1, 5, 2)
+	addViews(2, 10, 3)
+	addViews(3, 100, 48)
+
+	req, _ := http.NewRequest("GET", "/products/trending", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	checkLength(t, m, 2)
+
+	if len(m) == 2 && m[0]["id"] != 2.0 {
+		t.Errorf("Expected product 2 to be trending first. Got '%v'", m[0]["id"])
+	}
+}
+
+func TestGetRecommendations(t *testing.T) {
+	clearTable()
+	addProducts(4)
+	addOrder(1, 2)
+	addOrder(1, 2, 3)
+	addOrder(1, 3)
+	addOrder(2, 4)
+	a.DB.Exec("UPDATE products SET published = false WHERE id = 3")
+
+	req, _ := http.NewRequest("POST", "/jobs/recommendations", nil)
+	req.Header.Set("X-Admin-Token", adminToken)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/product/1/recommendations", nil)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	// product 3 is unpublished and product 4 was never ordered with product 1
+	checkLength(t, m, 1)
+
+	if len(m) == 1 && m[0]["id"] != 2.0 {
+		t.Errorf("Expected product 2 to be recommended. Got '%v'", m[0]["id"])
+	}
+}
+
+func TestRunJob_NotFound(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/jobs/something", nil)
+	req.Header.Set("X-Admin-Token", adminToken)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestRunJobRequiresAdmin(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/jobs/recommendations", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+}
+
+func TestGetDuplicates(t *testing.T) {
+	clearTable()
+	a.DB.Exec("INSERT INTO products(name, price) VALUES('Product 1', 10), ('product-1', 10), ('Widget', 5), ('Gadget', 7)")
+	a.DB.Exec("INSERT INTO products(name, price, barcode) VALUES('Blue Widget', 5, '4006381333931'), ('Widget (blue)', 5, '4006381333931')")
+
+	req, _ := http.NewRequest("POST", "/jobs/duplicates", nil)
+	req.Header.Set("X-Admin-Token", adminToken)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/products/duplicates", nil)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	checkLength(t, m, 2)
+
+	for _, cluster := range m {
+		ids, _ := cluster["product_ids"].([]interface{})
+		if len(ids) != 2 {
+			t.Errorf("Expected clusters of 2 products. Got %v", ids)
+		}
+	}
+}
+
+func TestMergeProducts(t *testing.T) {
+	clearTable()
+	addProducts(3)
+	a.DB.Exec("UPDATE products SET stock = 2")
+	addReview(2, 5, "approved")
+	addRelation(3, 2, "accessory")
+
+	var jsonStr = []byte(`{"target_id": 1, "source_ids": [2]}`)
+	req, _ := http.NewRequest("POST", "/products/merge", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	if m["stock"] != 4.0 {
+		t.Errorf("Expected merged stock to be '4'. Got '%v'", m["stock"])
+	}
+
+	rating, _ := m["rating"].(map[string]interface{})
+	if rating["count"] != 1.0 {
+		t.Errorf("Expected the review to move to the target. Got '%v'", rating)
+	}
+
+	req, _ = http.NewRequest("GET", "/product/2", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	req, _ = http.NewRequest("GET", "/product/3/relations", nil)
+	response = executeRequest(req)
+
+	var relations []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &relations)
+
+	if len(relations) != 1 || relations[0]["related_id"] != 1.0 {
+		t.Errorf("Expected the relation to point to the target. Got '%v'", relations)
+	}
+}
+
+func TestMergeProducts_NonExistentSource(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	var jsonStr = []byte(`{"target_id": 1, "source_ids": [11]}`)
+	req, _ := http.NewRequest("POST", "/products/merge", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestTenantIsolation(t *testing.T) {
+	clearTable()
+	addTenant("acme", 0)
+
+	var jsonStr = []byte(`{"name":"acme product", "price": 11.22}`)
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(jsonStr))
+	req.Header.Set("X-Tenant", "acme")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("GET", "/product/1", nil)
+	req.Header.Set("X-Tenant", "acme")
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/product/1", nil)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	req, _ = http.NewRequest("GET", "/products", nil)
+	response = executeRequest(req)
+
+	if body := response.Body.String(); body != "[]" {
+		t.Errorf("Expected the default tenant to see no products. Got %s", body)
+	}
+}
+
+func TestTenantProductLimit(t *testing.T) {
+	clearTable()
+	addTenant("acme", 1)
+
+	for i, expected := range []int{http.StatusCreated, http.StatusForbidden} {
+		var jsonStr = []byte(`{"name":"product ` + strconv.Itoa(i) + `", "price": 1}`)
+		req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(jsonStr))
+		req.Header.Set("X-Tenant", "acme")
+		response := executeRequest(req)
+
+		checkResponseCode(t, expected, response.Code)
+	}
+}
+
+func TestTenantProductLimit_Concurrently(t *testing.T) {
+	clearTable()
+	addTenant("acme", 3)
+
+	codes := make(chan int, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			var jsonStr = []byte(`[{"name":"imported product", "price": 1}]`)
+			req, _ := http.NewRequest("POST", "/products/import", bytes.NewBuffer(jsonStr))
+			req.Header.Set("X-Tenant", "acme")
+			codes <- executeRequest(req).Code
+		}()
+	}
+
+	created := 0
+	for i := 0; i < 5; i++ {
+		if <-codes == http.StatusCreated {
+			created++
+		}
+	}
+	if created != 3 {
+		t.Errorf("Expected 3 products within the limit. Got %d", created)
+	}
+}
+
+func TestTenantFromToken(t *testing.T) {
+	clearTable()
+	addTenant("acme", 0)
+	a.TenantTokenSecret = []byte("secret")
+	defer func() { a.TenantTokenSecret = nil }()
+
+	token := tenantToken("acme")
+
+	req, _ := http.NewRequest("GET", "/tenant", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	if m["slug"] != "acme" {
+		t.Errorf("Expected tenant to be 'acme'. Got '%v'", m["slug"])
+	}
+
+	req, _ = http.NewRequest("GET", "/tenant", nil)
+	req.Header.Set("Authorization", "Bearer "+token+"x")
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+}
+
+func TestTenantHeaderIgnoredWithToken(t *testing.T) {
+	clearTable()
+	addTenant("acme", 0)
+	addTenant("other", 0)
+	a.TenantTokenSecret = []byte("secret")
+	defer func() { a.TenantTokenSecret = nil }()
+
+	req, _ := http.NewRequest("GET", "/tenant", nil)
+	req.Header.Set("Authorization", "Bearer "+tenantToken("acme"))
+	req.Header.Set("X-Tenant", "other")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	if m["slug"] != "acme" {
+		t.Errorf("Expected tenant to be 'acme'. Got '%v'", m["slug"])
+	}
+
+	req, _ = http.NewRequest("GET", "/tenant", nil)
+	req.Header.Set("X-Tenant", "other")
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	if m["slug"] != "default" {
+		t.Errorf("Expected tenant to be 'default'. Got '%v'", m["slug"])
+	}
+}
+
+func TestTenantRoutesRequireAdmin(t *testing.T) {
+	clearTable()
+
+	var jsonStr = []byte(`{"slug":"acme", "name":"Acme"}`)
+	req, _ := http.NewRequest("POST", "/tenant", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("GET", "/tenants", nil)
+	req.Header.Set("X-Admin-Token", "wrong")
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	req, _ = http.NewRequest("POST", "/tenant", bytes.NewBuffer(jsonStr))
+	req.Header.Set("X-Admin-Token", adminToken)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("GET", "/tenants", nil)
+	req.Header.Set("X-Admin-Token", adminToken)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	checkLength(t, m, 2)
+}
+
+func TestTenantRoutesForAdminCertificate(t *testing.T) {
+	a.AdminIdentities = []string{"ops"}
+	defer func() { a.AdminIdentities = nil }()
+
+	for name, expected := range map[string]int{"ops": http.StatusOK, "shop": http.StatusForbidden} {
+		req, _ := http.NewRequest("GET", "/tenants", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{newTestCert(t, name, 1, nil).cert}}}
+		response := executeRequest(req)
+
+		checkResponseCode(t, expected, response.Code)
+	}
+}
+
+func TestTenantCache(t *testing.T) {
+	clearTable()
+	addTenant("acme", 0)
+	a.TenantCacheTTL = time.Minute
+	defer func() { a.TenantCacheTTL = 0 }()
+
+	pageSize := func() interface{} {
+		req, _ := http.NewRequest("GET", "/tenant", nil)
+		req.Header.Set("X-Tenant", "acme")
+		response := executeRequest(req)
+
+		var m map[string]interface{}
+		json.Unmarshal(response.Body.Bytes(), &m)
+
+		return m["max_page_size"]
+	}
+
+	pageSize()
+	a.DB.Exec("UPDATE tenants SET max_page_size=20 WHERE slug='acme'")
+
+	if size := pageSize(); size != 10.0 {
+		t.Errorf("Expected the cached page size of 10. Got '%v'", size)
+	}
+
+	var id int
+	a.DB.QueryRow("SELECT id FROM tenants WHERE slug='acme'").Scan(&id)
+
+	req, _ := http.NewRequest("PUT", "/tenant/"+strconv.Itoa(id), bytes.NewBufferString(`{"name":"Acme", "max_page_size": 5}`))
+	req.Header.Set("X-Admin-Token", adminToken)
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	if size := pageSize(); size != 5.0 {
+		t.Errorf("Expected the updated page size of 5. Got '%v'", size)
+	}
+}
+
+func TestUnknownTenant(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/products", nil)
+	req.Header.Set("X-Tenant", "something")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestChannelAssortment(t *testing.T) {
+	clearTable()
+	addProducts(2)
+
+	req, _ := http.NewRequest("POST", "/channel", bytes.NewBuffer([]byte(`{"code":"web", "name":"Web shop"}`)))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("PUT", "/channel/1/products/1", bytes.NewBuffer([]byte(`{"price": 5}`)))
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("PUT", "/channel/1/products/2", bytes.NewBuffer([]byte(`{"visible": false}`)))
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/products?channel=web", nil)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var products []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &products)
+
+	if len(products) != 1 || products[0]["price"] != 5.0 {
+		t.Errorf("Expected only product 1 at the channel price of 5. Got %v", products)
+	}
+
+	req, _ = http.NewRequest("GET", "/product/2?channel=web", nil)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	req, _ = http.NewRequest("GET", "/product/1", nil)
+	response = executeRequest(req)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	if m["price"] != 10.0 {
+		t.Errorf("Expected the product's own price of 10 without a channel. Got '%v'", m["price"])
+	}
+}
+
+func TestChannelHidesProductsFromSearchAndCount(t *testing.T) {
+	clearTable()
+	addProducts(2)
+
+	req, _ := http.NewRequest("POST", "/channel", bytes.NewBuffer([]byte(`{"code":"web", "name":"Web shop"}`)))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("PUT", "/channel/1/products/2", bytes.NewBuffer([]byte(`{"visible": false}`)))
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/product/search?name=product&channel=web", nil)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var products []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &products)
+
+	if len(products) != 1 || products[0]["id"] != 1.0 {
+		t.Errorf("Expected only product 1 to be found in the channel. Got %v", products)
+	}
+
+	req, _ = http.NewRequest("GET", "/product/meta/count?channel=web", nil)
+	response = executeRequest(req)
+
+	if body := response.Body.String(); body != "1" {
+		t.Errorf("Expected a count of 1 in the channel. Got %s", body)
+	}
+
+	req, _ = http.NewRequest("GET", "/product/meta/count", nil)
+	response = executeRequest(req)
+
+	if body := response.Body.String(); body != "2" {
+		t.Errorf("Expected a count of 2 without a channel. Got %s", body)
+	}
+
+	_, m := executeGraphQL(`{ searchProducts(name: "product", channel: "web") { id } productCount(channel: "web") }`, nil)
+	data, _ := m["data"].(map[string]interface{})
+
+	if found, _ := data["searchProducts"].([]interface{}); len(found) != 1 {
+		t.Errorf("Expected GraphQL to find 1 product in the channel. Got %v", m)
+	}
+	if data["productCount"] != 1.0 {
+		t.Errorf("Expected a GraphQL count of 1 in the channel. Got %v", m)
+	}
+
+	client := productpb.NewProductServiceClient(dialGRPC(t))
+	ctx := context.Background()
+
+	list, err := client.Search(ctx, &productpb.SearchProductsRequest{Name: "product", Channel: "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Products) != 1 || list.Products[0].Id != 1 {
+		t.Errorf("Expected gRPC to find product 1 in the channel. Got %v", list.Products)
+	}
+
+	count, err := client.Count(ctx, &productpb.CountProductsRequest{Channel: "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count.Count != 1 {
+		t.Errorf("Expected a gRPC count of 1 in the channel. Got %d", count.Count)
+	}
+}
+
+func TestUnknownChannel(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	req, _ := http.NewRequest("GET", "/products?channel=retail", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+func TestCreateChannelDuplicateCode(t *testing.T) {
+	clearTable()
+
+	for _, expected := range []int{http.StatusCreated, http.StatusConflict} {
+		req, _ := http.NewRequest("POST", "/channel", bytes.NewBuffer([]byte(`{"code":"marketplace", "name":"Marketplace"}`)))
+		response := executeRequest(req)
+
+		checkResponseCode(t, expected, response.Code)
+	}
+}
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/openapi.json", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var doc struct {
+		Paths map[string]map[string]interface{} `json:"paths"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &doc)
+
+	documented := map[string]bool{}
+	for path, operations := range doc.Paths {
+		for method := range operations {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	// mux templates carry the patterns of their variables, OpenAPI paths do not
+	pattern := regexp.MustCompile(`\{([^:}]+):[^}]+\}`)
+
+	registered := map[string]bool{}
+	a.Router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+
+		for _, method := range methods {
+			key := method + " " + pattern.ReplaceAllString(template, "{$1}")
+			registered[key] = true
+
+			if !documented[key] {
+				t.Errorf("Route %s is missing from the OpenAPI document", key)
+			}
+		}
+
+		return nil
+	})
+
+	for key := range documented {
+		if !registered[key] {
+			t.Errorf("OpenAPI document describes %s, which is not a route", key)
+		}
+	}
+}
+
+func TestGetOpenAPI(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/openapi.json", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var doc struct {
+		Paths map[string]map[string]struct {
+			Parameters []struct {
+				Name   string            `json:"name"`
+				Schema map[string]string `json:"schema"`
+			} `json:"parameters"`
+			Responses map[string]struct {
+				Content map[string]struct {
+					Schema map[string]string `json:"schema"`
+				} `json:"content"`
+			} `json:"responses"`
+		} `json:"paths"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &doc)
+
+	op, ok := doc.Paths["/product/{id}"]["get"]
+	if !ok {
+		t.Fatalf("Expected GET /product/{id} to be documented")
+	}
+	if op.Responses["200"].Content["application/json"].Schema["$ref"] != "#/components/schemas/product" {
+		t.Errorf("Expected GET /product/{id} to respond with a product")
+	}
+	if len(op.Parameters) == 0 || op.Parameters[0].Name != "id" || op.Parameters[0].Schema["type"] != "integer" {
+		t.Errorf("Expected an integer id path parameter. Got %v", op.Parameters)
+	}
+}
+
+func TestAPIValidationRejectsInvalidBody(t *testing.T) {
+	clearTable()
+
+	var jsonStr = []byte(`{"name": 5, "price": "cheap"}`)
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(jsonStr))
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	var m struct {
+		Details []string `json:"details"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	expected := []string{"body.name: must be a string", "body.price: must be a number"}
+	if strings.Join(m.Details, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected details %v. Got %v", expected, m.Details)
+	}
+}
+
+func TestAPIValidationRejectsInvalidQuery(t *testing.T) {
+	clearTable()
+
+	req, _ := http.NewRequest("GET", "/products?count=ten", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	if body := response.Body.String(); !strings.Contains(body, "query parameter count: must be an integer") {
+		t.Errorf("Expected the invalid count to be reported. Got %s", body)
+	}
+}
+
+func executeGraphQL(query string, variables map[string]interface{}) (*httptest.ResponseRecorder, map[string]interface{}) {
+	payload, _ := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+	req, _ := http.NewRequest("POST", "/graphql", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	return response, m
+}
+
+func TestGraphQLProducts(t *testing.T) {
+	clearTable()
+	addProducts(2)
+
+	response, m := executeGraphQL(`{ products(count: 1) { id name } productCount }`, nil)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	data := m["data"].(map[string]interface{})
+	products := data["products"].([]interface{})
+	if len(products) != 1 || products[0].(map[string]interface{})["name"] != "Product 0" {
+		t.Errorf("Expected only 'Product 0'. Got %v", products)
+	}
+	if data["productCount"] != 2.0 {
+		t.Errorf("Expected a product count of 2. Got '%v'", data["productCount"])
+	}
+
+	if body := response.Body.String(); !strings.HasPrefix(body, `{"data":{"products":[{"id":1,"name":"Product 0"}]`) {
+		t.Errorf("Expected fields in the order of the query. Got %s", body)
+	}
+}
+
+func TestGraphQLMutations(t *testing.T) {
+	clearTable()
+
+	response, m := executeGraphQL(`mutation Create($input: ProductInput!) { createProduct(input: $input) { id price } }`,
+		map[string]interface{}{"input": map[string]interface{}{"name": "graphql product", "price": 12.5}})
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	created := m["data"].(map[string]interface{})["createProduct"].(map[string]interface{})
+	if created["id"] != 1.0 || created["price"] != 12.5 {
+		t.Errorf("Expected product 1 with a price of 12.5. Got %v", created)
+	}
+
+	_, m = executeGraphQL(`mutation { updateProduct(id: 1, input: {stock: 3}) { name stock } }`, nil)
+
+	updated := m["data"].(map[string]interface{})["updateProduct"].(map[string]interface{})
+	if updated["name"] != "graphql product" || updated["stock"] != 3.0 {
+		t.Errorf("Expected only the stock to change. Got %v", updated)
+	}
+
+	_, m = executeGraphQL(`mutation { deleteProduct(id: 1) }`, nil)
+
+	if m["data"].(map[string]interface{})["deleteProduct"] != true {
+		t.Errorf("Expected the product to be deleted. Got %v", m)
+	}
+}
+
+func TestGraphQLRelated(t *testing.T) {
+	clearTable()
+	addProducts(3)
+	addRelation(1, 2, "accessory")
+	addRelation(2, 3, "accessory")
+
+	_, m := executeGraphQL(`{ products { id related { product { name } } } }`, nil)
+
+	products := m["data"].(map[string]interface{})["products"].([]interface{})
+	expected := []string{"[Product 1]", "[Product 2]", "[]"}
+
+	for i, p := range products {
+		var names []string
+		for _, rel := range p.(map[string]interface{})["related"].([]interface{}) {
+			names = append(names, rel.(map[string]interface{})["product"].(map[string]interface{})["name"].(string))
+		}
+		if got := fmt.Sprint(names); got != expected[i] {
+			t.Errorf("Expected product %d to be related to %s. Got %s", i+1, expected[i], got)
+		}
+	}
+}
+
+func TestGraphQLComplexityLimit(t *testing.T) {
+	response, m := executeGraphQL(`{ products(count: 100) { related { product { related { product { id name price } } } } } }`, nil)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	if _, ok := m["data"]; ok {
+		t.Errorf("Expected the query not to be executed. Got %v", m["data"])
+	}
+}
+
+func TestGraphQLSearchProducts(t *testing.T) {
+	clearTable()
+	addProducts(3)
+
+	_, m := executeGraphQL(`{ searchProducts(name: "product", start: 1, count: 1) { id } }`, nil)
+
+	found, _ := m["data"].(map[string]interface{})["searchProducts"].([]interface{})
+	if len(found) != 1 || found[0].(map[string]interface{})["id"] != 2.0 {
+		t.Errorf("Expected only product 2. Got %v", m)
+	}
+
+	for _, query := range []string{`{ searchProducts(name: "") { id } }`, `{ products(minRating: 6) { id } }`} {
+		_, m = executeGraphQL(query, nil)
+
+		if errors, _ := m["errors"].([]interface{}); len(errors) != 1 {
+			t.Errorf("Expected an error for %s. Got %v", query, m)
+		}
+	}
+
+	response, _ := executeGraphQL(`{ searchProducts(name: "") { related { product { related { product { id } } } } } }`, nil)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+func TestGraphQLComplexityOfClampedCount(t *testing.T) {
+	clearTable()
+
+	// the count is clamped to the page size of the tenant
+	response, _ := executeGraphQL(`{ products(count: 2000000000) { id name } }`, nil)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+}
+
+func TestGraphQLDepthLimit(t *testing.T) {
+	response, m := executeGraphQL(`{ product(id: 1) { related { product { related { product { related { product { related { product { id } } } } } } } } } }`, nil)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	if errors, _ := m["errors"].([]interface{}); len(errors) != 1 || !strings.Contains(fmt.Sprint(errors[0]), "depth") {
+		t.Errorf("Expected the query depth to be refused. Got %v", m)
+	}
+}
+
+func TestGraphQLFragmentsAndDirectives(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	response, m := executeGraphQL(`query Get($withPrice: Boolean!) { product(id: 1) { ...Names price @include(if: $withPrice) } }
+		fragment Names on Product { id name }`, map[string]interface{}{"withPrice": false})
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	p := m["data"].(map[string]interface{})["product"].(map[string]interface{})
+	if _, ok := p["price"]; ok || p["name"] != "Product 0" {
+		t.Errorf("Expected the name of the fragment without the price. Got %v", p)
+	}
+}
+
+func TestGraphQLIntrospection(t *testing.T) {
+	response, m := executeGraphQL(`{ __type(name: "Product") { fields { name } } }`, nil)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	fields := m["data"].(map[string]interface{})["__type"].(map[string]interface{})["fields"].([]interface{})
+	if len(fields) == 0 || fields[0].(map[string]interface{})["name"] != "id" {
+		t.Errorf("Expected the fields of Product. Got %v", fields)
+	}
+}
+
+func TestGraphQLInvalidQuery(t *testing.T) {
+	response, _ := executeGraphQL(`{ products { nope } }`, nil)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+// dialGRPC serves the gRPC API of the app over an in-memory listener and
+// returns a client connection to it.
+func dialGRPC(t *testing.T) *grpc.ClientConn {
+	return dialGRPCServer(t, a.NewGRPCServer())
+}
+
+// dialGRPCServer serves s over an in-memory listener and returns a client
+// connection to it.
+func dialGRPCServer(t *testing.T, s *grpc.Server) *grpc.ClientConn {
+	lis := bufconn.Listen(1024 * 1024)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestGRPCCreateAndGetProduct(t *testing.T) {
+	clearTable()
+	client := productpb.NewProductServiceClient(dialGRPC(t))
+	ctx := context.Background()
+
+	created, err := client.Create(ctx, &productpb.CreateProductRequest{Product: &productpb.Product{Name: "grpc product", Price: 11.22}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Id != 1 || !created.GetPublished() {
+		t.Errorf("Expected published product 1. Got %v", created)
+	}
+
+	p, err := client.Get(ctx, &productpb.GetProductRequest{Id: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "grpc product" || p.Price != 11.22 {
+		t.Errorf("Expected 'grpc product' at 11.22. Got %v", p)
+	}
+
+	_, err = client.Update(ctx, &productpb.UpdateProductRequest{Product: &productpb.Product{Id: 1, Name: "grpc product", Price: 11.22, Stock: -1}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for a negative stock. Got %v", err)
+	}
+}
+
+func TestGRPCListAndCountProducts(t *testing.T) {
+	clearTable()
+	addProducts(3)
+	client := productpb.NewProductServiceClient(dialGRPC(t))
+	ctx := context.Background()
+
+	list, err := client.List(ctx, &productpb.ListProductsRequest{Start: 1, Count: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Products) != 2 || list.Products[0].Name != "Product 1" {
+		t.Errorf("Expected products 1 and 2. Got %v", list.Products)
+	}
+
+	count, err := client.Count(ctx, &productpb.CountProductsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count.Count != 3 {
+		t.Errorf("Expected a count of 3. Got %d", count.Count)
+	}
+}
+
+func TestGRPCGetNonExistentProduct(t *testing.T) {
+	clearTable()
+	client := productpb.NewProductServiceClient(dialGRPC(t))
+
+	_, err := client.Get(context.Background(), &productpb.GetProductRequest{Id: 11})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound. Got %v", err)
+	}
+
+	_, err = client.Delete(context.Background(), &productpb.DeleteProductRequest{Id: 11})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound on delete. Got %v", err)
+	}
+}
+
+func TestGRPCUnknownTenant(t *testing.T) {
+	client := productpb.NewProductServiceClient(dialGRPC(t))
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-tenant", "unknown")
+
+	_, err := client.Count(ctx, &productpb.CountProductsRequest{})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound for an unknown tenant. Got %v", err)
+	}
+}
+
+func TestGRPCTenantHeaderIgnoredWithToken(t *testing.T) {
+	clearTable()
+	addTenant("acme", 0)
+	addTenant("other", 0)
+	addProducts(1)
+	a.TenantTokenSecret = []byte("secret")
+	defer func() { a.TenantTokenSecret = nil }()
+
+	client := productpb.NewProductServiceClient(dialGRPC(t))
+	ctx := metadata.AppendToOutgoingContext(context.Background(),
+		"authorization", "Bearer "+tenantToken("acme"), "x-tenant", "default")
+
+	count, err := client.Count(ctx, &productpb.CountProductsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count.Count != 0 {
+		t.Errorf("Expected the products of 'acme' to be counted. Got %d", count.Count)
+	}
+}
+
+func TestGRPCWatchProducts(t *testing.T) {
+	clearTable()
+	client := productpb.NewProductServiceClient(dialGRPC(t))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &productpb.WatchProductsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the server sends headers once it has subscribed
+	if _, err := stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBufferString(`{"name":"watched product", "price": 1.5}`))
+	req.Header.Set("Content-Type", "application/json")
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+
+	event, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != productpb.ProductEvent_CREATED || event.Product.GetName() != "watched product" {
+		t.Errorf("Expected a created event of 'watched product'. Got %v", event)
+	}
+}
+
+func TestGRPCWatchMergedProducts(t *testing.T) {
+	clearTable()
+	addProducts(2)
+	client := productpb.NewProductServiceClient(dialGRPC(t))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &productpb.WatchProductsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("POST", "/products/merge", bytes.NewBufferString(`{"target_id": 1, "source_ids": [2]}`))
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+
+	event, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != productpb.ProductEvent_DELETED || event.Product.GetId() != 2 {
+		t.Errorf("Expected a deleted event of product 2. Got %v", event)
+	}
+}
+
+func TestGRPCHealth(t *testing.T) {
+	client := healthpb.NewHealthClient(dialGRPC(t))
+
+	resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "catalog.v1.ProductService"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected SERVING. Got %v", resp.Status)
+	}
+}
+
+func TestGetProductAsXML(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	req, _ := http.NewRequest("GET", "/product/1", nil)
+	req.Header.Set("Accept", "application/xml")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var p struct {
+		ID   int    `xml:"id"`
+		Name string `xml:"name"`
+	}
+	if err := xml.Unmarshal(response.Body.Bytes(), &p); err != nil || p.ID != 1 || p.Name != "Product 0" {
+		t.Errorf("Expected product 1 as XML. Got %s", response.Body.String())
+	}
+}
+
+func TestGetProductsAsCSV(t *testing.T) {
+	clearTable()
+	addProducts(2)
+
+	req, _ := http.NewRequest("GET", "/products", nil)
+	req.Header.Set("Accept", "text/csv")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	records, err := csv.NewReader(response.Body).ReadAll()
+	if err != nil || len(records) != 3 || records[0][1] != "name" || records[2][1] != "Product 1" {
+		t.Errorf("Expected a header and 2 products. Got %v", records)
+	}
+
+	// a single product is not a list
+	req, _ = http.NewRequest("GET", "/product/1", nil)
+	req.Header.Set("Accept", "text/csv")
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotAcceptable, response.Code)
+}
+
+func TestGetProductAsProtobuf(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	req, _ := http.NewRequest("GET", "/product/1", nil)
+	req.Header.Set("Accept", "application/x-protobuf")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var p productpb.Product
+	if err := proto.Unmarshal(response.Body.Bytes(), &p); err != nil || p.Name != "Product 0" {
+		t.Errorf("Expected 'Product 0' as protobuf. Got %v (%v)", &p, err)
+	}
+}
+
+func TestNotAcceptable(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	req, _ := http.NewRequest("GET", "/product/1", nil)
+	req.Header.Set("Accept", "image/png")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotAcceptable, response.Code)
+}
+
+func TestNotAcceptableBeforeCreating(t *testing.T) {
+	clearTable()
+
+	for _, accept := range []string{"text/csv", "image/png"} {
+		var jsonStr = []byte(`{"name":"test product", "price": 11.22}`)
+		req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(jsonStr))
+		req.Header.Set("Accept", accept)
+		response := executeRequest(req)
+
+		checkResponseCode(t, http.StatusNotAcceptable, response.Code)
+	}
+
+	req, _ := http.NewRequest("GET", "/product/meta/count", nil)
+	response := executeRequest(req)
+
+	if body := response.Body.String(); body != "0" {
+		t.Errorf("Expected no product to be created. Got a count of %s", body)
+	}
+}
+
+func TestCreateProductFromMsgpack(t *testing.T) {
+	clearTable()
+
+	body, _ := msgpack.Marshal(map[string]interface{}{"name": "msgpack product", "price": 2.5})
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/msgpack")
+	req.Header.Set("Accept", "application/msgpack")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var m map[string]interface{}
+	if err := msgpack.Unmarshal(response.Body.Bytes(), &m); err != nil || m["name"] != "msgpack product" || m["published"] != true {
+		t.Errorf("Expected the published 'msgpack product'. Got %v (%v)", m, err)
+	}
+}
+
+func TestCreateProductUnsupportedMediaType(t *testing.T) {
+	clearTable()
+
+	req, _ := http.NewRequest("POST", "/product", bytes.NewBufferString("name=test"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusUnsupportedMediaType, response.Code)
+}
+
+func TestGetProductsAsJSONAPI(t *testing.T) {
+	clearTable()
+	addProducts(3)
+
+	req, _ := http.NewRequest("GET", "/products?start=1&count=1", nil)
+	req.Header.Set("Accept", "application/vnd.api+json")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var document struct {
+		Data []struct {
+			Type       string                 `json:"type"`
+			ID         string                 `json:"id"`
+			Attributes map[string]interface{} `json:"attributes"`
+			Links      map[string]string      `json:"links"`
+		} `json:"data"`
+		Links map[string]string `json:"links"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &document)
+
+	if len(document.Data) != 1 || document.Data[0].Type != "products" || document.Data[0].ID != "2" || document.Data[0].Attributes["name"] != "Product 1" {
+		t.Errorf("Expected product 2 as a resource object. Got %s", response.Body.String())
+	}
+	if document.Data[0].Links["self"] != "/product/2" {
+		t.Errorf("Expected a self link to /product/2. Got '%s'", document.Data[0].Links["self"])
+	}
+	if document.Links["next"] != "/products?count=1&start=2" || document.Links["prev"] != "/products?count=1&start=0" {
+		t.Errorf("Expected next and prev links. Got %v", document.Links)
+	}
+}
+
+func TestJSONAPIErrorObjects(t *testing.T) {
+	clearTable()
+
+	req, _ := http.NewRequest("GET", "/product/11", nil)
+	req.Header.Set("Accept", "application/vnd.api+json")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	var document struct {
+		Errors []map[string]string `json:"errors"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &document)
+
+	if len(document.Errors) != 1 || document.Errors[0]["status"] != "404" || document.Errors[0]["title"] != "Product not found" {
+		t.Errorf("Expected a JSON:API error object. Got %s", response.Body.String())
+	}
+}
+
+func TestGetProductAsHAL(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	req, _ := http.NewRequest("GET", "/product/1", nil)
+	req.Header.Set("Accept", "application/hal+json")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if ct := response.Header().Get("Content-Type"); ct != "application/hal+json" {
+		t.Errorf("Expected Content-Type application/hal+json. Got '%s'", ct)
+	}
+
+	var m struct {
+		Name  string                       `json:"name"`
+		Links map[string]map[string]string `json:"_links"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	if m.Name != "Product 0" || m.Links["self"]["href"] != "/product/1" || m.Links["reviews"]["href"] != "/product/1/reviews" {
+		t.Errorf("Expected product 1 with self and reviews links. Got %s", response.Body.String())
+	}
+}
+
+func TestGetProductsWithFields(t *testing.T) {
+	clearTable()
+	addProducts(2)
+
+	req, _ := http.NewRequest("GET", "/products?fields=id,name", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var products []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &products)
+
+	if len(products) != 2 || len(products[0]) != 2 || products[0]["id"] != 1.0 || products[0]["name"] != "Product 0" {
+		t.Errorf("Expected only the id and name of 2 products. Got %v", products)
+	}
+
+	req, _ = http.NewRequest("GET", "/product/1?fields=name,rating", nil)
+	response = executeRequest(req)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	if _, ok := m["price"]; ok || m["name"] != "Product 0" || m["rating"] == nil {
+		t.Errorf("Expected the id, name and rating of product 1. Got %v", m)
+	}
+}
+
+func TestGetProductsWithUnknownField(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	req, _ := http.NewRequest("GET", "/products?fields=id,secret", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	var m map[string]string
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["error"] != "Unknown field 'secret'" {
+		t.Errorf("Expected the 'error' key of the response to be set to 'Unknown field 'secret''. Got '%s'", m["error"])
+	}
+}
+
+func TestGetProductsV1(t *testing.T) {
+	clearTable()
+	addProducts(2)
+
+	req, _ := http.NewRequest("GET", "/v1/products", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if v := response.Header().Get("API-Version"); v != "1" {
+		t.Errorf("Expected API-Version 1. Got '%s'", v)
+	}
+
+	var m []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	checkLength(t, m, 2)
+}
+
+func TestGetProductsV2(t *testing.T) {
+	clearTable()
+	addProducts(2)
+
+	req, _ := http.NewRequest("GET", "/v2/products", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if v := response.Header().Get("API-Version"); v != "2" {
+		t.Errorf("Expected API-Version 2. Got '%s'", v)
+	}
+
+	var m struct {
+		Data []map[string]interface{} `json:"data"`
+		Meta map[string]interface{}   `json:"meta"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	checkLength(t, m.Data, 2)
+	checkCount(t, m.Meta["page_size"], 2)
+}
+
+func TestGetProductsWithAPIVersionHeader(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	req, _ := http.NewRequest("GET", "/products", nil)
+	req.Header.Set("API-Version", "2")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	checkLength(t, m.Data, 1)
+}
+
+func TestUnsupportedAPIVersion(t *testing.T) {
+	clearTable()
+
+	req, _ := http.NewRequest("GET", "/products", nil)
+	req.Header.Set("API-Version", "3")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	var m map[string]string
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["error"] != "Unsupported API version" {
+		t.Errorf("Expected the 'error' key of the response to be set to 'Unsupported API version'. Got '%s'", m["error"])
+	}
+}
+
+func TestGetProductsCompressed(t *testing.T) {
+	clearTable()
+	addProducts(20)
+
+	req, _ := http.NewRequest("GET", "/products", nil)
+	req.Header.Set("Accept-Encoding", "br;q=0.5, gzip")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if e := response.Header().Get("Content-Encoding"); e != "gzip" {
+		t.Fatalf("Expected Content-Encoding gzip. Got '%s'", e)
+	}
+
+	gz, err := gzip.NewReader(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(gz)
+
+	var m []map[string]interface{}
+	json.Unmarshal(body, &m)
+	checkLength(t, m, 20)
+}
+
+func TestGetProductsMsgpackCompressed(t *testing.T) {
+	clearTable()
+	addProducts(20)
+
+	req, _ := http.NewRequest("GET", "/products", nil)
+	req.Header.Set("Accept", "application/x-msgpack")
+	req.Header.Set("Accept-Encoding", "gzip")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if ct := response.Header().Get("Content-Type"); ct != "application/msgpack" {
+		t.Errorf("Expected Content-Type application/msgpack. Got '%s'", ct)
+	}
+	if e := response.Header().Get("Content-Encoding"); e != "gzip" {
+		t.Errorf("Expected Content-Encoding gzip. Got '%s'", e)
+	}
+}
+
+func TestSmallResponseUncompressed(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	req, _ := http.NewRequest("GET", "/product/1", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if e := response.Header().Get("Content-Encoding"); e != "" {
+		t.Errorf("Expected no Content-Encoding. Got '%s'", e)
+	}
+}
+
+func gzipBody(t *testing.T, data []byte) *bytes.Buffer {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+
+	return &buf
+}
+
+func TestImportCompressedProducts(t *testing.T) {
+	clearTable()
+
+	payload := []byte(`[{"name":"first","price":1.5},{"name":"second","price":2.5,"published":false}]`)
+	req, _ := http.NewRequest("POST", "/products/import", gzipBody(t, payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var m []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	checkLength(t, m, 2)
+	if len(m) == 2 && (m[0]["published"] != true || m[1]["published"] != false) {
+		t.Errorf("Expected only the first product to be published. Got %v", m)
+	}
+}
+
+func TestImportRejectsDecompressionBomb(t *testing.T) {
+	a.MaxDecompressedSize = 1024
+	defer func() { a.MaxDecompressedSize = 0 }()
+
+	payload := []byte(`[{"name":"` + strings.Repeat("a", 4096) + `"}]`)
+	req, _ := http.NewRequest("POST", "/products/import", gzipBody(t, payload))
+	req.Header.Set("Content-Encoding", "gzip")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusRequestEntityTooLarge, response.Code)
+}
+
+func TestCompressedBodyOnOtherRoute(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/product", gzipBody(t, []byte(`{"name":"test product","price":11.22}`)))
+	req.Header.Set("Content-Encoding", "gzip")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusUnsupportedMediaType, response.Code)
+}
+
+func TestCORSPreflight(t *testing.T) {
+	a.CORSOrigins = []string{"https://*.example.com"}
+	a.CORSMaxAge = 10 * time.Minute
+	defer func() { a.CORSOrigins, a.CORSMaxAge = nil, 0 }()
+
+	req, _ := http.NewRequest("OPTIONS", "/product/1", nil)
+	req.Header.Set("Origin", "https://admin.example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	req.Header.Set("Access-Control-Request-Headers", "content-type, x-admin-token, x-request-id")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusNoContent, response.Code)
+
+	if o := response.Header().Get("Access-Control-Allow-Origin"); o != "https://admin.example.com" {
+		t.Errorf("Expected the origin to be allowed. Got '%s'", o)
+	}
+	if m := response.Header().Get("Access-Control-Allow-Methods"); m != "DELETE, GET, PUT" {
+		t.Errorf("Expected the methods of the route. Got '%s'", m)
+	}
+	if h := response.Header().Get("Access-Control-Allow-Headers"); h != "content-type, x-admin-token, x-request-id" {
+		t.Errorf("Expected the requested headers to be allowed. Got '%s'", h)
+	}
+	if age := response.Header().Get("Access-Control-Max-Age"); age != "600" {
+		t.Errorf("Expected a max age of 600. Got '%s'", age)
+	}
+}
+
+func TestCORSPreflightFromUnknownOrigin(t *testing.T) {
+	a.CORSOrigins = []string{"https://*.example.com"}
+	defer func() { a.CORSOrigins = nil }()
+
+	req, _ := http.NewRequest("OPTIONS", "/products", nil)
+	req.Header.Set("Origin", "https://example.org")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	if o := response.Header().Get("Access-Control-Allow-Origin"); o != "" {
+		t.Errorf("Expected no allowed origin. Got '%s'", o)
+	}
+}
+
+func TestCORSRequest(t *testing.T) {
+	a.CORSOrigins = []string{"https://admin.example.com"}
+	a.CORSCredentials = true
+	defer func() { a.CORSOrigins, a.CORSCredentials = nil, false }()
+
+	clearTable()
+
+	req, _ := http.NewRequest("GET", "/products", nil)
+	req.Header.Set("Origin", "https://admin.example.com")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if o := response.Header().Get("Access-Control-Allow-Origin"); o != "https://admin.example.com" {
+		t.Errorf("Expected the origin to be allowed. Got '%s'", o)
+	}
+	if c := response.Header().Get("Access-Control-Allow-Credentials"); c != "true" {
+		t.Errorf("Expected credentials to be allowed. Got '%s'", c)
+	}
+	if e := response.Header().Get("Access-Control-Expose-Headers"); !strings.Contains(e, "X-Request-ID") {
+		t.Errorf("Expected X-Request-ID to be exposed. Got '%s'", e)
+	}
+}
+
+func TestCORSWildcardWithoutCredentials(t *testing.T) {
+	a.CORSOrigins = []string{"https://admin.example.com", "*"}
+	a.CORSCredentials = true
+	defer func() { a.CORSOrigins, a.CORSCredentials = nil, false }()
+
+	clearTable()
+
+	req, _ := http.NewRequest("GET", "/products", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if o := response.Header().Get("Access-Control-Allow-Origin"); o != "*" {
+		t.Errorf("Expected any origin to be allowed. Got '%s'", o)
+	}
+	if c := response.Header().Get("Access-Control-Allow-Credentials"); c != "" {
+		t.Errorf("Expected credentials not to be allowed. Got '%s'", c)
+	}
+
+	req, _ = http.NewRequest("OPTIONS", "/products", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusNoContent, response.Code)
+
+	if c := response.Header().Get("Access-Control-Allow-Credentials"); c != "" {
+		t.Errorf("Expected credentials not to be allowed in the preflight. Got '%s'", c)
+	}
+
+	req, _ = http.NewRequest("GET", "/products", nil)
+	req.Header.Set("Origin", "https://admin.example.com")
+	response = executeRequest(req)
+
+	if c := response.Header().Get("Access-Control-Allow-Credentials"); c != "true" {
+		t.Errorf("Expected credentials to be allowed for a listed origin. Got '%s'", c)
+	}
+}
+
+func TestUnknownPath(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/unknown", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	var m map[string]string
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["error"] != "Not found" {
+		t.Errorf("Expected the 'error' key of the response to be set to 'Not found'. Got '%s'", m["error"])
+	}
+	if id := response.Header().Get("X-Request-ID"); id == "" {
+		t.Errorf("Expected a request ID in X-Request-ID")
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	req, _ := http.NewRequest("PATCH", "/product/1", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusMethodNotAllowed, response.Code)
+
+	if allow := response.Header().Get("Allow"); allow != "DELETE, GET, HEAD, OPTIONS, PUT" {
+		t.Errorf("Expected the methods of the path in Allow. Got '%s'", allow)
+	}
+
+	var m map[string]string
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["error"] != "Method not allowed" {
+		t.Errorf("Expected the 'error' key of the response to be set to 'Method not allowed'. Got '%s'", m["error"])
+	}
+	if id := response.Header().Get("X-Request-ID"); id == "" {
+		t.Errorf("Expected a request ID in X-Request-ID")
+	}
+}
+
+func TestUnknownPathWithCORS(t *testing.T) {
+	a.CORSOrigins = []string{"https://shop.example.com"}
+	defer func() { a.CORSOrigins = nil }()
+
+	req, _ := http.NewRequest("GET", "/unknown", nil)
+	req.Header.Set("Origin", "https://shop.example.com")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+
+	if origin := response.Header().Get("Access-Control-Allow-Origin"); origin != "https://shop.example.com" {
+		t.Errorf("Expected the origin to be allowed. Got '%s'", origin)
+	}
+}
+
+func TestHeadProduct(t *testing.T) {
+	clearTable()
+	addProducts(1)
+
+	req, _ := http.NewRequest("HEAD", "/product/1", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if ct := response.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected the Content-Type of GET. Got '%s'", ct)
+	}
+	if response.Body.Len() != 0 {
+		t.Errorf("Expected an empty body. Got %s", response.Body.String())
+	}
+}
+
+func TestOptionsProduct(t *testing.T) {
+	req, _ := http.NewRequest("OPTIONS", "/products", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusNoContent, response.Code)
+
+	if allow := response.Header().Get("Allow"); allow != "GET, HEAD, OPTIONS" {
+		t.Errorf("Expected the methods of the path in Allow. Got '%s'", allow)
+	}
+}
+
+// testCert is a certificate generated for the TLS tests, signed by ca or
+// self-signed for the CA itself.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCert(t *testing.T, name string, serial int64, ca *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parent, signer := template, key
+	if ca == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	return &testCert{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, c.pem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+// startTLSServer serves the API over HTTPS on a unix socket in dir, with a
+// server certificate and a client CA in dir, returning the socket and the CA.
+func startTLSServer(t *testing.T, dir string) (string, *testCert) {
+	ca := newTestCert(t, "Test CA", 1, nil)
+	ca.write(t, filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	newTestCert(t, "server", 2, ca).write(t, filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+
+	a.TLSCertFile = filepath.Join(dir, "cert.pem")
+	a.TLSKeyFile = filepath.Join(dir, "key.pem")
+	a.TLSClientCAFile = filepath.Join(dir, "ca.pem")
+
+	socket := filepath.Join(dir, "api.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- a.Serve(ctx, []string{"unix://" + socket + "?tls=true"}) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+		a.TLSCertFile, a.TLSKeyFile, a.TLSClientCAFile = "", "", ""
+		a.ClientIdentities = nil
+	})
+	waitForSocket(t, socket)
+
+	return socket, ca
+}
+
+// waitForSocket waits for Serve to listen on the unix socket and returns
+// its file info.
+func waitForSocket(t *testing.T, socket string) os.FileInfo {
+	var info os.FileInfo
+	var err error
+	for i := 0; i < 100; i++ {
+		if info, err = os.Stat(socket); err == nil {
+			return info
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal(err)
+
+	return nil
+}
+
+// tlsClient returns a client of the HTTPS server on socket. Requests go to
+// https://127.0.0.1, the address in the server certificate.
+func tlsClient(socket string, ca *testCert, certs ...tls.Certificate) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: certs},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+		DisableKeepAlives: true,
+	}}
+}
+
+func TestHTTPSWithClientCertificates(t *testing.T) {
+	socket, ca := startTLSServer(t, t.TempDir())
+	a.ClientIdentities = map[string]string{"inventory": "inventory-service"}
+
+	for _, tt := range []struct {
+		name string
+		code int
+	}{
+		{"inventory", http.StatusOK},
+		{"unknown", http.StatusForbidden},
+	} {
+		client := tlsClient(socket, ca, newTestCert(t, tt.name, 3, ca).tlsCertificate())
+		response, err := client.Get("https://127.0.0.1/openapi.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		checkResponseCode(t, tt.code, response.StatusCode)
+	}
+
+	// without a client certificate
+	response, err := tlsClient(socket, ca).Get("https://127.0.0.1/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	checkResponseCode(t, http.StatusOK, response.StatusCode)
+}
+
+func TestHTTPSReloadsRotatedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	socket, ca := startTLSServer(t, dir)
+
+	serial := func() int64 {
+		response, err := tlsClient(socket, ca).Get("https://127.0.0.1/openapi.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response.TLS.PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	if s := serial(); s != 2 {
+		t.Fatalf("Expected the certificate with serial 2. Got %d", s)
+	}
+
+	newTestCert(t, "server", 4, ca).write(t, a.TLSCertFile, a.TLSKeyFile)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(a.TLSCertFile, later, later)
+	os.Chtimes(a.TLSKeyFile, later, later)
+
+	if s := serial(); s != 4 {
+		t.Errorf("Expected the rotated certificate with serial 4. Got %d", s)
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	srv := a.NewRedirectServer(":8080", ":8443")
+
+	req, _ := http.NewRequest("GET", "http://catalog.example.com:8080/products?count=1", nil)
+	response := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(response, req)
+
+	checkResponseCode(t, http.StatusPermanentRedirect, response.Code)
+
+	if l := response.Header().Get("Location"); l != "https://catalog.example.com:8443/products?count=1" {
+		t.Errorf("Expected a redirect to HTTPS. Got '%s'", l)
+	}
+}
+
+func TestServeUnixSocketWithH2C(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "api.sock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- a.Serve(ctx, []string{"unix://" + socket + "?mode=0600&h2c=true"}) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if info := waitForSocket(t, socket); info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the socket to have mode 0600. Got %v", info.Mode().Perm())
+	}
+
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{
+		Protocols: protocols,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+
+	response, err := client.Get("http://catalog/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	checkResponseCode(t, http.StatusOK, response.StatusCode)
+	if response.ProtoMajor != 2 {
+		t.Errorf("Expected HTTP/2 without TLS. Got %s", response.Proto)
+	}
+}
+
+func TestServeFinishesRequestsWhenStopped(t *testing.T) {
+	// a separate app, as the routes of a are checked against the OpenAPI
+	// document
+	var b main.App
+	b.Initialize(
+		os.Getenv("APP_DB_USERNAME"),
+		os.Getenv("APP_DB_PASSWORD"),
+		os.Getenv("APP_DB_NAME"))
+	defer b.Close()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	b.Router.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+
+	socket := filepath.Join(t.TempDir(), "api.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- b.Serve(ctx, []string{"unix://" + socket}) }()
+	waitForSocket(t, socket)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+
+	responses := make(chan string)
+	go func() {
+		response, err := client.Get("http://catalog/slow")
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		responses <- string(body)
+	}()
+
+	<-started
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if body := <-responses; body != "done" {
+		t.Errorf("Expected the request in progress to finish. Got '%s'", body)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServeUnknownListener(t *testing.T) {
+	if err := a.Serve(context.Background(), []string{"udp://:8010"}); err == nil {
+		t.Error("Expected an error for an unknown network")
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	reports := make(chan map[string]interface{}, 1)
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&report)
+		reports <- report
+	}))
+	defer sink.Close()
+
+	// a separate app, as the routes of a are checked against the OpenAPI
+	// document
+	var b main.App
+	b.Initialize(
+		os.Getenv("APP_DB_USERNAME"),
+		os.Getenv("APP_DB_PASSWORD"),
+		os.Getenv("APP_DB_NAME"))
+	defer b.Close()
+	b.ErrorSinkURL = sink.URL
+	b.Router.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+
+	panics := func() int64 {
+		if v, ok := expvar.Get("panics").(*expvar.Map).Get("/panic").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := panics()
+
+	req, _ := http.NewRequest("GET", "/panic", nil)
+	req.Header.Set("X-Request-ID", "test-request")
+	req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{newTestCert(t, "shop", 1, nil).cert}}}
+	response := httptest.NewRecorder()
+	b.Router.ServeHTTP(response, req)
+
+	checkResponseCode(t, http.StatusInternalServerError, response.Code)
+
+	if contentType := response.Header().Get("Content-Type"); contentType != "application/problem+json" {
+		t.Errorf("Expected a problem details response. Got '%s'", contentType)
+	}
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["type"] != "about:blank" || m["title"] != "Internal Server Error" || m["status"] != 500.0 || m["instance"] != "/panic" || m["request_id"] != "test-request" {
+		t.Errorf("Expected the problem details of request test-request. Got %v", m)
+	}
+	if id := response.Header().Get("X-Request-ID"); id != "test-request" {
+		t.Errorf("Expected the request ID in X-Request-ID. Got '%s'", id)
+	}
+	if after := panics(); after != before+1 {
+		t.Errorf("Expected the panic to be counted. Got %d after %d", after, before)
+	}
+
+	select {
+	case report := <-reports:
+		if report["request_id"] != "test-request" || report["client"] != "shop" || report["value"] != "boom" || report["route"] != "/panic" {
+			t.Errorf("Expected a report of the panic of client shop. Got %v", report)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the panic to be reported to the error sink")
+	}
+}
+
+func TestGRPCRecoverPanic(t *testing.T) {
+	boom := func(ctx context.Context, req interface{}) (interface{}, error) { panic("boom") }
+
+	s := a.NewGRPCServer()
+	s.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "test.Panic",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Boom",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := new(emptypb.Empty)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				return interceptor(ctx, in, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/test.Panic/Boom"}, boom)
+			},
+		}},
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "BoomStream",
+			ServerStreams: true,
+			Handler:       func(srv interface{}, stream grpc.ServerStream) error { panic("boom") },
+		}},
+	}, struct{}{})
+	conn := dialGRPCServer(t, s)
+	ctx := context.Background()
+
+	panics := func() int64 {
+		if v, ok := expvar.Get("panics").(*expvar.Map).Get("/test.Panic/Boom").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := panics()
+
+	err := conn.Invoke(ctx, "/test.Panic/Boom", &emptypb.Empty{}, &emptypb.Empty{})
+	if status.Code(err) != codes.Internal {
+		t.Errorf("Expected Internal for a panicking call. Got %v", err)
+	}
+	if after := panics(); after != before+1 {
+		t.Errorf("Expected the panic to be counted. Got %d after %d", after, before)
+	}
+
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, "/test.Panic/BoomStream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SendMsg(&emptypb.Empty{})
+	stream.CloseSend()
+	if err := stream.RecvMsg(&emptypb.Empty{}); status.Code(err) != codes.Internal {
+		t.Errorf("Expected Internal for a panicking stream. Got %v", err)
+	}
+
+	// the server survives the panics
+	if _, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Errorf("Expected the server to keep serving. Got %v", err)
+	}
+}
+
+func TestCloseWritesPendingViews(t *testing.T) {
+	clearTable()
+	addProducts(1)
+	a.DB.Exec("DELETE FROM product_views")
+
+	var b main.App
+	b.Initialize(
+		os.Getenv("APP_DB_USERNAME"),
+		os.Getenv("APP_DB_PASSWORD"),
+		os.Getenv("APP_DB_NAME"))
+
+	req, _ := http.NewRequest("GET", "/product/1", nil)
+	response := httptest.NewRecorder()
+	b.Router.ServeHTTP(response, req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	// HEAD requests are no views
+	req, _ = http.NewRequest("HEAD", "/product/1", nil)
+	response = httptest.NewRecorder()
+	b.Router.ServeHTTP(response, req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	b.Close()
+
+	var views int
+	a.DB.QueryRow("SELECT COALESCE(SUM(views), 0) FROM product_views WHERE product_id = 1").Scan(&views)
+	if views != 1 {
+		t.Errorf("Expected the view to be written on close. Got %d views", views)
+	}
+}
+
+func ensureTableExists() {
+	if _, err := a.DB.Exec(tableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func clearTable() {
+	a.DB.Exec("DELETE FROM products")
+	a.DB.Exec("ALTER SEQUENCE products_id_seq RESTART WITH 1")
+	a.DB.Exec("ALTER SEQUENCE reviews_id_seq RESTART WITH 1")
+	a.DB.Exec("DELETE FROM carts")
+	a.DB.Exec("DELETE FROM orders")
+	a.DB.Exec("ALTER SEQUENCE orders_id_seq RESTART WITH 1")
+	a.DB.Exec("DELETE FROM suppliers")
+	a.DB.Exec("ALTER SEQUENCE suppliers_id_seq RESTART WITH 1")
+	a.DB.Exec("DELETE FROM channels")
+	a.DB.Exec("ALTER SEQUENCE channels_id_seq RESTART WITH 1")
+	a.DB.Exec("DELETE FROM tenants WHERE slug <> 'default'")
+}
+
+func addProducts(count int) {
+	if count < 1 {
+		count = 1
+	}
+
+	for i := 0; i < count; i++ {
+		a.DB.Exec("INSERT INTO products(name, price) VALUES($1, $2)", "Product "+strconv.Itoa(i), (i+1.0)*10)
+	}
+}
+
+func addRelation(productID, relatedID int, relationType string) {
+	a.DB.Exec("INSERT INTO product_relations(product_id, related_id, relation_type) VALUES($1, $2, $3)", productID, relatedID, relationType)
+}
+
+func addSupplier() {
+	a.DB.Exec("INSERT INTO suppliers(name) VALUES($1)", "Supplier")
+}
+
+func addReview(productID, rating int, status string) {
+	a.DB.Exec("INSERT INTO reviews(product_id, rating, author, status) VALUES($1, $2, $3, $4)", productID, rating, "Author", status)
+}
+
+func addCart(quantities map[int]int) int {
+	var id int
+	a.DB.QueryRow("INSERT INTO carts(customer) VALUES('customer') RETURNING id").Scan(&id)
+
+	for productID, quantity := range quantities {
+		a.DB.Exec("INSERT INTO cart_items(cart_id, product_id, quantity, unit_price) SELECT $1, id, $2, price FROM products WHERE id=$3",
+			id, quantity, productID)
+	}
+
+	return id
+}
+
+func addViews(productID, views, hoursAgo int) {
+	a.DB.Exec("INSERT INTO product_views(product_id, bucket, views) VALUES($1, date_trunc('hour', now()) - make_interval(hours => $2), $3)",
+		productID, hoursAgo, views)
+}
+
+func addOrder(productIDs ...int) {
+	var id int
+	a.DB.QueryRow("INSERT INTO orders(customer, total) VALUES('customer', 0) RETURNING id").Scan(&id)
+
+	for _, productID := range productIDs {
+		a.DB.Exec("INSERT INTO order_items(order_id, product_id, name, quantity, unit_price) SELECT $1, id, name, 1, price FROM products WHERE id=$2",
+			id, productID)
+	}
+}
+
+// adminToken is the AdminToken of the tested App.
+const adminToken = "admin-secret"
+
+func addTenant(slug string, maxProducts int) {
+	a.DB.Exec("INSERT INTO tenants(slug, name, max_products) VALUES($1, $1, $2)", slug, maxProducts)
+}
+
+// tenantToken returns a bearer token for a tenant, signed with
+// a.TenantTokenSecret.
+func tenantToken(slug string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"tenant":"` + slug + `"}`))
+	mac := hmac.New(sha256.New, a.TenantTokenSecret)
+	mac.Write([]byte(header + "." + payload))
+
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
 func checkResponseCode(t *testing.T, expected int, actual int) {
 	if expected != actual {
 		t.Errorf("Expected response code %d. Got %d\n", expected, actual)
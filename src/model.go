@@ -2,22 +2,244 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"strings"
+
+	"github.com/lib/pq"
 )
 
 type product struct {
-	ID    int     `json:"id"`
-	Name  string  `json:"name"`
-	Price float64 `json:"price"`
+	ID    int     `json:"id" xml:"id"`
+	Name  string  `json:"name" xml:"name"`
+	Price float64 `json:"price" xml:"price"`
+	Stock int     `json:"stock" xml:"stock"`
+
+	Published bool   `json:"published" xml:"published"`
+	Barcode   string `json:"barcode" xml:"barcode"`
+
+	Weight        float64 `json:"weight" xml:"weight"`
+	WeightUnit    string  `json:"weight_unit" xml:"weight_unit"`
+	Length        float64 `json:"length" xml:"length"`
+	Width         float64 `json:"width" xml:"width"`
+	Height        float64 `json:"height" xml:"height"`
+	DimensionUnit string  `json:"dimension_unit" xml:"dimension_unit"`
+
+	Related []productRelation `json:"related,omitempty" xml:"-"`
+	Rating  *productRating    `json:"rating,omitempty" xml:"-"`
+
+	fields productFieldSet
+}
+
+type productRating struct {
+	Average float64 `json:"average"`
+	Count   int     `json:"count"`
+}
+
+// productRatingJoin exposes the average and count of approved reviews of
+// each product as rating.average and rating.count.
+const productRatingJoin = `LEFT JOIN LATERAL (
+	SELECT COALESCE(ROUND(AVG(reviews.rating), 2), 0) AS average, COUNT(*) AS count
+	FROM reviews WHERE reviews.product_id = products.id AND reviews.status = 'approved') rating ON true`
+
+// validate checks a product before it is stored and normalizes its units.
+func (p *product) validate() error {
+	if p.Stock < 0 {
+		return errors.New("Stock must not be negative")
+	}
+
+	return p.normalizeMeasurements()
+}
+
+// productChannelJoin exposes the settings of the channel whose ID is bound to
+// the given placeholder as channel.visible and channel.price. Products without
+// settings, and all products for channel ID 0, are visible at their own price.
+func productChannelJoin(placeholder string) string {
+	return "LEFT JOIN channel_products channel ON channel.product_id = products.id AND channel.channel_id = " + placeholder
+}
+
+// productChannelVisible is the condition selecting the products visible in
+// the channel of productChannelJoin.
+const productChannelVisible = "COALESCE(channel.visible, true)"
+
+// productField is a field of a product that can be selected with a
+// productFieldSet, named as in its JSON representation. Reading it may
+// require other fields, like the unit of a measurement.
+type productField struct {
+	name     string
+	columns  string
+	targets  func(p *product) []interface{}
+	requires string
+}
+
+// productFields lists the fields of a product in the order of the product
+// queries. Their columns require productRatingJoin and productChannelJoin.
+var productFields = []productField{
+	{name: "id", columns: "id", targets: func(p *product) []interface{} { return []interface{}{&p.ID} }},
+	{name: "name", columns: "name", targets: func(p *product) []interface{} { return []interface{}{&p.Name} }},
+	{name: "price", columns: "COALESCE(channel.price, products.price)", targets: func(p *product) []interface{} { return []interface{}{&p.Price} }},
+	{name: "stock", columns: "stock", targets: func(p *product) []interface{} { return []interface{}{&p.Stock} }},
+	{name: "published", columns: "published", targets: func(p *product) []interface{} { return []interface{}{&p.Published} }},
+	{name: "barcode", columns: "barcode", targets: func(p *product) []interface{} { return []interface{}{&p.Barcode} }},
+	{name: "weight", columns: "weight", targets: func(p *product) []interface{} { return []interface{}{&p.Weight} }, requires: "weight_unit"},
+	{name: "weight_unit", columns: "weight_unit", targets: func(p *product) []interface{} { return []interface{}{&p.WeightUnit} }},
+	{name: "length", columns: "length", targets: func(p *product) []interface{} { return []interface{}{&p.Length} }, requires: "dimension_unit"},
+	{name: "width", columns: "width", targets: func(p *product) []interface{} { return []interface{}{&p.Width} }, requires: "dimension_unit"},
+	{name: "height", columns: "height", targets: func(p *product) []interface{} { return []interface{}{&p.Height} }, requires: "dimension_unit"},
+	{name: "dimension_unit", columns: "dimension_unit", targets: func(p *product) []interface{} { return []interface{}{&p.DimensionUnit} }},
+	{name: "rating", columns: "rating.average, rating.count", targets: func(p *product) []interface{} {
+		p.Rating = &productRating{}
+		return []interface{}{&p.Rating.Average, &p.Rating.Count}
+	}},
+}
+
+// productFieldSet selects the fields of products read and returned by the
+// product queries, like the fields query parameter. The id is always
+// selected; a nil set selects all fields.
+type productFieldSet []string
+
+// parseProductFields parses a comma-separated list of field names. An empty
+// list selects all fields.
+func parseProductFields(list string) (productFieldSet, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+
+	fields := productFieldSet{"id"}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+
+		known := false
+		for _, f := range productFields {
+			known = known || f.name == name
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown field '%s'", name)
+		}
+		if !fields.has(name) {
+			fields = append(fields, name)
+		}
+	}
+
+	return fields, nil
+}
+
+func (f productFieldSet) has(name string) bool {
+	if f == nil {
+		return true
+	}
+	for _, field := range f {
+		if field == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// read returns the fields to read for the set: its own and those they
+// require, in the order of productFields.
+func (f productFieldSet) read() []productField {
+	var fields []productField
+	for _, field := range productFields {
+		required := false
+		for _, other := range productFields {
+			required = required || other.requires == field.name && f.has(other.name)
+		}
+		if f.has(field.name) || required {
+			fields = append(fields, field)
+		}
+	}
+
+	return fields
+}
+
+// columns lists the columns read for the set, in the order expected by
+// scanFields.
+func (f productFieldSet) columns() string {
+	var columns []string
+	for _, field := range f.read() {
+		columns = append(columns, field.columns)
+	}
+
+	return strings.Join(columns, ", ")
+}
+
+// productColumns lists the columns of all fields, in the order expected by
+// scanTargets.
+var productColumns = productFieldSet(nil).columns()
+
+func (p *product) scanTargets() []interface{} {
+	return p.scanFields(nil)
+}
+
+// scanFields returns the scan targets of the columns of the set and limits
+// the JSON representation of the product to its fields.
+func (p *product) scanFields(f productFieldSet) []interface{} {
+	p.fields = f
+
+	var targets []interface{}
+	for _, field := range f.read() {
+		targets = append(targets, field.targets(p)...)
+	}
+
+	return targets
+}
+
+// MarshalJSON leaves out the fields that were not selected when the product
+// was read.
+func (p product) MarshalJSON() ([]byte, error) {
+	return p.marshalWith()
+}
+
+// marshalWith returns the JSON representation of the product with extra
+// fields appended, given as name and value pairs, for types embedding it.
+func (p product) marshalWith(extra ...interface{}) ([]byte, error) {
+	// plain has the fields of product but not its methods
+	type plain product
+	if p.fields == nil && len(extra) == 0 {
+		return json.Marshal(plain(p))
+	}
+
+	value, err := toOrdered(plain(p))
+	if err != nil {
+		return nil, err
+	}
+
+	all := value.(*orderedObject)
+	object := newOrderedObject()
+	for _, key := range all.keys {
+		if p.fields.has(key) || key == "related" {
+			object.set(key, all.values[key])
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		object.set(extra[i].(string), extra[i+1])
+	}
+
+	return json.Marshal(object)
 }
 
 func (p *product) getProduct(db *sql.DB) error {
-	return db.QueryRow("SELECT name, price FROM products WHERE id=$1",
-		p.ID).Scan(&p.Name, &p.Price)
+	return p.getChannelProduct(db, 0, nil)
+}
+
+// getChannelProduct reads the given fields of the product as seen in the
+// given channel. A product hidden in the channel is not found. Like the other
+// product queries of this file, it is restricted to the tenant of the
+// connection, see App.tenantDB, on top of the row-level security policies.
+func (p *product) getChannelProduct(db *sql.DB, channelID int, fields productFieldSet) error {
+	return db.QueryRow("SELECT "+fields.columns()+" FROM products "+productRatingJoin+" "+productChannelJoin("$2")+
+		" WHERE id=$1 AND "+productChannelVisible+" AND products.tenant_id = current_tenant_id()",
+		p.ID, channelID).Scan(p.scanFields(fields)...)
 }
 
-func (p *product) getNumberOfProducts(db *sql.DB) (int, error) {
-	row := db.QueryRow("SELECT COUNT(*) FROM products")
+// getNumberOfProducts counts the products visible in the given channel, all
+// of them for channel ID 0.
+func (p *product) getNumberOfProducts(db *sql.DB, channelID int) (int, error) {
+	row := db.QueryRow("SELECT COUNT(*) FROM products "+productChannelJoin("$1")+
+		" WHERE "+productChannelVisible+" AND products.tenant_id = current_tenant_id()", channelID)
 
 	var count int
 
@@ -29,8 +251,14 @@ func (p *product) getNumberOfProducts(db *sql.DB) (int, error) {
 	return count, nil
 }
 
-func (p *product) searchProducts(db *sql.DB) ([]product, error) {
-	rows, err := db.Query("SELECT id, name, price FROM products WHERE LOWER(name) LIKE '%' || $1 || '%'", strings.ToLower(p.Name))
+// searchProducts returns the products whose name contains p.Name and which
+// are visible in the given channel, skipping start of them and returning at
+// most count, or all of them if count is 0.
+func (p *product) searchProducts(db *sql.DB, channelID int, fields productFieldSet, start, count int) ([]product, error) {
+	rows, err := db.Query("SELECT "+fields.columns()+" FROM products "+productRatingJoin+" "+productChannelJoin("$2")+
+		" WHERE LOWER(name) LIKE '%' || $1 || '%' AND "+productChannelVisible+" AND products.tenant_id = current_tenant_id()"+
+		" ORDER BY products.id LIMIT NULLIF($3, 0) OFFSET $4",
+		strings.ToLower(p.Name), channelID, count, start)
 
 	if err != nil {
 		return nil, err
@@ -41,7 +269,7 @@ func (p *product) searchProducts(db *sql.DB) ([]product, error) {
 
 	for rows.Next() {
 		var p product
-		if err := rows.Scan(&p.ID, &p.Name, &p.Price); err != nil {
+		if err := rows.Scan(p.scanFields(fields)...); err != nil {
 			return products, err
 		}
 		products = append(products, p)
@@ -56,34 +284,127 @@ func (p *product) searchProducts(db *sql.DB) ([]product, error) {
 
 func (p *product) updateProduct(db *sql.DB) error {
 	_, err :=
-		db.Exec("UPDATE products SET name=$1, price=$2 WHERE id=$3",
-			p.Name, p.Price, p.ID)
+		db.Exec("UPDATE products SET name=$1, price=$2, stock=$3, published=$4, barcode=$5, weight=$6, weight_unit=$7, length=$8, width=$9, height=$10, dimension_unit=$11 WHERE id=$12 AND tenant_id = current_tenant_id()",
+			p.Name, p.Price, p.Stock, p.Published, p.Barcode, p.Weight, p.WeightUnit, p.Length, p.Width, p.Height, p.DimensionUnit, p.ID)
 
 	return err
 }
 
 func (p *product) deleteProduct(db *sql.DB) error {
-	_, err := db.Exec("DELETE FROM products WHERE id=$1", p.ID)
+	_, err := db.Exec("DELETE FROM products WHERE id=$1 AND tenant_id = current_tenant_id()", p.ID)
 
 	return err
 }
 
-func (p *product) createProduct(db *sql.DB) error {
-	err := db.QueryRow(
-		"INSERT INTO products(name, price) VALUES($1, $2) RETURNING id",
-		p.Name, p.Price).Scan(&p.ID)
+// createProduct creates the product like createProducts, setting its ID.
+func (p *product) createProduct(db *sql.DB, tenantID int) error {
+	products := []product{*p}
+	if err := createProducts(db, tenantID, products); err != nil {
+		return err
+	}
+	p.ID = products[0].ID
 
+	return nil
+}
+
+// createProducts creates the products of the tenant in one transaction,
+// setting their IDs, or returns errProductLimit if they exceed its product
+// limit.
+func createProducts(db *sql.DB, tenantID int, products []product) error {
+	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	return nil
+	if err := checkProductLimit(tx, tenantID, len(products)); err != nil {
+		return err
+	}
+
+	for i := range products {
+		p := &products[i]
+		err := tx.QueryRow(
+			"INSERT INTO products(tenant_id, name, price, stock, published, barcode, weight, weight_unit, length, width, height, dimension_unit) VALUES(current_tenant_id(), $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id",
+			p.Name, p.Price, p.Stock, p.Published, p.Barcode, p.Weight, p.WeightUnit, p.Length, p.Width, p.Height, p.DimensionUnit).Scan(&p.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// importedProduct is a product of an import, published unless the payload
+// says otherwise like in createProduct.
+type importedProduct struct {
+	product
 }
 
-func getProducts(db *sql.DB, start, count int) ([]product, error) {
+func (p *importedProduct) UnmarshalJSON(data []byte) error {
+	p.product = product{Published: true}
+
+	return json.Unmarshal(data, &p.product)
+}
+
+// getProductsByIDs returns the products with the given IDs, in no particular
+// order. IDs of products that don't exist are skipped.
+func getProductsByIDs(db *sql.DB, ids []int) ([]product, error) {
+	rows, err := db.Query("SELECT "+productColumns+" FROM products "+productRatingJoin+" "+productChannelJoin("0")+
+		" WHERE id = ANY($1) AND products.tenant_id = current_tenant_id()", pq.Array(ids))
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	products := []product{}
+
+	for rows.Next() {
+		var p product
+		if err := rows.Scan(p.scanTargets()...); err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+
+	return products, rows.Err()
+}
+
+// productFilter selects the page of products returned by getProducts.
+type productFilter struct {
+	Start     int
+	Count     int
+	MinRating float64
+	Sort      string
+	Channel   int
+	Fields    productFieldSet
+}
+
+// productSortOrders maps the sort query parameter of /products to an ORDER BY
+// clause. Sorting by popularity requires productPopularityJoin.
+var productSortOrders = map[string]string{
+	"id":      "id",
+	"popular": "popularity.score DESC, id",
+}
+
+// getProducts returns a page of products in the order given by f.Sort, by id
+// if empty. Products whose average rating is below f.MinRating or that are
+// hidden in f.Channel are skipped. Only the fields in f.Fields are read.
+func getProducts(db *sql.DB, f productFilter) ([]product, error) {
+	joins := productRatingJoin + " " + productChannelJoin("$4")
+	if f.Sort == "popular" {
+		joins += " " + productPopularityJoin
+	}
+
+	order, ok := productSortOrders[f.Sort]
+	if !ok {
+		order = productSortOrders["id"]
+	}
+
 	rows, err := db.Query(
-		"SELECT id, name,  price FROM products LIMIT $1 OFFSET $2",
-		count, start)
+		"SELECT "+f.Fields.columns()+" FROM products "+joins+
+			" WHERE rating.average >= $3 AND "+productChannelVisible+" AND products.tenant_id = current_tenant_id() ORDER BY "+order+" LIMIT $1 OFFSET $2",
+		f.Count, f.Start, f.MinRating, f.Channel)
 
 	if err != nil {
 		return nil, err
@@ -95,7 +416,7 @@ func getProducts(db *sql.DB, start, count int) ([]product, error) {
 
 	for rows.Next() {
 		var p product
-		if err := rows.Scan(&p.ID, &p.Name, &p.Price); err != nil {
+		if err := rows.Scan(p.scanFields(f.Fields)...); err != nil {
 			return nil, err
 		}
 		products = append(products, p)
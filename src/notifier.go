@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// priceAlert is the message sent when a price watch fires.
+type priceAlert struct {
+	Watch       priceWatch `json:"watch"`
+	ProductName string     `json:"product_name"`
+	Price       float64    `json:"price"`
+}
+
+// notifier delivers price alerts through one channel. Notifiers are
+// registered in App.Notifiers under the channel name used by price watches.
+type notifier interface {
+	notify(alert priceAlert) error
+}
+
+type logNotifier struct{}
+
+func (logNotifier) notify(alert priceAlert) error {
+	log.Printf("price alert for %s: %s is now %.2f (target %.2f)",
+		alert.Watch.Customer, alert.ProductName, alert.Price, alert.Watch.TargetPrice)
+
+	return nil
+}
+
+// emailNotifier sends alerts to the watch address through an SMTP server.
+type emailNotifier struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (n emailNotifier) notify(alert priceAlert) error {
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: Price drop: %s\r\n\r\n%s is now %.2f, at or below your target of %.2f.\r\n",
+		n.from, alert.Watch.Address, alert.ProductName, alert.ProductName, alert.Price, alert.Watch.TargetPrice)
+
+	return smtp.SendMail(n.addr, n.auth, n.from, []string{alert.Watch.Address}, []byte(msg))
+}
+
+// webhookNotifier posts alerts as JSON to the watch address.
+type webhookNotifier struct {
+	client *http.Client
+}
+
+func (n webhookNotifier) notify(alert priceAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(alert.Watch.Address, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+func defaultNotifiers() map[string]notifier {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: publicDialControl}
+
+	return map[string]notifier{
+		"log": logNotifier{},
+		"webhook": webhookNotifier{client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+		}},
+	}
+}
+
+var errPrivateAddress = errors.New("address is not public")
+
+// nonPublicNetworks are the networks publicIP refuses besides those the net
+// package classifies: shared carrier-grade NAT space and "this network".
+var nonPublicNetworks = []*net.IPNet{
+	{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)},
+	{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+}
+
+// publicIP reports whether an IP address is reachable on the internet rather
+// than belonging to this host or a private network.
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	for _, network := range nonPublicNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// publicDialControl refuses connections to addresses that are not public, so
+// webhooks cannot reach internal services even if their host resolves
+// differently at delivery, or redirects elsewhere.
+func publicDialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return errPrivateAddress
+	}
+
+	return nil
+}
+
+// validateWatchAddress checks the address of a price watch for its channel:
+// email watches need a plain email address and webhook watches an https URL
+// of a public host.
+func validateWatchAddress(ctx context.Context, channel, address string) error {
+	switch channel {
+	case "email":
+		if addr, err := mail.ParseAddress(address); err != nil || addr.Address != address {
+			return errors.New("Invalid email address")
+		}
+	case "webhook":
+		u, err := url.Parse(address)
+		if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+			return errors.New("Webhook address must be an https URL")
+		}
+		ips, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+		if err != nil {
+			return errors.New("Webhook host cannot be resolved")
+		}
+		for _, ip := range ips {
+			if !publicIP(ip.IP) {
+				return errors.New("Webhook address must be public")
+			}
+		}
+	}
+
+	return nil
+}
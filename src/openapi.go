@@ -0,0 +1,493 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// apiDocsPage renders the OpenAPI document served at /openapi.json with
+// Redoc.
+//
+//go:embed openapi.html
+var apiDocsPage []byte
+
+// The types below model the subset of OpenAPI 3 used by this API.
+
+type apiDocument struct {
+	OpenAPI    string                              `json:"openapi"`
+	Info       apiInfo                             `json:"info"`
+	Paths      map[string]map[string]*apiOperation `json:"paths"`
+	Components apiComponents                       `json:"components"`
+}
+
+type apiInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type apiComponents struct {
+	Schemas map[string]*apiSchema `json:"schemas"`
+}
+
+type apiOperation struct {
+	Summary     string                 `json:"summary"`
+	Parameters  []apiParameter         `json:"parameters,omitempty"`
+	RequestBody *apiRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]apiResponse `json:"responses"`
+}
+
+// compilePatterns compiles the patterns of the schemas of the operation.
+func (op *apiOperation) compilePatterns() error {
+	for _, param := range op.Parameters {
+		if err := param.Schema.compilePatterns(); err != nil {
+			return fmt.Errorf("parameter %s: %v", param.Name, err)
+		}
+	}
+	if op.RequestBody != nil {
+		for _, media := range op.RequestBody.Content {
+			if err := media.Schema.compilePatterns(); err != nil {
+				return err
+			}
+		}
+	}
+	for _, response := range op.Responses {
+		for _, media := range response.Content {
+			if err := media.Schema.compilePatterns(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+type apiParameter struct {
+	Name     string     `json:"name"`
+	In       string     `json:"in"`
+	Required bool       `json:"required,omitempty"`
+	Schema   *apiSchema `json:"schema"`
+}
+
+type apiRequestBody struct {
+	Required bool                    `json:"required"`
+	Content  map[string]apiMediaType `json:"content"`
+}
+
+type apiResponse struct {
+	Description string                  `json:"description"`
+	Content     map[string]apiMediaType `json:"content,omitempty"`
+}
+
+type apiMediaType struct {
+	Schema *apiSchema `json:"schema"`
+}
+
+type apiSchema struct {
+	Ref        string                `json:"$ref,omitempty"`
+	Type       string                `json:"type,omitempty"`
+	Pattern    string                `json:"pattern,omitempty"`
+	Nullable   bool                  `json:"nullable,omitempty"`
+	Properties map[string]*apiSchema `json:"properties,omitempty"`
+	Required   []string              `json:"required,omitempty"`
+	Items      *apiSchema            `json:"items,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// compilePatterns compiles the patterns of the schema and of its properties
+// and items, for validate.
+func (s *apiSchema) compilePatterns() error {
+	if s == nil {
+		return nil
+	}
+	if s.Pattern != "" && s.pattern == nil {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("pattern %q: %v", s.Pattern, err)
+		}
+		s.pattern = pattern
+	}
+	for _, property := range s.Properties {
+		if err := property.compilePatterns(); err != nil {
+			return err
+		}
+	}
+
+	return s.Items.compilePatterns()
+}
+
+// apiRoute documents a route of initializeRoutes. Path parameters are taken
+// from the route itself; Query lists the optional query parameters. Errors
+// replaces the error schema for routes that report errors differently.
+// MediaType is set for routes responding in it regardless of the Accept
+// header.
+type apiRoute struct {
+	Summary   string
+	Query     []apiParameter
+	Body      *apiSchema
+	Status    int
+	Response  *apiSchema
+	Errors    *apiSchema
+	MediaType string
+}
+
+func schemaRef(name string) *apiSchema {
+	return &apiSchema{Ref: "#/components/schemas/" + name}
+}
+
+func arrayOf(items *apiSchema) *apiSchema {
+	return &apiSchema{Type: "array", Items: items}
+}
+
+func queryParam(name, typ string) apiParameter {
+	return apiParameter{Name: name, In: "query", Schema: &apiSchema{Type: typ}}
+}
+
+var (
+	anyObject    = &apiSchema{Type: "object"}
+	pageParams   = []apiParameter{queryParam("count", "integer"), queryParam("start", "integer")}
+	channelParam = queryParam("channel", "string")
+	fieldsParam  = queryParam("fields", "string")
+)
+
+var productProperties = map[string]*apiSchema{
+	"id":             {Type: "integer"},
+	"name":           {Type: "string"},
+	"price":          {Type: "number"},
+	"stock":          {Type: "integer"},
+	"published":      {Type: "boolean"},
+	"barcode":        {Type: "string"},
+	"weight":         {Type: "number"},
+	"weight_unit":    {Type: "string"},
+	"length":         {Type: "number"},
+	"width":          {Type: "number"},
+	"height":         {Type: "number"},
+	"dimension_unit": {Type: "string"},
+	"related":        arrayOf(anyObject),
+	"rating": {
+		Type: "object",
+		Properties: map[string]*apiSchema{
+			"average": {Type: "number"},
+			"count":   {Type: "integer"},
+		},
+	},
+}
+
+// apiSchemas are the shared schemas of the document.
+var apiSchemas = map[string]*apiSchema{
+	"product": {
+		Type: "object",
+		// other fields may be left out with the fields parameter
+		Required:   []string{"id"},
+		Properties: productProperties,
+	},
+	// the payload of create and update, which may leave out any field
+	"productInput": {
+		Type:       "object",
+		Properties: productProperties,
+	},
+	"error": {
+		Type:     "object",
+		Required: []string{"error"},
+		Properties: map[string]*apiSchema{
+			"error":   {Type: "string"},
+			"details": arrayOf(&apiSchema{Type: "string"}),
+		},
+	},
+	"graphqlResponse": {
+		Type: "object",
+		Properties: map[string]*apiSchema{
+			"data": anyObject,
+			"errors": arrayOf(&apiSchema{
+				Type:     "object",
+				Required: []string{"message"},
+				Properties: map[string]*apiSchema{
+					"message": {Type: "string"},
+					// field names and list indices
+					"path": arrayOf(&apiSchema{}),
+				},
+			}),
+		},
+	},
+	"result": {
+		Type:       "object",
+		Required:   []string{"result"},
+		Properties: map[string]*apiSchema{"result": {Type: "string"}},
+	},
+	"listMeta": {
+		Type:       "object",
+		Required:   []string{"page_size"},
+		Properties: map[string]*apiSchema{"page_size": {Type: "integer"}},
+	},
+}
+
+// apiRoutes documents every route, keyed by apiRouteKey of its path without
+// the version prefix. A test checks that it matches the router.
+var apiRoutes = map[string]apiRoute{
+	"GET /products": {Summary: "List products",
+		Query:    append([]apiParameter{queryParam("min_rating", "number"), queryParam("sort", "string"), channelParam, fieldsParam}, pageParams...),
+		Response: arrayOf(schemaRef("product"))},
+	"POST /product": {Summary: "Create a product", Body: schemaRef("productInput"), Status: http.StatusCreated, Response: schemaRef("product")},
+	"GET /product/{id}": {Summary: "Get a product",
+		Query:    []apiParameter{queryParam("weight_unit", "string"), queryParam("dimension_unit", "string"), queryParam("include", "string"), channelParam, fieldsParam},
+		Response: schemaRef("product")},
+	"GET /product/search":                                {Summary: "Search products by name", Query: []apiParameter{channelParam, fieldsParam}, Response: &apiSchema{Type: "array", Items: schemaRef("product"), Nullable: true}},
+	"GET /product/meta/count":                            {Summary: "Count products", Query: []apiParameter{channelParam}, Response: &apiSchema{Type: "integer"}},
+	"PUT /product/{id}":                                  {Summary: "Update a product", Body: schemaRef("productInput"), Response: schemaRef("product")},
+	"DELETE /product/{id}":                               {Summary: "Delete a product", Response: schemaRef("result")},
+	"GET /product/{id}/relations":                        {Summary: "List the relations of a product", Query: []apiParameter{queryParam("type", "string")}, Response: arrayOf(anyObject)},
+	"POST /product/{id}/relations":                       {Summary: "Relate a product to another", Body: anyObject, Status: http.StatusCreated, Response: anyObject},
+	"PUT /product/{id}/relations/{type}":                 {Summary: "Reorder the relations of a type", Body: arrayOf(&apiSchema{Type: "integer"}), Response: arrayOf(anyObject)},
+	"DELETE /product/{id}/relations/{type}/{related_id}": {Summary: "Delete a relation", Response: schemaRef("result")},
+	"GET /product/{id}/bundle":                           {Summary: "Get the components and price of a bundle", Response: anyObject},
+	"GET /product/{id}/recommendations":                  {Summary: "List products bought together with a product", Query: []apiParameter{queryParam("count", "integer"), channelParam, fieldsParam}, Response: arrayOf(schemaRef("product"))},
+	"GET /product/{id}/suppliers":                        {Summary: "List the suppliers of a product", Response: arrayOf(anyObject)},
+	"GET /products/trending":                             {Summary: "List the most viewed products", Query: []apiParameter{queryParam("count", "integer"), channelParam, fieldsParam}, Response: arrayOf(schemaRef("product"))},
+	"GET /products/duplicates":                           {Summary: "List clusters of likely duplicate products", Response: arrayOf(anyObject)},
+	"POST /products/merge":                               {Summary: "Merge duplicate products", Body: anyObject, Response: schemaRef("product")},
+	"POST /products/import":                              {Summary: "Create a list of products", Body: arrayOf(schemaRef("productInput")), Status: http.StatusCreated, Response: arrayOf(schemaRef("product"))},
+	"GET /products/margins":                              {Summary: "Report the margin of each product", Response: arrayOf(anyObject)},
+	"GET /product/{id}/reviews":                          {Summary: "List the reviews of a product", Query: append([]apiParameter{queryParam("status", "string"), queryParam("sort", "string")}, pageParams...), Response: arrayOf(anyObject)},
+	"POST /product/{id}/reviews":                         {Summary: "Review a product", Body: anyObject, Status: http.StatusCreated, Response: anyObject},
+	"PUT /review/{id}/status":                            {Summary: "Moderate a review", Body: anyObject, Response: anyObject},
+	"DELETE /review/{id}":                                {Summary: "Delete a review", Response: schemaRef("result")},
+	"POST /cart":                                         {Summary: "Create a cart", Body: anyObject, Status: http.StatusCreated, Response: anyObject},
+	"GET /cart/{id}":                                     {Summary: "Get a cart", Response: anyObject},
+	"PUT /cart/{id}/items/{product_id}":                  {Summary: "Set the quantity of a cart item", Body: anyObject, Response: anyObject},
+	"DELETE /cart/{id}/items/{product_id}":               {Summary: "Remove an item from a cart", Response: schemaRef("result")},
+	"POST /cart/{id}/order":                              {Summary: "Place an order for a cart", Status: http.StatusCreated, Response: anyObject},
+	"GET /orders":                                        {Summary: "List orders", Query: append([]apiParameter{queryParam("customer", "string"), queryParam("status", "string")}, pageParams...), Response: arrayOf(anyObject)},
+	"GET /order/{id}":                                    {Summary: "Get an order", Response: anyObject},
+	"PUT /order/{id}/status":                             {Summary: "Change the status of an order", Body: anyObject, Response: anyObject},
+	"POST /shipping/estimate":                            {Summary: "Estimate shipping costs", Body: anyObject, Response: arrayOf(anyObject)},
+	"GET /wishlist/{customer}":                           {Summary: "Get the wishlist of a customer", Response: arrayOf(anyObject)},
+	"PUT /wishlist/{customer}/{product_id}":              {Summary: "Add a product to a wishlist", Response: schemaRef("result")},
+	"DELETE /wishlist/{customer}/{product_id}":           {Summary: "Remove a product from a wishlist", Response: schemaRef("result")},
+	"GET /price-watches":                                 {Summary: "List price watches", Query: []apiParameter{queryParam("customer", "string")}, Response: arrayOf(anyObject)},
+	"POST /price-watch":                                  {Summary: "Watch the price of a product", Body: anyObject, Status: http.StatusCreated, Response: anyObject},
+	"DELETE /price-watch/{id}":                           {Summary: "Delete a price watch", Response: schemaRef("result")},
+	"POST /jobs/{name}":                                  {Summary: "Run a background job", Response: schemaRef("result")},
+	"GET /tenant":                                        {Summary: "Get the tenant of the request", Response: anyObject},
+	"GET /tenants":                                       {Summary: "List tenants", Response: arrayOf(anyObject)},
+	"POST /tenant":                                       {Summary: "Create a tenant", Body: anyObject, Status: http.StatusCreated, Response: anyObject},
+	"PUT /tenant/{id}":                                   {Summary: "Update a tenant", Body: anyObject, Response: anyObject},
+	"GET /channels":                                      {Summary: "List sales channels", Response: arrayOf(anyObject)},
+	"POST /channel":                                      {Summary: "Create a sales channel", Body: anyObject, Status: http.StatusCreated, Response: anyObject},
+	"DELETE /channel/{id}":                               {Summary: "Delete a sales channel", Response: schemaRef("result")},
+	"GET /channel/{id}/products":                         {Summary: "List the product settings of a channel", Response: arrayOf(anyObject)},
+	"PUT /channel/{id}/products/{product_id}":            {Summary: "Set the visibility and price of a product in a channel", Body: anyObject, Response: anyObject},
+	"DELETE /channel/{id}/products/{product_id}":         {Summary: "Reset a product to its defaults in a channel", Response: schemaRef("result")},
+	"GET /suppliers":                                     {Summary: "List suppliers", Response: arrayOf(anyObject)},
+	"POST /supplier":                                     {Summary: "Create a supplier", Body: anyObject, Status: http.StatusCreated, Response: anyObject},
+	"GET /supplier/{id}":                                 {Summary: "Get a supplier", Response: anyObject},
+	"PUT /supplier/{id}":                                 {Summary: "Update a supplier", Body: anyObject, Response: anyObject},
+	"DELETE /supplier/{id}":                              {Summary: "Delete a supplier", Response: schemaRef("result")},
+	"GET /supplier/{id}/products":                        {Summary: "List the products of a supplier", Response: arrayOf(anyObject)},
+	"POST /supplier/{id}/products":                       {Summary: "Link a product to a supplier", Body: anyObject, Response: anyObject},
+	"DELETE /supplier/{id}/products/{product_id}":        {Summary: "Unlink a product from a supplier", Response: schemaRef("result")},
+	"GET /graphql": {Summary: "Run a GraphQL query",
+		Query:    []apiParameter{queryParam("query", "string"), queryParam("operationName", "string"), queryParam("variables", "string")},
+		Response: schemaRef("graphqlResponse"), Errors: schemaRef("graphqlResponse"), MediaType: "application/json"},
+	"POST /graphql":     {Summary: "Run a GraphQL operation", Body: anyObject, Response: schemaRef("graphqlResponse"), Errors: schemaRef("graphqlResponse"), MediaType: "application/json"},
+	"GET /openapi.json": {Summary: "Get this document", Response: anyObject, MediaType: "application/json"},
+	"GET /docs":         {Summary: "Browse this document", MediaType: "text/html"},
+}
+
+// documentedRoute returns the documentation of the route matched by the
+// request.
+func documentedRoute(r *http.Request) (apiRoute, bool) {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return apiRoute{}, false
+	}
+
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return apiRoute{}, false
+	}
+	_, unversioned := splitAPIVersion(template)
+	key, _ := apiPath(unversioned)
+
+	documented, ok := apiRoutes[apiRouteKey(r.Method, key)]
+
+	return documented, ok
+}
+
+// apiPath converts a mux path template to an OpenAPI path, returning the path
+// parameters. Parameters restricted to digits are integers.
+func apiPath(template string) (string, []apiParameter) {
+	var params []apiParameter
+	segments := strings.Split(template, "/")
+
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") {
+			continue
+		}
+
+		name, pattern := segment[1:len(segment)-1], ""
+		if j := strings.Index(name, ":"); j >= 0 {
+			name, pattern = name[:j], name[j+1:]
+		}
+
+		schema := &apiSchema{Type: "string"}
+		if pattern == "[0-9]+" {
+			schema.Type = "integer"
+		} else if pattern != "" {
+			schema.Pattern = "^" + pattern + "$"
+		}
+
+		params = append(params, apiParameter{Name: name, In: "path", Required: true, Schema: schema})
+		segments[i] = "{" + name + "}"
+	}
+
+	return strings.Join(segments, "/"), params
+}
+
+func apiRouteKey(method, path string) string {
+	return method + " " + path
+}
+
+// buildAPIDocument generates the OpenAPI document from the routes of the
+// router and their documentation in apiRoutes. Undocumented routes are left
+// out, while documentation without a route, like that of a renamed route, is
+// an error. The patterns of the schemas are compiled, and invalid ones are an
+// error too.
+func buildAPIDocument(router *mux.Router) (*apiDocument, error) {
+	doc := &apiDocument{
+		OpenAPI:    "3.0.3",
+		Info:       apiInfo{Title: "Product catalog", Version: "1.0"},
+		Paths:      map[string]map[string]*apiOperation{},
+		Components: apiComponents{Schemas: apiSchemas},
+	}
+
+	routed := map[string]bool{}
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		// the routes selected by the API-Version header repeat unversioned
+		// paths, which document version 1
+		version, unversioned := splitAPIVersion(template)
+		if version == 0 && strings.Contains(route.GetName(), "/") {
+			return nil
+		}
+
+		path, params := apiPath(template)
+		key, _ := apiPath(unversioned)
+
+		// required query parameters are matchers of the route
+		queries, _ := route.GetQueriesTemplates()
+		for _, q := range queries {
+			name := strings.SplitN(q, "=", 2)[0]
+			params = append(params, apiParameter{Name: name, In: "query", Required: true, Schema: &apiSchema{Type: "string"}})
+		}
+
+		for _, method := range methods {
+			documented, ok := apiRoutes[apiRouteKey(method, key)]
+			if !ok {
+				continue
+			}
+			routed[apiRouteKey(method, key)] = true
+
+			op := documented.operation(params, version)
+			if err := op.compilePatterns(); err != nil {
+				return fmt.Errorf("%s %s: %v", method, path, err)
+			}
+			if _, ok := doc.Paths[path]; !ok {
+				doc.Paths[path] = map[string]*apiOperation{}
+			}
+			doc.Paths[path][strings.ToLower(method)] = op
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var unrouted []string
+	for key := range apiRoutes {
+		if !routed[key] {
+			unrouted = append(unrouted, key)
+		}
+	}
+	if len(unrouted) > 0 {
+		sort.Strings(unrouted)
+		return nil, fmt.Errorf("documented routes without a route: %s", strings.Join(unrouted, ", "))
+	}
+
+	for name, schema := range apiSchemas {
+		if err := schema.compilePatterns(); err != nil {
+			return nil, fmt.Errorf("schema %s: %v", name, err)
+		}
+	}
+
+	return doc, nil
+}
+
+// operation documents the route in a version, 0 for unversioned paths.
+// Lists are wrapped in an apiList from version 2 on.
+func (r apiRoute) operation(params []apiParameter, version int) *apiOperation {
+	errors := r.Errors
+	if errors == nil {
+		errors = schemaRef("error")
+	}
+
+	op := &apiOperation{
+		Summary:    r.Summary,
+		Parameters: append(append([]apiParameter{}, params...), r.Query...),
+		Responses: map[string]apiResponse{
+			"default": {Description: "Error", Content: map[string]apiMediaType{"application/json": {Schema: errors}}},
+		},
+	}
+
+	if r.Body != nil {
+		op.RequestBody = &apiRequestBody{Required: true, Content: map[string]apiMediaType{"application/json": {Schema: r.Body}}}
+	}
+
+	status := r.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	response := apiResponse{Description: http.StatusText(status)}
+	if r.Response != nil {
+		schema := r.Response
+		if version >= 2 && schema.Type == "array" {
+			schema = &apiSchema{
+				Type:     "object",
+				Required: []string{"data", "meta"},
+				Properties: map[string]*apiSchema{
+					"data": arrayOf(schema.Items),
+					"meta": schemaRef("listMeta"),
+				},
+			}
+		}
+		response.Content = map[string]apiMediaType{"application/json": {Schema: schema}}
+	}
+	op.Responses[strconv.Itoa(status)] = response
+
+	return op
+}
+
+func (a *App) getOpenAPI(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, a.apiDoc)
+}
+
+func (a *App) getAPIDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(apiDocsPage)
+}
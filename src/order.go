@@ -0,0 +1,553 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	orderPending   = "pending"
+	orderPaid      = "paid"
+	orderShipped   = "shipped"
+	orderDelivered = "delivered"
+	orderCancelled = "cancelled"
+)
+
+// orderTransitions lists the statuses an order may move to from each status.
+var orderTransitions = map[string][]string{
+	orderPending:   {orderPaid, orderCancelled},
+	orderPaid:      {orderShipped, orderCancelled},
+	orderShipped:   {orderDelivered},
+	orderDelivered: {},
+	orderCancelled: {},
+}
+
+type cart struct {
+	ID        int        `json:"id"`
+	Customer  string     `json:"customer"`
+	Items     []cartItem `json:"items"`
+	Total     float64    `json:"total"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// cartItem holds the price of the product at the time it was added to the
+// cart, which is checked against the current price when the order is placed.
+type cartItem struct {
+	ProductID int     `json:"product_id"`
+	Name      string  `json:"name"`
+	Quantity  int     `json:"quantity"`
+	UnitPrice float64 `json:"unit_price"`
+}
+
+type order struct {
+	ID        int         `json:"id"`
+	Customer  string      `json:"customer"`
+	Status    string      `json:"status"`
+	Items     []orderItem `json:"items,omitempty"`
+	Total     float64     `json:"total"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// orderItem is a snapshot of the product name and price at order time.
+type orderItem struct {
+	ProductID int     `json:"product_id"`
+	Name      string  `json:"name"`
+	Quantity  int     `json:"quantity"`
+	UnitPrice float64 `json:"unit_price"`
+}
+
+// orderConflictError is returned when a cart cannot be ordered because a
+// price changed or a product is out of stock.
+type orderConflictError struct {
+	message string
+}
+
+func (e *orderConflictError) Error() string {
+	return e.message
+}
+
+func (c *cart) createCart(db *sql.DB) error {
+	return db.QueryRow("INSERT INTO carts(customer) VALUES($1) RETURNING id, created_at",
+		c.Customer).Scan(&c.ID, &c.CreatedAt)
+}
+
+func (c *cart) getCart(db *sql.DB) error {
+	err := db.QueryRow("SELECT customer, created_at FROM carts WHERE id=$1",
+		c.ID).Scan(&c.Customer, &c.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query(
+		`SELECT i.product_id, p.name, i.quantity, i.unit_price
+		FROM cart_items i JOIN products p ON p.id = i.product_id
+		WHERE i.cart_id=$1 ORDER BY i.product_id`, c.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	c.Items = []cartItem{}
+	c.Total = 0
+
+	for rows.Next() {
+		var item cartItem
+		if err := rows.Scan(&item.ProductID, &item.Name, &item.Quantity, &item.UnitPrice); err != nil {
+			return err
+		}
+		c.Items = append(c.Items, item)
+		c.Total += item.UnitPrice * float64(item.Quantity)
+	}
+	c.Total = round2(c.Total)
+
+	return rows.Err()
+}
+
+// setCartItem sets the quantity of a product in the cart, snapshotting its
+// current price. A quantity of zero removes the product.
+func (c *cart) setCartItem(db *sql.DB, productID, quantity int) error {
+	if quantity == 0 {
+		_, err := db.Exec("DELETE FROM cart_items WHERE cart_id=$1 AND product_id=$2", c.ID, productID)
+		return err
+	}
+
+	_, err := db.Exec(
+		`INSERT INTO cart_items(cart_id, product_id, quantity, unit_price)
+		SELECT $1, id, $3, price FROM products WHERE id=$2
+		ON CONFLICT (cart_id, product_id) DO UPDATE SET quantity=EXCLUDED.quantity, unit_price=EXCLUDED.unit_price`,
+		c.ID, productID, quantity)
+
+	return err
+}
+
+// placeOrder turns the cart into an order in a single transaction. The cart
+// is locked first so that concurrent orders of it are serialized; the one
+// that waited finds the cart deleted. The ordered products are locked, their
+// current prices compared with the cart and their stock decremented; the
+// cart is deleted afterwards.
+func (c *cart) placeOrder(db *sql.DB) (order, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return order{}, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("SELECT customer FROM carts WHERE id=$1 FOR UPDATE", c.ID).Scan(&c.Customer)
+	if err == sql.ErrNoRows {
+		return order{}, &orderConflictError{"Cart has already been ordered"}
+	}
+	if err != nil {
+		return order{}, err
+	}
+
+	o := order{Customer: c.Customer, Status: orderPending}
+
+	rows, err := tx.Query(
+		`SELECT i.product_id, p.name, i.quantity, i.unit_price, p.price, p.stock
+		FROM cart_items i JOIN products p ON p.id = i.product_id
+		WHERE i.cart_id=$1 ORDER BY i.product_id
+		FOR UPDATE OF p`, c.ID)
+	if err != nil {
+		return order{}, err
+	}
+
+	for rows.Next() {
+		var item orderItem
+		var price float64
+		var stock int
+		if err := rows.Scan(&item.ProductID, &item.Name, &item.Quantity, &item.UnitPrice, &price, &stock); err != nil {
+			rows.Close()
+			return order{}, err
+		}
+
+		if price != item.UnitPrice {
+			rows.Close()
+			return order{}, &orderConflictError{fmt.Sprintf("Price of product %d changed from %.2f to %.2f", item.ProductID, item.UnitPrice, price)}
+		}
+		if stock < item.Quantity {
+			rows.Close()
+			return order{}, &orderConflictError{fmt.Sprintf("Insufficient stock for product %d", item.ProductID)}
+		}
+
+		o.Items = append(o.Items, item)
+		o.Total += item.UnitPrice * float64(item.Quantity)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return order{}, err
+	}
+
+	if len(o.Items) == 0 {
+		return order{}, &orderConflictError{"Cart is empty"}
+	}
+	o.Total = round2(o.Total)
+
+	err = tx.QueryRow("INSERT INTO orders(customer, status, total) VALUES($1, $2, $3) RETURNING id, created_at, updated_at",
+		o.Customer, o.Status, o.Total).Scan(&o.ID, &o.CreatedAt, &o.UpdatedAt)
+	if err != nil {
+		return order{}, err
+	}
+
+	for _, item := range o.Items {
+		if _, err := tx.Exec("INSERT INTO order_items(order_id, product_id, name, quantity, unit_price) VALUES($1, $2, $3, $4, $5)",
+			o.ID, item.ProductID, item.Name, item.Quantity, item.UnitPrice); err != nil {
+			return order{}, err
+		}
+		if _, err := tx.Exec("UPDATE products SET stock = stock - $1 WHERE id=$2", item.Quantity, item.ProductID); err != nil {
+			return order{}, err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM carts WHERE id=$1", c.ID); err != nil {
+		return order{}, err
+	}
+
+	return o, tx.Commit()
+}
+
+func (o *order) getOrder(db *sql.DB) error {
+	err := db.QueryRow("SELECT customer, status, total, created_at, updated_at FROM orders WHERE id=$1",
+		o.ID).Scan(&o.Customer, &o.Status, &o.Total, &o.CreatedAt, &o.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query("SELECT COALESCE(product_id, 0), name, quantity, unit_price FROM order_items WHERE order_id=$1 ORDER BY product_id", o.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	o.Items = []orderItem{}
+
+	for rows.Next() {
+		var item orderItem
+		if err := rows.Scan(&item.ProductID, &item.Name, &item.Quantity, &item.UnitPrice); err != nil {
+			return err
+		}
+		o.Items = append(o.Items, item)
+	}
+
+	return rows.Err()
+}
+
+// updateOrderStatus moves the order to the given status if the lifecycle
+// allows it. Cancelling an order returns its items to stock.
+func (o *order) updateOrderStatus(db *sql.DB, status string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current string
+	if err := tx.QueryRow("SELECT status FROM orders WHERE id=$1 FOR UPDATE", o.ID).Scan(&current); err != nil {
+		return err
+	}
+
+	allowed := false
+	for _, next := range orderTransitions[current] {
+		if next == status {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return &orderConflictError{fmt.Sprintf("Cannot change order status from %s to %s", current, status)}
+	}
+
+	if _, err := tx.Exec("UPDATE orders SET status=$1, updated_at=now() WHERE id=$2", status, o.ID); err != nil {
+		return err
+	}
+
+	if status == orderCancelled {
+		if _, err := tx.Exec(
+			`UPDATE products p SET stock = p.stock + i.quantity
+			FROM order_items i WHERE i.order_id=$1 AND i.product_id = p.id`, o.ID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// getOrders returns a page of orders, newest first. Empty customer or status
+// arguments do not filter.
+func getOrders(db *sql.DB, customer, status string, start, count int) ([]order, error) {
+	rows, err := db.Query(
+		`SELECT id, customer, status, total, created_at, updated_at FROM orders
+		WHERE ($1 = '' OR customer=$1) AND ($2 = '' OR status=$2)
+		ORDER BY created_at DESC, id DESC LIMIT $3 OFFSET $4`,
+		customer, status, count, start)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []order{}
+
+	for rows.Next() {
+		var o order
+		if err := rows.Scan(&o.ID, &o.Customer, &o.Status, &o.Total, &o.CreatedAt, &o.UpdatedAt); err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+
+	return orders, rows.Err()
+}
+
+func (a *App) createCart(w http.ResponseWriter, r *http.Request) {
+	var c cart
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&c); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if len(c.Customer) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Customer is required")
+		return
+	}
+
+	if err := c.createCart(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.Items = []cartItem{}
+
+	respond(w, http.StatusCreated, c)
+}
+
+func (a *App) getCart(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid cart ID")
+		return
+	}
+
+	c := cart{ID: id}
+	if err := c.getCart(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Cart not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respond(w, http.StatusOK, c)
+}
+
+func (a *App) setCartItem(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid cart ID")
+		return
+	}
+	productID, err := strconv.Atoi(vars["product_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	var item cartItem
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&item); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if item.Quantity < 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid quantity")
+		return
+	}
+
+	c := cart{ID: id}
+	if err := c.getCart(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Cart not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	p := product{ID: productID}
+	if err := p.getProduct(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Product not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	if err := c.setCartItem(a.db(r), productID, item.Quantity); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := c.getCart(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, c)
+}
+
+func (a *App) deleteCartItem(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid cart ID")
+		return
+	}
+	productID, err := strconv.Atoi(vars["product_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	c := cart{ID: id}
+	if err := c.setCartItem(a.db(r), productID, 0); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *App) placeOrder(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid cart ID")
+		return
+	}
+
+	c := cart{ID: id}
+	if err := c.getCart(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Cart not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	o, err := c.placeOrder(a.db(r))
+	if err != nil {
+		switch err.(type) {
+		case *orderConflictError:
+			respondWithError(w, http.StatusConflict, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respond(w, http.StatusCreated, o)
+}
+
+func (a *App) getOrder(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	o := order{ID: id}
+	if err := o.getOrder(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Order not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respond(w, http.StatusOK, o)
+}
+
+func (a *App) getOrders(w http.ResponseWriter, r *http.Request) {
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	start, _ := strconv.Atoi(r.FormValue("start"))
+
+	count = tenantFromRequest(r).pageSize(count)
+	if start < 0 {
+		start = 0
+	}
+
+	status := r.FormValue("status")
+	if _, ok := orderTransitions[status]; status != "" && !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid order status")
+		return
+	}
+
+	orders, err := getOrders(a.db(r), r.FormValue("customer"), status, start, count)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, orders)
+}
+
+func (a *App) updateOrderStatus(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid order ID")
+		return
+	}
+
+	var o order
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&o); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if _, ok := orderTransitions[o.Status]; !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid order status")
+		return
+	}
+
+	status := o.Status
+	o = order{ID: id}
+	if err := o.updateOrderStatus(a.db(r), status); err != nil {
+		if _, ok := err.(*orderConflictError); ok {
+			respondWithError(w, http.StatusConflict, err.Error())
+			return
+		}
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Order not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	if err := o.getOrder(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, o)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// popularityHalfLife is the age at which a product view counts half as much
+// towards the popularity score.
+const popularityHalfLife = 24 * time.Hour
+
+// productPopularityJoin exposes the time-decayed view count of each product
+// as popularity.score.
+var productPopularityJoin = `LEFT JOIN LATERAL (
+	SELECT COALESCE(SUM(product_views.views * power(0.5, EXTRACT(EPOCH FROM now() - product_views.bucket) / ` +
+	strconv.Itoa(int(popularityHalfLife.Seconds())) + `)), 0) AS score
+	FROM product_views WHERE product_views.product_id = products.id) popularity ON true`
+
+type trendingProduct struct {
+	product
+	Views int `json:"views"`
+}
+
+func (p trendingProduct) MarshalJSON() ([]byte, error) {
+	return p.product.marshalWith("views", p.Views)
+}
+
+// viewTracker counts product views in memory and writes them to the
+// product_views table in one statement per flush interval, bucketed by hour.
+type viewTracker struct {
+	db       *sql.DB
+	interval time.Duration
+
+	mu     sync.Mutex
+	counts map[int]int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newViewTracker(db *sql.DB, interval time.Duration) *viewTracker {
+	t := &viewTracker{
+		db:       db,
+		interval: interval,
+		counts:   map[int]int{},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+
+	return t
+}
+
+func (t *viewTracker) record(productID int) {
+	t.mu.Lock()
+	t.counts[productID]++
+	t.mu.Unlock()
+}
+
+func (t *viewTracker) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.flush()
+		case <-t.stop:
+			t.flush()
+			return
+		}
+	}
+}
+
+// close stops the tracker after writing the pending views.
+func (t *viewTracker) close() {
+	close(t.stop)
+	<-t.done
+}
+
+// flush writes the pending views. On failure they are kept for the next
+// flush.
+func (t *viewTracker) flush() {
+	t.mu.Lock()
+	counts := t.counts
+	t.counts = map[int]int{}
+	t.mu.Unlock()
+
+	if len(counts) == 0 {
+		return
+	}
+
+	ids := make([]int64, 0, len(counts))
+	views := make([]int64, 0, len(counts))
+	for id, n := range counts {
+		ids = append(ids, int64(id))
+		views = append(views, int64(n))
+	}
+
+	// views of products deleted in the meantime are dropped by the join
+	_, err := t.db.Exec(
+		`INSERT INTO product_views(tenant_id, product_id, bucket, views)
+		SELECT p.tenant_id, v.id, date_trunc('hour', now()), v.views
+		FROM unnest($1::int[], $2::int[]) AS v(id, views) JOIN products p ON p.id = v.id
+		ON CONFLICT (product_id, bucket) DO UPDATE SET views = product_views.views + EXCLUDED.views`,
+		pq.Array(ids), pq.Array(views))
+
+	if err != nil {
+		log.Printf("flushing product views: %v", err)
+
+		t.mu.Lock()
+		for id, n := range counts {
+			t.counts[id] += n
+		}
+		t.mu.Unlock()
+	}
+}
+
+// getTrendingProducts returns the products visible in the channel that were
+// most viewed since the given time, with the given fields.
+func getTrendingProducts(db *sql.DB, channelID int, since time.Time, count int, fields productFieldSet) ([]trendingProduct, error) {
+	rows, err := db.Query(
+		`SELECT `+fields.columns()+`, trending.views FROM products `+productRatingJoin+` `+productChannelJoin("$3")+`
+		JOIN (SELECT product_id, SUM(views) AS views FROM product_views WHERE bucket >= date_trunc('hour', $1::timestamptz)
+		GROUP BY product_id) trending ON trending.product_id = products.id
+		WHERE `+productChannelVisible+`
+		ORDER BY trending.views DESC, id LIMIT $2`,
+		since, count, channelID)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	products := []trendingProduct{}
+
+	for rows.Next() {
+		var p trendingProduct
+		if err := rows.Scan(append(p.scanFields(fields), &p.Views)...); err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+
+	return products, rows.Err()
+}
+
+func (a *App) getTrendingProducts(w http.ResponseWriter, r *http.Request) {
+	count, _ := strconv.Atoi(r.FormValue("count"))
+
+	count = tenantFromRequest(r).pageSize(count)
+
+	fields, err := parseProductFields(r.FormValue("fields"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	channelID, err := a.requestChannel(r)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Channel not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	products, err := getTrendingProducts(a.db(r), channelID, time.Now().Add(-24*time.Hour), count, fields)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, products)
+}
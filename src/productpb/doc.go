@@ -0,0 +1,5 @@
+// Package productpb contains the protobuf messages and gRPC stubs of the
+// product service.
+package productpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative product.proto
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+)
+
+// The product mutations below are shared by the REST, GraphQL and gRPC
+// APIs, so that a product changes the same way through each of them: it is
+// validated, the product limit of the tenant is checked, price watches are
+// evaluated and the change is published as a productEvent.
+
+// invalidProductError is returned by the product mutations for a product
+// failing validation.
+type invalidProductError struct {
+	message string
+}
+
+func (e *invalidProductError) Error() string {
+	return e.message
+}
+
+// addProduct creates the product for the tenant. It is read back
+// afterwards, for the values set by the database.
+func (a *App) addProduct(db *sql.DB, t tenant, p *product) error {
+	if err := p.validate(); err != nil {
+		return &invalidProductError{err.Error()}
+	}
+	if err := p.createProduct(db, t.ID); err != nil {
+		return err
+	}
+	if err := p.getProduct(db); err != nil {
+		return err
+	}
+
+	a.events.publish(productEvent{Type: productCreated, TenantID: t.ID, Product: *p})
+
+	return nil
+}
+
+// saveProduct replaces the product with the ID of p, returning
+// sql.ErrNoRows if there is none. It is read back afterwards.
+func (a *App) saveProduct(db *sql.DB, t tenant, p *product) error {
+	if err := p.validate(); err != nil {
+		return &invalidProductError{err.Error()}
+	}
+	if err := (&product{ID: p.ID}).getProduct(db); err != nil {
+		return err
+	}
+	if err := p.updateProduct(db); err != nil {
+		return err
+	}
+
+	if err := a.evaluatePriceWatches(db, *p); err != nil {
+		log.Printf("evaluating price watches of product %d: %v", p.ID, err)
+	}
+
+	if err := p.getProduct(db); err != nil {
+		return err
+	}
+
+	a.events.publish(productEvent{Type: productUpdated, TenantID: t.ID, Product: *p})
+
+	return nil
+}
+
+// removeProduct deletes the product, returning sql.ErrNoRows if there is
+// none.
+func (a *App) removeProduct(db *sql.DB, t tenant, id int) error {
+	p := product{ID: id}
+	if err := p.getProduct(db); err != nil {
+		return err
+	}
+	if err := p.deleteProduct(db); err != nil {
+		return err
+	}
+
+	a.events.publish(productEvent{Type: productDeleted, TenantID: t.ID, Product: product{ID: id}})
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type recommendation struct {
+	product
+	Score float64 `json:"score"`
+}
+
+func (r recommendation) MarshalJSON() ([]byte, error) {
+	return r.product.marshalWith("score", r.Score)
+}
+
+// computeCooccurrences rebuilds the product_cooccurrences table from the
+// orders of all tenants. Two products co-occur when they are part of the
+// same order; their similarity is the cosine of their order vectors, i.e.
+// the number of orders containing both divided by the geometric mean of the
+// orders containing each.
+func computeCooccurrences(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM product_cooccurrences"); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`WITH items AS (
+			SELECT DISTINCT tenant_id, order_id, product_id FROM order_items WHERE product_id IS NOT NULL
+		), totals AS (
+			SELECT product_id, COUNT(*) AS orders FROM items GROUP BY product_id
+		), pairs AS (
+			SELECT a.tenant_id, a.product_id, b.product_id AS other_id, COUNT(*) AS together
+			FROM items a JOIN items b ON a.order_id = b.order_id AND a.product_id <> b.product_id
+			GROUP BY a.tenant_id, a.product_id, b.product_id
+		)
+		INSERT INTO product_cooccurrences(tenant_id, product_id, other_id, count, score)
+		SELECT pairs.tenant_id, pairs.product_id, pairs.other_id, pairs.together, pairs.together / sqrt(ta.orders * tb.orders)
+		FROM pairs
+		JOIN totals ta ON ta.product_id = pairs.product_id
+		JOIN totals tb ON tb.product_id = pairs.other_id`)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// getRecommendations returns the products most similar to the given one,
+// leaving out unpublished products and those hidden in the channel. Only the
+// given fields of the products are read.
+func getRecommendations(db *sql.DB, productID, channelID, count int, fields productFieldSet) ([]recommendation, error) {
+	rows, err := db.Query(
+		`SELECT `+fields.columns()+`, c.score FROM product_cooccurrences c
+		JOIN products ON products.id = c.other_id `+productRatingJoin+` `+productChannelJoin("$3")+`
+		WHERE c.product_id=$1 AND products.published AND `+productChannelVisible+`
+		ORDER BY c.score DESC, c.count DESC, products.id LIMIT $2`,
+		productID, count, channelID)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recommendations := []recommendation{}
+
+	for rows.Next() {
+		var rec recommendation
+		if err := rows.Scan(append(rec.scanFields(fields), &rec.Score)...); err != nil {
+			return nil, err
+		}
+		recommendations = append(recommendations, rec)
+	}
+
+	return recommendations, rows.Err()
+}
+
+func (a *App) getRecommendations(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	count, _ := strconv.Atoi(r.FormValue("count"))
+
+	count = tenantFromRequest(r).pageSize(count)
+
+	fields, err := parseProductFields(r.FormValue("fields"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	channelID, err := a.requestChannel(r)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Channel not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	p := product{ID: id}
+	if err := p.getChannelProduct(a.db(r), channelID, productFieldSet{"id"}); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Product not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	recommendations, err := getRecommendations(a.db(r), id, channelID, count, fields)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, recommendations)
+}
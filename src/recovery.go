@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// panics counts the recovered panics by route template.
+var panics = expvar.NewMap("panics")
+
+type requestIDKey struct{}
+
+// assignRequestID is a middleware identifying every request by the
+// X-Request-ID header of the caller, or by a random ID without one. The ID
+// is sent back in the same header.
+func (a *App) assignRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// newRequestID returns a random request ID.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+
+	return id
+}
+
+// panicReport describes a panic recovered while serving a request.
+type panicReport struct {
+	RequestID string    `json:"request_id"`
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Route     string    `json:"route"`
+	Client    string    `json:"client,omitempty"`
+	Value     string    `json:"value"`
+	Stack     string    `json:"stack"`
+}
+
+// errorSink receives the reports of recovered panics, e.g. an error tracking
+// service.
+type errorSink interface {
+	report(p panicReport) error
+}
+
+// webhookErrorSink posts reports as JSON to a URL.
+type webhookErrorSink struct {
+	client *http.Client
+	url    string
+}
+
+var errorSinkClient = &http.Client{Timeout: 10 * time.Second}
+
+// errorSink returns the sink of ErrorSinkURL, or nil without one.
+func (a *App) errorSink() errorSink {
+	if a.ErrorSinkURL == "" {
+		return nil
+	}
+
+	return webhookErrorSink{client: errorSinkClient, url: a.ErrorSinkURL}
+}
+
+func (s webhookErrorSink) report(p panicReport) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("error sink responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// recoveredResponse tracks whether a response was started, after which a
+// panic can no longer be answered with an error.
+type recoveredResponse struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *recoveredResponse) WriteHeader(code int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recoveredResponse) Write(b []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recoveredResponse) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.started = true
+		f.Flush()
+	}
+}
+
+// problem is an RFC 9457 problem details object, with the request ID as an
+// extension member.
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func respondWithProblem(w http.ResponseWriter, p problem) {
+	body, _ := json.Marshal(p)
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	w.Write(body)
+}
+
+// reportPanic logs a recovered panic with its stack, counts it in the
+// panics metric by route and reports it to the ErrorSinkURL.
+func (a *App) reportPanic(report panicReport) {
+	log.Printf("request %s: panic serving %s %s: %s\n%s", report.RequestID, report.Method, report.Path, report.Value, report.Stack)
+	panics.Add(report.Route, 1)
+
+	if sink := a.errorSink(); sink != nil {
+		go func() {
+			if err := sink.report(report); err != nil {
+				log.Printf("request %s: reporting panic: %v", report.RequestID, err)
+			}
+		}()
+	}
+}
+
+// recoverPanics is a middleware answering requests whose handler panicked
+// with a 500 instead of dropping the connection. The panic is logged with
+// its stack, counted in the panics metric and reported to the ErrorSinkURL.
+// It runs after identifyClient, so reports name the client.
+func (a *App) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &recoveredResponse{ResponseWriter: w}
+
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// the server aborts the response without logging it
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			report := panicReport{
+				RequestID: requestID(r),
+				Time:      time.Now(),
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Client:    clientIdentity(r),
+				Value:     fmt.Sprint(v),
+				Stack:     string(debug.Stack()),
+			}
+			if route := mux.CurrentRoute(r); route != nil {
+				report.Route, _ = route.GetPathTemplate()
+			}
+
+			a.reportPanic(report)
+
+			if rw.started {
+				// the client sees an incomplete response
+				panic(http.ErrAbortHandler)
+			}
+			respondWithProblem(w, problem{
+				Type:      "about:blank",
+				Title:     http.StatusText(http.StatusInternalServerError),
+				Status:    http.StatusInternalServerError,
+				Detail:    "The server failed to handle the request.",
+				Instance:  r.URL.Path,
+				RequestID: report.RequestID,
+			})
+		}()
+
+		next.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	relationAccessory       = "accessory"
+	relationReplacementPart = "replacement_part"
+	relationBundleComponent = "bundle_component"
+)
+
+var relationTypes = map[string]bool{
+	relationAccessory:       true,
+	relationReplacementPart: true,
+	relationBundleComponent: true,
+}
+
+type productRelation struct {
+	ProductID int     `json:"product_id"`
+	RelatedID int     `json:"related_id"`
+	Type      string  `json:"type"`
+	Position  int     `json:"position"`
+	Quantity  int     `json:"quantity"`
+	Name      string  `json:"name,omitempty"`
+	Price     float64 `json:"price,omitempty"`
+}
+
+type bundle struct {
+	ProductID  int               `json:"product_id"`
+	Components []productRelation `json:"components"`
+	Price      float64           `json:"price"`
+}
+
+// uniqueViolation is the SQLSTATE of an insert conflicting with a primary
+// key or unique constraint.
+const uniqueViolation = "23505"
+
+var errRelationExists = errors.New("Relation already exists")
+
+// createRelation adds the relation, returning errRelationExists if the
+// products are already related by its type.
+func (rel *productRelation) createRelation(db *sql.DB) error {
+	_, err := db.Exec(
+		"INSERT INTO product_relations(product_id, related_id, relation_type, position, quantity) VALUES($1, $2, $3, $4, $5)",
+		rel.ProductID, rel.RelatedID, rel.Type, rel.Position, rel.Quantity)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == uniqueViolation {
+		return errRelationExists
+	}
+
+	return err
+}
+
+func (rel *productRelation) deleteRelation(db *sql.DB) (bool, error) {
+	res, err := db.Exec(
+		"DELETE FROM product_relations WHERE product_id=$1 AND related_id=$2 AND relation_type=$3",
+		rel.ProductID, rel.RelatedID, rel.Type)
+
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+
+	return affected > 0, err
+}
+
+// getRelations returns the relations of a product joined with the related
+// product's name and price, ordered by type and position. An empty
+// relationType returns relations of every type.
+func getRelations(db *sql.DB, productID int, relationType string) ([]productRelation, error) {
+	rows, err := db.Query(
+		`SELECT r.product_id, r.related_id, r.relation_type, r.position, r.quantity, p.name, p.price
+		FROM product_relations r JOIN products p ON p.id = r.related_id
+		WHERE r.product_id=$1 AND ($2 = '' OR r.relation_type=$2)
+		ORDER BY r.relation_type, r.position, r.related_id`,
+		productID, relationType)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	relations := []productRelation{}
+
+	for rows.Next() {
+		var rel productRelation
+		if err := rows.Scan(&rel.ProductID, &rel.RelatedID, &rel.Type, &rel.Position, &rel.Quantity, &rel.Name, &rel.Price); err != nil {
+			return nil, err
+		}
+		relations = append(relations, rel)
+	}
+
+	return relations, rows.Err()
+}
+
+// getRelationsOfProducts returns the relations of all the given products in
+// one query, ordered like getRelations within each product.
+func getRelationsOfProducts(db *sql.DB, productIDs []int, relationType string) ([]productRelation, error) {
+	rows, err := db.Query(
+		`SELECT r.product_id, r.related_id, r.relation_type, r.position, r.quantity, p.name, p.price
+		FROM product_relations r JOIN products p ON p.id = r.related_id
+		WHERE r.product_id = ANY($1) AND ($2 = '' OR r.relation_type=$2)
+		ORDER BY r.product_id, r.relation_type, r.position, r.related_id`,
+		pq.Array(productIDs), relationType)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	relations := []productRelation{}
+
+	for rows.Next() {
+		var rel productRelation
+		if err := rows.Scan(&rel.ProductID, &rel.RelatedID, &rel.Type, &rel.Position, &rel.Quantity, &rel.Name, &rel.Price); err != nil {
+			return nil, err
+		}
+		relations = append(relations, rel)
+	}
+
+	return relations, rows.Err()
+}
+
+// reorderRelations sets the position of each related product to its index
+// in relatedIDs, in a single transaction.
+func reorderRelations(db *sql.DB, productID int, relationType string, relatedIDs []int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, relatedID := range relatedIDs {
+		res, err := tx.Exec(
+			"UPDATE product_relations SET position=$1 WHERE product_id=$2 AND related_id=$3 AND relation_type=$4",
+			i, productID, relatedID, relationType)
+		if err != nil {
+			return err
+		}
+		if affected, _ := res.RowsAffected(); affected == 0 {
+			return sql.ErrNoRows
+		}
+	}
+
+	return tx.Commit()
+}
+
+func getBundle(db *sql.DB, productID int) (bundle, error) {
+	components, err := getRelations(db, productID, relationBundleComponent)
+	if err != nil {
+		return bundle{}, err
+	}
+
+	b := bundle{ProductID: productID, Components: components}
+	for _, c := range components {
+		b.Price += c.Price * float64(c.Quantity)
+	}
+
+	return b, nil
+}
+
+func (a *App) getRelations(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	relationType := r.FormValue("type")
+	if relationType != "" && !relationTypes[relationType] {
+		respondWithError(w, http.StatusBadRequest, "Invalid relation type")
+		return
+	}
+
+	relations, err := getRelations(a.db(r), id, relationType)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, relations)
+}
+
+func (a *App) createRelation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	var rel productRelation
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&rel); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	rel.ProductID = id
+	if rel.Quantity == 0 {
+		rel.Quantity = 1
+	}
+
+	if !relationTypes[rel.Type] {
+		respondWithError(w, http.StatusBadRequest, "Invalid relation type")
+		return
+	}
+	if rel.RelatedID == rel.ProductID {
+		respondWithError(w, http.StatusBadRequest, "A product cannot be related to itself")
+		return
+	}
+	if rel.Quantity < 1 || rel.Position < 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid quantity or position")
+		return
+	}
+
+	for _, pid := range []int{rel.ProductID, rel.RelatedID} {
+		p := product{ID: pid}
+		if err := p.getProduct(a.db(r)); err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				respondWithError(w, http.StatusNotFound, "Product not found")
+			default:
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+	}
+
+	if err := rel.createRelation(a.db(r)); err != nil {
+		switch err {
+		case errRelationExists:
+			respondWithError(w, http.StatusConflict, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respond(w, http.StatusCreated, rel)
+}
+
+func (a *App) reorderRelations(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	relationType := vars["type"]
+	if !relationTypes[relationType] {
+		respondWithError(w, http.StatusBadRequest, "Invalid relation type")
+		return
+	}
+
+	var relatedIDs []int
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&relatedIDs); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := reorderRelations(a.db(r), id, relationType, relatedIDs); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Relation not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	relations, err := getRelations(a.db(r), id, relationType)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, relations)
+}
+
+func (a *App) deleteRelation(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+	relatedID, err := strconv.Atoi(vars["related_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid related product ID")
+		return
+	}
+
+	rel := productRelation{ProductID: id, RelatedID: relatedID, Type: vars["type"]}
+	deleted, err := rel.deleteRelation(a.db(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !deleted {
+		respondWithError(w, http.StatusNotFound, "Relation not found")
+		return
+	}
+
+	respond(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *App) getBundle(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	b, err := getBundle(a.db(r), id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(b.Components) == 0 {
+		respondWithError(w, http.StatusNotFound, "Product is not a bundle")
+		return
+	}
+
+	respond(w, http.StatusOK, b)
+}
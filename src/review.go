@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	minReviewRating = 1
+	maxReviewRating = 5
+
+	reviewPending  = "pending"
+	reviewApproved = "approved"
+	reviewRejected = "rejected"
+)
+
+var reviewStatuses = map[string]bool{
+	reviewPending:  true,
+	reviewApproved: true,
+	reviewRejected: true,
+}
+
+// reviewSortOrders maps the sort query parameter to an ORDER BY clause.
+var reviewSortOrders = map[string]string{
+	"newest":  "created_at DESC, id DESC",
+	"oldest":  "created_at, id",
+	"highest": "rating DESC, created_at DESC, id DESC",
+	"lowest":  "rating, created_at DESC, id DESC",
+}
+
+type review struct {
+	ID        int       `json:"id"`
+	ProductID int       `json:"product_id"`
+	Rating    int       `json:"rating"`
+	Text      string    `json:"text"`
+	Author    string    `json:"author"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (rv *review) getReview(db *sql.DB) error {
+	return db.QueryRow("SELECT product_id, rating, text, author, status, created_at FROM reviews WHERE id=$1",
+		rv.ID).Scan(&rv.ProductID, &rv.Rating, &rv.Text, &rv.Author, &rv.Status, &rv.CreatedAt)
+}
+
+func (rv *review) createReview(db *sql.DB) error {
+	return db.QueryRow(
+		"INSERT INTO reviews(product_id, rating, text, author, status) VALUES($1, $2, $3, $4, $5) RETURNING id, created_at",
+		rv.ProductID, rv.Rating, rv.Text, rv.Author, rv.Status).Scan(&rv.ID, &rv.CreatedAt)
+}
+
+func (rv *review) updateReviewStatus(db *sql.DB) error {
+	res, err := db.Exec("UPDATE reviews SET status=$1 WHERE id=$2", rv.Status, rv.ID)
+	if err != nil {
+		return err
+	}
+
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (rv *review) deleteReview(db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM reviews WHERE id=$1", rv.ID)
+
+	return err
+}
+
+// getReviews returns a page of a product's reviews with the given status.
+// sort must be a key of reviewSortOrders.
+func getReviews(db *sql.DB, productID int, status, sort string, start, count int) ([]review, error) {
+	rows, err := db.Query(
+		"SELECT id, product_id, rating, text, author, status, created_at FROM reviews WHERE product_id=$1 AND status=$2 ORDER BY "+
+			reviewSortOrders[sort]+" LIMIT $3 OFFSET $4",
+		productID, status, count, start)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reviews := []review{}
+
+	for rows.Next() {
+		var rv review
+		if err := rows.Scan(&rv.ID, &rv.ProductID, &rv.Rating, &rv.Text, &rv.Author, &rv.Status, &rv.CreatedAt); err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, rv)
+	}
+
+	return reviews, rows.Err()
+}
+
+func (a *App) getReviews(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	count, _ := strconv.Atoi(r.FormValue("count"))
+	start, _ := strconv.Atoi(r.FormValue("start"))
+
+	count = tenantFromRequest(r).pageSize(count)
+	if start < 0 {
+		start = 0
+	}
+
+	status := r.FormValue("status")
+	if status == "" {
+		status = reviewApproved
+	}
+	if !reviewStatuses[status] {
+		respondWithError(w, http.StatusBadRequest, "Invalid review status")
+		return
+	}
+	// reviews awaiting or failing moderation are only shown to moderators
+	if status != reviewApproved && !a.isAdmin(r) {
+		respondWithError(w, http.StatusForbidden, "Admin credentials required")
+		return
+	}
+
+	sort := r.FormValue("sort")
+	if sort == "" {
+		sort = "newest"
+	}
+	if _, ok := reviewSortOrders[sort]; !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid sort order")
+		return
+	}
+
+	reviews, err := getReviews(a.db(r), id, status, sort, start, count)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, reviews)
+}
+
+func (a *App) createReview(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	var rv review
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&rv); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	// new reviews always await moderation
+	rv.ProductID = id
+	rv.Status = reviewPending
+
+	if rv.Rating < minReviewRating || rv.Rating > maxReviewRating {
+		respondWithError(w, http.StatusBadRequest, "Rating must be between 1 and 5")
+		return
+	}
+	if len(rv.Author) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Review author is required")
+		return
+	}
+
+	p := product{ID: id}
+	if err := p.getProduct(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Product not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	if err := rv.createReview(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusCreated, rv)
+}
+
+func (a *App) moderateReview(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid review ID")
+		return
+	}
+
+	var rv review
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&rv); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	rv.ID = id
+
+	if !reviewStatuses[rv.Status] {
+		respondWithError(w, http.StatusBadRequest, "Invalid review status")
+		return
+	}
+
+	if err := rv.updateReviewStatus(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Review not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	if err := rv.getReview(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, rv)
+}
+
+func (a *App) deleteReview(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid review ID")
+		return
+	}
+
+	rv := review{ID: id}
+	if err := rv.deleteReview(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, map[string]string{"result": "success"})
+}
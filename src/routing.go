@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// routeMethods returns the methods of the routes matching the path of a
+// request.
+func (a *App) routeMethods(r *http.Request) []string {
+	methods := map[string]bool{}
+	a.Router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		routeMethods, _ := route.GetMethods()
+		for _, m := range routeMethods {
+			methods[m] = true
+		}
+		return nil
+	})
+
+	var matching []string
+	for method := range methods {
+		req := r.Clone(r.Context())
+		req.Method = method
+		var match mux.RouteMatch
+		if a.Router.Match(req, &match) && match.MatchErr == nil {
+			matching = append(matching, method)
+		}
+	}
+	sort.Strings(matching)
+
+	return matching
+}
+
+// allowedMethods returns the methods of the Allow header of a path: the
+// methods of its routes, HEAD for GET routes and OPTIONS.
+func (a *App) allowedMethods(r *http.Request) []string {
+	methods := a.routeMethods(r)
+	for _, m := range methods {
+		if m == http.MethodGet {
+			methods = append(methods, http.MethodHead)
+			break
+		}
+	}
+	methods = append(methods, http.MethodOptions)
+	sort.Strings(methods)
+
+	return methods
+}
+
+// withFallbackMiddleware wraps the handlers of requests without a route in
+// the middlewares of a.Router which apply to them too.
+func (a *App) withFallbackMiddleware(h http.HandlerFunc) http.Handler {
+	return a.assignRequestID(a.identifyClient(a.recoverPanics(a.cors(h))))
+}
+
+func (a *App) notFound(w http.ResponseWriter, r *http.Request) {
+	respondWithError(w, http.StatusNotFound, "Not found")
+}
+
+type headRequestKey struct{}
+
+// isHeadRequest reports whether a GET request is a HEAD request served by the
+// GET route, see methodNotAllowed.
+func isHeadRequest(r *http.Request) bool {
+	head, _ := r.Context().Value(headRequestKey{}).(bool)
+
+	return head
+}
+
+// methodNotAllowed handles requests whose path has routes for other methods
+// only. HEAD requests are served by the GET route without the body, going
+// through the middlewares of the route.
+func (a *App) methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodHead && containsFold(a.routeMethods(r), http.MethodGet) {
+		get := r.Clone(context.WithValue(r.Context(), headRequestKey{}, true))
+		get.Method = http.MethodGet
+		a.Router.ServeHTTP(headResponse{w}, get)
+		return
+	}
+
+	a.withFallbackMiddleware(a.refuseMethod).ServeHTTP(w, r)
+}
+
+// refuseMethod answers OPTIONS requests with the Allow header, after cors had
+// its say, and other requests with 405.
+func (a *App) refuseMethod(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Allow", strings.Join(a.allowedMethods(r), ", "))
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+}
+
+// headResponse drops the body of the response to a HEAD request.
+type headResponse struct {
+	http.ResponseWriter
+}
+
+func (h headResponse) Write(b []byte) (int, error) {
+	return len(b), nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+)
+
+const (
+	defaultWeightUnit    = "kg"
+	defaultDimensionUnit = "cm"
+)
+
+// weightUnits maps each supported weight unit to its value in kilograms.
+var weightUnits = map[string]float64{
+	"g":  0.001,
+	"kg": 1,
+	"oz": 0.028349523125,
+	"lb": 0.45359237,
+}
+
+// dimensionUnits maps each supported length unit to its value in
+// centimetres.
+var dimensionUnits = map[string]float64{
+	"mm": 0.1,
+	"cm": 1,
+	"m":  100,
+	"in": 2.54,
+}
+
+// weightBand is the cost of a shipment whose chargeable weight is at most
+// UpToKg.
+type weightBand struct {
+	UpToKg float64 `json:"up_to_kg"`
+	Cost   float64 `json:"cost"`
+}
+
+// carrier is a shipping rate table. The chargeable weight of a shipment is
+// the larger of its actual and volumetric weight, where the volumetric weight
+// is its volume in cm³ divided by VolumetricDivisor. Shipments heavier than
+// the last band cost that band plus PerExtraKg for every started kilogram
+// above it; a PerExtraKg of zero means the carrier does not take them.
+type carrier struct {
+	Name              string       `json:"name"`
+	VolumetricDivisor float64      `json:"volumetric_divisor"`
+	Bands             []weightBand `json:"bands"`
+	PerExtraKg        float64      `json:"per_extra_kg"`
+}
+
+type shippingItem struct {
+	ProductID int `json:"product_id"`
+	Quantity  int `json:"quantity"`
+}
+
+type shippingQuote struct {
+	Carrier            string  `json:"carrier"`
+	ActualWeightKg     float64 `json:"actual_weight_kg"`
+	VolumetricWeightKg float64 `json:"volumetric_weight_kg"`
+	ChargeableWeightKg float64 `json:"chargeable_weight_kg"`
+	Cost               float64 `json:"cost"`
+}
+
+var defaultCarriers = []carrier{
+	{
+		Name:              "standard",
+		VolumetricDivisor: 5000,
+		Bands: []weightBand{
+			{UpToKg: 1, Cost: 4.90},
+			{UpToKg: 5, Cost: 8.90},
+			{UpToKg: 10, Cost: 12.90},
+			{UpToKg: 31.5, Cost: 19.90},
+		},
+	},
+	{
+		Name:              "express",
+		VolumetricDivisor: 4000,
+		Bands: []weightBand{
+			{UpToKg: 1, Cost: 9.90},
+			{UpToKg: 5, Cost: 14.90},
+			{UpToKg: 10, Cost: 21.90},
+		},
+		PerExtraKg: 1.50,
+	},
+}
+
+var errUnknownUnit = errors.New("unknown unit")
+
+func convertWeight(value float64, from, to string) (float64, error) {
+	fromKg, ok := weightUnits[from]
+	toKg, ok2 := weightUnits[to]
+	if !ok || !ok2 {
+		return 0, errUnknownUnit
+	}
+
+	return value * fromKg / toKg, nil
+}
+
+func convertDimension(value float64, from, to string) (float64, error) {
+	fromCm, ok := dimensionUnits[from]
+	toCm, ok2 := dimensionUnits[to]
+	if !ok || !ok2 {
+		return 0, errUnknownUnit
+	}
+
+	return value * fromCm / toCm, nil
+}
+
+// normalizeMeasurements fills in the default units and rejects unknown units
+// and negative measurements.
+func (p *product) normalizeMeasurements() error {
+	if p.WeightUnit == "" {
+		p.WeightUnit = defaultWeightUnit
+	}
+	if p.DimensionUnit == "" {
+		p.DimensionUnit = defaultDimensionUnit
+	}
+
+	if _, ok := weightUnits[p.WeightUnit]; !ok {
+		return fmt.Errorf("Unknown weight unit '%s'", p.WeightUnit)
+	}
+	if _, ok := dimensionUnits[p.DimensionUnit]; !ok {
+		return fmt.Errorf("Unknown dimension unit '%s'", p.DimensionUnit)
+	}
+	if p.Weight < 0 || p.Length < 0 || p.Width < 0 || p.Height < 0 {
+		return errors.New("Weight and dimensions must not be negative")
+	}
+
+	return nil
+}
+
+// convertMeasurements expresses the product's weight and dimensions in the
+// given units. An empty unit leaves the corresponding values unchanged, as do
+// measurements whose unit was not read, see productFieldSet.
+func (p *product) convertMeasurements(weightUnit, dimensionUnit string) error {
+	if weightUnit != "" && p.WeightUnit != "" {
+		w, err := convertWeight(p.Weight, p.WeightUnit, weightUnit)
+		if err != nil {
+			return err
+		}
+		p.Weight, p.WeightUnit = w, weightUnit
+	}
+
+	if dimensionUnit != "" && p.DimensionUnit != "" {
+		for _, d := range []*float64{&p.Length, &p.Width, &p.Height} {
+			v, err := convertDimension(*d, p.DimensionUnit, dimensionUnit)
+			if err != nil {
+				return err
+			}
+			*d = v
+		}
+		p.DimensionUnit = dimensionUnit
+	}
+
+	return nil
+}
+
+// quote returns the cost of shipping a parcel with the given actual weight
+// and volume. ok is false if the parcel exceeds the carrier's limits.
+func (c carrier) quote(weightKg, volumeCm3 float64) (q shippingQuote, ok bool) {
+	q = shippingQuote{Carrier: c.Name, ActualWeightKg: round2(weightKg)}
+
+	chargeable := weightKg
+	if c.VolumetricDivisor > 0 {
+		q.VolumetricWeightKg = round2(volumeCm3 / c.VolumetricDivisor)
+		chargeable = math.Max(chargeable, volumeCm3/c.VolumetricDivisor)
+	}
+	q.ChargeableWeightKg = round2(chargeable)
+
+	if len(c.Bands) == 0 {
+		return q, false
+	}
+
+	for _, b := range c.Bands {
+		if chargeable <= b.UpToKg {
+			q.Cost = b.Cost
+			return q, true
+		}
+	}
+
+	if c.PerExtraKg <= 0 {
+		return q, false
+	}
+
+	last := c.Bands[len(c.Bands)-1]
+	q.Cost = round2(last.Cost + math.Ceil(chargeable-last.UpToKg)*c.PerExtraKg)
+
+	return q, true
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// loadCarriers reads carrier rate tables from a JSON file.
+func loadCarriers(path string) ([]carrier, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var carriers []carrier
+	if err := json.Unmarshal(data, &carriers); err != nil {
+		return nil, err
+	}
+
+	for _, c := range carriers {
+		sort.Slice(c.Bands, func(i, j int) bool { return c.Bands[i].UpToKg < c.Bands[j].UpToKg })
+	}
+
+	return carriers, nil
+}
+
+func (a *App) estimateShipping(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Items   []shippingItem `json:"items"`
+		Carrier string         `json:"carrier"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&request); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if len(request.Items) == 0 {
+		respondWithError(w, http.StatusBadRequest, "At least one item is required")
+		return
+	}
+
+	var weightKg, volumeCm3 float64
+	for _, item := range request.Items {
+		if item.Quantity == 0 {
+			item.Quantity = 1
+		}
+		if item.Quantity < 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid quantity")
+			return
+		}
+
+		p := product{ID: item.ProductID}
+		if err := p.getProduct(a.db(r)); err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				respondWithError(w, http.StatusNotFound, fmt.Sprintf("Product %d not found", item.ProductID))
+			default:
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+		if err := p.convertMeasurements("kg", "cm"); err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		weightKg += p.Weight * float64(item.Quantity)
+		volumeCm3 += p.Length * p.Width * p.Height * float64(item.Quantity)
+	}
+
+	quotes := []shippingQuote{}
+	for _, c := range a.Carriers {
+		if request.Carrier != "" && request.Carrier != c.Name {
+			continue
+		}
+		if q, ok := c.quote(weightKg, volumeCm3); ok {
+			quotes = append(quotes, q)
+		}
+	}
+
+	if len(quotes) == 0 {
+		respondWithError(w, http.StatusUnprocessableEntity, "No carrier can ship these items")
+		return
+	}
+
+	sort.Slice(quotes, func(i, j int) bool { return quotes[i].Cost < quotes[j].Cost })
+
+	respond(w, http.StatusOK, quotes)
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+type supplier struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	ContactName string `json:"contact_name"`
+	Email       string `json:"email"`
+	Phone       string `json:"phone"`
+}
+
+type supplierProduct struct {
+	SupplierID   int     `json:"supplier_id"`
+	ProductID    int     `json:"product_id"`
+	SupplierSKU  string  `json:"supplier_sku"`
+	CostPrice    float64 `json:"cost_price"`
+	LeadTimeDays int     `json:"lead_time_days"`
+}
+
+// productMargin is a row of the margin report. Cost and Margin are nil for
+// products without a supplier; otherwise Cost is the cheapest cost price.
+type productMargin struct {
+	ID     int      `json:"id"`
+	Name   string   `json:"name"`
+	Price  float64  `json:"price"`
+	Cost   *float64 `json:"cost"`
+	Margin *float64 `json:"margin"`
+}
+
+func (s *supplier) getSupplier(db *sql.DB) error {
+	return db.QueryRow("SELECT name, contact_name, email, phone FROM suppliers WHERE id=$1",
+		s.ID).Scan(&s.Name, &s.ContactName, &s.Email, &s.Phone)
+}
+
+func (s *supplier) createSupplier(db *sql.DB) error {
+	return db.QueryRow(
+		"INSERT INTO suppliers(name, contact_name, email, phone) VALUES($1, $2, $3, $4) RETURNING id",
+		s.Name, s.ContactName, s.Email, s.Phone).Scan(&s.ID)
+}
+
+func (s *supplier) updateSupplier(db *sql.DB) error {
+	res, err :=
+		db.Exec("UPDATE suppliers SET name=$1, contact_name=$2, email=$3, phone=$4 WHERE id=$5",
+			s.Name, s.ContactName, s.Email, s.Phone, s.ID)
+	if err != nil {
+		return err
+	}
+
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (s *supplier) deleteSupplier(db *sql.DB) error {
+	res, err := db.Exec("DELETE FROM suppliers WHERE id=$1", s.ID)
+	if err != nil {
+		return err
+	}
+
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func getSuppliers(db *sql.DB) ([]supplier, error) {
+	rows, err := db.Query("SELECT id, name, contact_name, email, phone FROM suppliers ORDER BY id")
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	suppliers := []supplier{}
+
+	for rows.Next() {
+		var s supplier
+		if err := rows.Scan(&s.ID, &s.Name, &s.ContactName, &s.Email, &s.Phone); err != nil {
+			return nil, err
+		}
+		suppliers = append(suppliers, s)
+	}
+
+	return suppliers, rows.Err()
+}
+
+// saveSupplierProduct links a product to a supplier, replacing the terms of
+// an existing link.
+func (sp *supplierProduct) saveSupplierProduct(db *sql.DB) error {
+	_, err := db.Exec(
+		`INSERT INTO supplier_products(supplier_id, product_id, supplier_sku, cost_price, lead_time_days)
+		VALUES($1, $2, $3, $4, $5)
+		ON CONFLICT (supplier_id, product_id) DO UPDATE
+		SET supplier_sku=EXCLUDED.supplier_sku, cost_price=EXCLUDED.cost_price, lead_time_days=EXCLUDED.lead_time_days`,
+		sp.SupplierID, sp.ProductID, sp.SupplierSKU, sp.CostPrice, sp.LeadTimeDays)
+
+	return err
+}
+
+func (sp *supplierProduct) deleteSupplierProduct(db *sql.DB) (bool, error) {
+	res, err := db.Exec("DELETE FROM supplier_products WHERE supplier_id=$1 AND product_id=$2",
+		sp.SupplierID, sp.ProductID)
+
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+
+	return affected > 0, err
+}
+
+// getSupplierProducts returns the supplier links filtered by the given
+// column, which must be either supplier_id or product_id.
+func getSupplierProducts(db *sql.DB, column string, id int) ([]supplierProduct, error) {
+	rows, err := db.Query(
+		"SELECT supplier_id, product_id, supplier_sku, cost_price, lead_time_days FROM supplier_products WHERE "+
+			column+"=$1 ORDER BY supplier_id, product_id", id)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []supplierProduct{}
+
+	for rows.Next() {
+		var sp supplierProduct
+		if err := rows.Scan(&sp.SupplierID, &sp.ProductID, &sp.SupplierSKU, &sp.CostPrice, &sp.LeadTimeDays); err != nil {
+			return nil, err
+		}
+		links = append(links, sp)
+	}
+
+	return links, rows.Err()
+}
+
+func getProductMargins(db *sql.DB) ([]productMargin, error) {
+	rows, err := db.Query(
+		`SELECT p.id, p.name, p.price, MIN(sp.cost_price), p.price - MIN(sp.cost_price)
+		FROM products p LEFT JOIN supplier_products sp ON sp.product_id = p.id
+		GROUP BY p.id, p.name, p.price
+		ORDER BY p.id`)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	margins := []productMargin{}
+
+	for rows.Next() {
+		var m productMargin
+		if err := rows.Scan(&m.ID, &m.Name, &m.Price, &m.Cost, &m.Margin); err != nil {
+			return nil, err
+		}
+		margins = append(margins, m)
+	}
+
+	return margins, rows.Err()
+}
+
+func (a *App) getSuppliers(w http.ResponseWriter, r *http.Request) {
+	suppliers, err := getSuppliers(a.db(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, suppliers)
+}
+
+func (a *App) getSupplier(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid supplier ID")
+		return
+	}
+
+	s := supplier{ID: id}
+	if err := s.getSupplier(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Supplier not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respond(w, http.StatusOK, s)
+}
+
+func (a *App) createSupplier(w http.ResponseWriter, r *http.Request) {
+	var s supplier
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&s); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if len(s.Name) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Supplier name is required")
+		return
+	}
+
+	if err := s.createSupplier(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusCreated, s)
+}
+
+func (a *App) updateSupplier(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid supplier ID")
+		return
+	}
+
+	var s supplier
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&s); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	s.ID = id
+
+	if len(s.Name) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Supplier name is required")
+		return
+	}
+
+	if err := s.updateSupplier(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Supplier not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respond(w, http.StatusOK, s)
+}
+
+func (a *App) deleteSupplier(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid supplier ID")
+		return
+	}
+
+	s := supplier{ID: id}
+	if err := s.deleteSupplier(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Supplier not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respond(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *App) getSupplierProducts(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid supplier ID")
+		return
+	}
+
+	links, err := getSupplierProducts(a.db(r), "supplier_id", id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, links)
+}
+
+func (a *App) getProductSuppliers(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	links, err := getSupplierProducts(a.db(r), "product_id", id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, links)
+}
+
+func (a *App) saveSupplierProduct(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid supplier ID")
+		return
+	}
+
+	var sp supplierProduct
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&sp); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	sp.SupplierID = id
+
+	if sp.CostPrice < 0 || sp.LeadTimeDays < 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid cost price or lead time")
+		return
+	}
+
+	s := supplier{ID: sp.SupplierID}
+	if err := s.getSupplier(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Supplier not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	p := product{ID: sp.ProductID}
+	if err := p.getProduct(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Product not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	if err := sp.saveSupplierProduct(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, sp)
+}
+
+func (a *App) deleteSupplierProduct(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid supplier ID")
+		return
+	}
+	productID, err := strconv.Atoi(vars["product_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	sp := supplierProduct{SupplierID: id, ProductID: productID}
+	deleted, err := sp.deleteSupplierProduct(a.db(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !deleted {
+		respondWithError(w, http.StatusNotFound, "Supplier product not found")
+		return
+	}
+
+	respond(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *App) getProductMargins(w http.ResponseWriter, r *http.Request) {
+	margins, err := getProductMargins(a.db(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, margins)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultTenantSlug = "default"
+
+	// tenantRole is the database role tenant connections switch to. It is
+	// not a superuser, so the row-level security policies apply to it.
+	tenantRole = "catalog_app"
+
+	tenantHeader = "X-Tenant"
+
+	// tenantMaxOpenConns caps the connections of each tenant's pool, so
+	// that the pools of all tenants stay within the max_connections of the
+	// database. Idle connections are closed after tenantConnMaxIdleTime, so
+	// the pools of inactive tenants hold none.
+	tenantMaxOpenConns    = 10
+	tenantConnMaxIdleTime = 5 * time.Minute
+
+	defaultTenantCacheTTL = 30 * time.Second
+)
+
+type tenantContextKey struct{}
+
+// tenant is a catalog hosted by this deployment. A MaxProducts of zero means
+// no limit; MaxPageSize caps the count parameter of list endpoints.
+type tenant struct {
+	ID          int                    `json:"id"`
+	Slug        string                 `json:"slug"`
+	Name        string                 `json:"name"`
+	MaxProducts int                    `json:"max_products"`
+	MaxPageSize int                    `json:"max_page_size"`
+	Settings    map[string]interface{} `json:"settings"`
+}
+
+var errInvalidTenantToken = errors.New("invalid tenant token")
+
+func (t *tenant) getTenantBySlug(db *sql.DB) error {
+	var settings []byte
+	err := db.QueryRow("SELECT id, name, max_products, max_page_size, settings FROM tenants WHERE slug=$1",
+		t.Slug).Scan(&t.ID, &t.Name, &t.MaxProducts, &t.MaxPageSize, &settings)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(settings, &t.Settings)
+}
+
+func (t *tenant) createTenant(db *sql.DB) error {
+	settings, err := json.Marshal(t.Settings)
+	if err != nil {
+		return err
+	}
+
+	return db.QueryRow(
+		"INSERT INTO tenants(slug, name, max_products, max_page_size, settings) VALUES($1, $2, $3, $4, $5) RETURNING id",
+		t.Slug, t.Name, t.MaxProducts, t.MaxPageSize, settings).Scan(&t.ID)
+}
+
+func (t *tenant) updateTenant(db *sql.DB) error {
+	settings, err := json.Marshal(t.Settings)
+	if err != nil {
+		return err
+	}
+
+	res, err := db.Exec("UPDATE tenants SET name=$1, max_products=$2, max_page_size=$3, settings=$4 WHERE id=$5",
+		t.Name, t.MaxProducts, t.MaxPageSize, settings, t.ID)
+	if err != nil {
+		return err
+	}
+
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return db.QueryRow("SELECT slug FROM tenants WHERE id=$1", t.ID).Scan(&t.Slug)
+}
+
+func getTenants(db *sql.DB) ([]tenant, error) {
+	rows, err := db.Query("SELECT id, slug, name, max_products, max_page_size, settings FROM tenants ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tenants := []tenant{}
+
+	for rows.Next() {
+		var t tenant
+		var settings []byte
+		if err := rows.Scan(&t.ID, &t.Slug, &t.Name, &t.MaxProducts, &t.MaxPageSize, &settings); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(settings, &t.Settings); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, t)
+	}
+
+	return tenants, rows.Err()
+}
+
+// tenantSlug identifies the tenant of a request from, in order of
+// precedence, the X-Tenant header, the tenant claim of a bearer token and
+// the subdomain below TenantBaseDomain. Requests without any of them belong
+// to the default tenant. The unauthenticated X-Tenant header is ignored once
+// TenantTokenSecret is set, so only verified tokens select a tenant.
+func (a *App) tenantSlug(r *http.Request) (string, error) {
+	if slug := r.Header.Get(tenantHeader); slug != "" && len(a.TenantTokenSecret) == 0 {
+		return slug, nil
+	}
+
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return a.tenantClaim(strings.TrimPrefix(auth, "Bearer "))
+	}
+
+	if a.TenantBaseDomain != "" {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if sub := strings.TrimSuffix(host, "."+a.TenantBaseDomain); sub != host && !strings.Contains(sub, ".") {
+			return sub, nil
+		}
+	}
+
+	return defaultTenantSlug, nil
+}
+
+// tenantClaim returns the tenant claim of an HS256-signed JWT, verified with
+// TenantTokenSecret.
+func (a *App) tenantClaim(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(a.TenantTokenSecret) == 0 || len(parts) != 3 {
+		return "", errInvalidTenantToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if data, err := base64.RawURLEncoding.DecodeString(parts[0]); err != nil || json.Unmarshal(data, &header) != nil || header.Alg != "HS256" {
+		return "", errInvalidTenantToken
+	}
+
+	mac := hmac.New(sha256.New, a.TenantTokenSecret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", errInvalidTenantToken
+	}
+
+	var claims struct {
+		Tenant string `json:"tenant"`
+	}
+	if data, err := base64.RawURLEncoding.DecodeString(parts[1]); err != nil || json.Unmarshal(data, &claims) != nil || claims.Tenant == "" {
+		return "", errInvalidTenantToken
+	}
+
+	return claims.Tenant, nil
+}
+
+// cachedTenant is a tenant read for the cache of tenantBySlug.
+type cachedTenant struct {
+	tenant  tenant
+	expires time.Time
+}
+
+// tenantBySlug returns the tenant with the given slug, from the cache if it
+// was read within TenantCacheTTL. Unknown slugs are not cached.
+func (a *App) tenantBySlug(slug string) (tenant, error) {
+	now := time.Now()
+
+	if a.TenantCacheTTL > 0 {
+		a.tenantCacheMu.Lock()
+		cached, ok := a.tenantCache[slug]
+		a.tenantCacheMu.Unlock()
+
+		if ok && now.Before(cached.expires) {
+			return cached.tenant, nil
+		}
+	}
+
+	t := tenant{Slug: slug}
+	if err := t.getTenantBySlug(a.DB); err != nil {
+		return t, err
+	}
+
+	if a.TenantCacheTTL > 0 {
+		a.tenantCacheMu.Lock()
+		a.tenantCache[slug] = cachedTenant{tenant: t, expires: now.Add(a.TenantCacheTTL)}
+		a.tenantCacheMu.Unlock()
+	}
+
+	return t, nil
+}
+
+// forgetTenant removes a changed tenant from the cache of tenantBySlug.
+func (a *App) forgetTenant(slug string) {
+	a.tenantCacheMu.Lock()
+	delete(a.tenantCache, slug)
+	a.tenantCacheMu.Unlock()
+}
+
+// identifyTenant is a middleware resolving the tenant of every request and
+// storing it in the request context.
+func (a *App) identifyTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slug, err := a.tenantSlug(r)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Invalid tenant token")
+			return
+		}
+
+		t, err := a.tenantBySlug(slug)
+		if err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				respondWithError(w, http.StatusNotFound, "Tenant not found")
+			default:
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, t)))
+	})
+}
+
+func tenantFromRequest(r *http.Request) tenant {
+	return tenantFromContext(r.Context())
+}
+
+func tenantFromContext(ctx context.Context) tenant {
+	t, _ := ctx.Value(tenantContextKey{}).(tenant)
+
+	return t
+}
+
+// db returns the connection pool of the request's tenant.
+func (a *App) db(r *http.Request) *sql.DB {
+	return a.tenantDB(tenantFromRequest(r).ID)
+}
+
+// tenantDB returns the connection pool of a tenant. Its connections run as
+// tenantRole with app.tenant_id set, so the row-level security policies
+// restrict them to the tenant's rows.
+func (a *App) tenantDB(id int) *sql.DB {
+	a.tenantMu.Lock()
+	defer a.tenantMu.Unlock()
+
+	if db, ok := a.tenantDBs[id]; ok {
+		return db
+	}
+
+	// sql.Open only validates its arguments, the connection string was
+	// already accepted by Initialize
+	db, _ := sql.Open("postgres", fmt.Sprintf("%s options='-c role=%s -c app.tenant_id=%d'", a.connectionString, tenantRole, id))
+	db.SetMaxOpenConns(tenantMaxOpenConns)
+	db.SetMaxIdleConns(2)
+	db.SetConnMaxIdleTime(tenantConnMaxIdleTime)
+	a.tenantDBs[id] = db
+
+	return db
+}
+
+// pageSize clamps the requested page size to the tenant's limit.
+func (t tenant) pageSize(count int) int {
+	if count > t.MaxPageSize || count < 1 {
+		return t.MaxPageSize
+	}
+
+	return count
+}
+
+func (a *App) getCurrentTenant(w http.ResponseWriter, r *http.Request) {
+	respond(w, http.StatusOK, tenantFromRequest(r))
+}
+
+func (a *App) getTenants(w http.ResponseWriter, r *http.Request) {
+	tenants, err := getTenants(a.DB)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, tenants)
+}
+
+func (a *App) createTenant(w http.ResponseWriter, r *http.Request) {
+	t := tenant{MaxPageSize: 10}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if len(t.Slug) == 0 || strings.ContainsAny(t.Slug, ". ") {
+		respondWithError(w, http.StatusBadRequest, "Invalid tenant slug")
+		return
+	}
+	if t.MaxProducts < 0 || t.MaxPageSize < 1 {
+		respondWithError(w, http.StatusBadRequest, "Invalid tenant limits")
+		return
+	}
+	if t.Settings == nil {
+		t.Settings = map[string]interface{}{}
+	}
+
+	if err := t.createTenant(a.DB); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusCreated, t)
+}
+
+func (a *App) updateTenant(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid tenant ID")
+		return
+	}
+
+	t := tenant{MaxPageSize: 10}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&t); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+	t.ID = id
+
+	if t.MaxProducts < 0 || t.MaxPageSize < 1 {
+		respondWithError(w, http.StatusBadRequest, "Invalid tenant limits")
+		return
+	}
+	if t.Settings == nil {
+		t.Settings = map[string]interface{}{}
+	}
+
+	if err := t.updateTenant(a.DB); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Tenant not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	a.forgetTenant(t.Slug)
+
+	respond(w, http.StatusOK, t)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves the certificate in a pair of files, loading it again
+// when one of them changes so rotated certificates are picked up without a
+// restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.certificate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// certificate returns the certificate, reloaded if the files changed. The
+// previous certificate is kept while the files are being replaced.
+func (c *certReloader) certificate() (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var modTimes [2]time.Time
+	for i, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			if c.cert != nil {
+				return c.cert, nil
+			}
+			return nil, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	if c.cert != nil && modTimes == c.modTimes {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	c.cert, c.modTimes = &cert, modTimes
+
+	return c.cert, nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.certificate()
+}
+
+// loadCertPool reads the PEM certificates of a file into a pool.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates in " + path)
+	}
+
+	return pool, nil
+}
+
+// loadClientIdentities reads the identities of client certificates from a
+// JSON object keyed like ClientIdentities.
+func loadClientIdentities(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var identities map[string]string
+	if err := json.Unmarshal(data, &identities); err != nil {
+		return nil, err
+	}
+
+	return identities, nil
+}
+
+// tlsConfig returns the TLS configuration of the server, or nil if
+// TLSCertFile is not set.
+func (a *App) tlsConfig() (*tls.Config, error) {
+	if a.TLSCertFile == "" {
+		return nil, nil
+	}
+
+	reloader, err := newCertReloader(a.TLSCertFile, a.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+	}
+
+	if a.TLSClientCAFile != "" {
+		if config.ClientCAs, err = loadCertPool(a.TLSClientCAFile); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if a.TLSRequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return config, nil
+}
+
+// NewRedirectServer returns a server on addr redirecting every request to
+// the HTTPS server on httpsAddr.
+func (a *App) NewRedirectServer(addr, httpsAddr string) *http.Server {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+
+	return &http.Server{Addr: addr, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})}
+}
+
+type clientIdentityKey struct{}
+
+// certificateKeys returns the keys of a client certificate in
+// ClientIdentities, by precedence: its SHA-256 fingerprint and its common
+// name.
+func certificateKeys(cert *x509.Certificate) []string {
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	return []string{"sha256:" + hex.EncodeToString(fingerprint[:]), cert.Subject.CommonName}
+}
+
+// identifyClient is a middleware mapping the verified client certificate of
+// a request to its identity in ClientIdentities, or to its common name if
+// there are none. Certificates without an identity are refused.
+func (a *App) identifyClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cert := r.TLS.VerifiedChains[0][0]
+		identity := cert.Subject.CommonName
+		if a.ClientIdentities != nil {
+			identity = ""
+			for _, key := range certificateKeys(cert) {
+				if id, ok := a.ClientIdentities[key]; ok {
+					identity = id
+					break
+				}
+			}
+		}
+		if identity == "" {
+			respondWithError(w, http.StatusForbidden, "Unknown client certificate")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIdentityKey{}, identity)))
+	})
+}
+
+// clientIdentity returns the identity of the client certificate of a
+// request, or "" if it has none.
+func clientIdentity(r *http.Request) string {
+	identity, _ := r.Context().Value(clientIdentityKey{}).(string)
+
+	return identity
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// apiVersionHeader selects the version of unversioned paths, which default
+// to version 1. Paths under /v1 and /v2 ignore it.
+const apiVersionHeader = "API-Version"
+
+// latestAPIVersion is the highest version served.
+const latestAPIVersion = 2
+
+// deprecation announces the end of a version or of one of its routes with
+// the Deprecation, Sunset and Link headers. Zero times are not sent; the
+// link defaults to the same path in the latest version.
+type deprecation struct {
+	Deprecated time.Time `json:"deprecated"`
+	Sunset     time.Time `json:"sunset"`
+	Link       string    `json:"link"`
+}
+
+// loadDeprecations reads the deprecations of versions and routes from a JSON
+// object keyed like deprecationKey, e.g. "v1" or "v1 GET /products".
+func loadDeprecations(path string) (map[string]deprecation, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var deprecations map[string]deprecation
+	if err := json.Unmarshal(data, &deprecations); err != nil {
+		return nil, err
+	}
+
+	return deprecations, nil
+}
+
+// splitAPIVersion splits a path template into its version prefix, 0 for
+// unversioned paths, and the path within the version.
+func splitAPIVersion(template string) (int, string) {
+	for v := 1; v <= latestAPIVersion; v++ {
+		prefix := "/v" + strconv.Itoa(v)
+		if strings.HasPrefix(template, prefix+"/") {
+			return v, strings.TrimPrefix(template, prefix)
+		}
+	}
+
+	return 0, template
+}
+
+// requestAPIVersion returns the API version of a request: the prefix of its
+// path, or the API-Version header for unversioned paths.
+func requestAPIVersion(r *http.Request) int {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			if v, _ := splitAPIVersion(template); v != 0 {
+				return v
+			}
+		}
+	}
+
+	if v, err := strconv.Atoi(r.Header.Get(apiVersionHeader)); err == nil && v >= 1 && v <= latestAPIVersion {
+		return v
+	}
+
+	return 1
+}
+
+// deprecationKey returns the key of a route of a version in Deprecations,
+// like "v1 GET /products".
+func deprecationKey(version int, method, template string) string {
+	_, path := splitAPIVersion(template)
+	path, _ = apiPath(path)
+
+	return "v" + strconv.Itoa(version) + " " + apiRouteKey(method, path)
+}
+
+// apiVersion is the middleware of the routes of a version. It rejects
+// unsupported values of the API-Version header, reports the version of the
+// response and announces its deprecation.
+func (a *App) apiVersion(version int) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			template, _ := mux.CurrentRoute(r).GetPathTemplate()
+			prefix, _ := splitAPIVersion(template)
+
+			if prefix == 0 {
+				w.Header().Add("Vary", apiVersionHeader)
+
+				if h := r.Header.Get(apiVersionHeader); h != "" && h != strconv.Itoa(version) {
+					respondWithError(w, http.StatusBadRequest, "Unsupported API version")
+					return
+				}
+			}
+
+			w.Header().Set(apiVersionHeader, strconv.Itoa(version))
+
+			d, ok := a.Deprecations[deprecationKey(version, r.Method, template)]
+			if !ok {
+				d, ok = a.Deprecations["v"+strconv.Itoa(version)]
+			}
+			if ok {
+				if !d.Deprecated.IsZero() {
+					w.Header().Set("Deprecation", "@"+strconv.FormatInt(d.Deprecated.Unix(), 10))
+				}
+				if !d.Sunset.IsZero() {
+					w.Header().Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+				}
+
+				link := d.Link
+				if link == "" && version < latestAPIVersion {
+					path := r.URL.Path
+					if prefix != 0 {
+						_, path = splitAPIVersion(path)
+					}
+					link = "/v" + strconv.Itoa(latestAPIVersion) + path
+				}
+				if link != "" {
+					w.Header().Add("Link", "<"+link+`>; rel="successor-version"`)
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// apiList is the shape of list responses from version 2 on, which leaves
+// room for metadata next to the items.
+type apiList struct {
+	Data interface{} `json:"data"`
+	Meta apiListMeta `json:"meta"`
+}
+
+// apiListMeta describes the page of items in an apiList. PageSize is the
+// number of items of this page, not the total of the list.
+type apiListMeta struct {
+	PageSize int `json:"page_size"`
+}
+
+// envelopeList wraps a list payload in an apiList. Other payloads are
+// returned as they are.
+func envelopeList(payload interface{}) interface{} {
+	v := reflect.ValueOf(payload)
+	if v.Kind() != reflect.Slice {
+		return payload
+	}
+	if v.IsNil() {
+		payload = reflect.MakeSlice(v.Type(), 0, 0).Interface()
+	}
+
+	return apiList{Data: payload, Meta: apiListMeta{PageSize: v.Len()}}
+}
+
+// unwrapList returns the items of an apiList, for media types with their
+// own representation of lists.
+func unwrapList(payload interface{}) interface{} {
+	if l, ok := payload.(apiList); ok {
+		return l.Data
+	}
+
+	return payload
+}
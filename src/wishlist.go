@@ -0,0 +1,320 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type wishlistItem struct {
+	Customer  string    `json:"customer"`
+	ProductID int       `json:"product_id"`
+	Name      string    `json:"name"`
+	Price     float64   `json:"price"`
+	AddedAt   time.Time `json:"added_at"`
+}
+
+// priceWatch asks for a notification through Channel to Address once the
+// product's price drops to TargetPrice or below. A watch fires only once.
+type priceWatch struct {
+	ID          int        `json:"id"`
+	Customer    string     `json:"customer"`
+	ProductID   int        `json:"product_id"`
+	TargetPrice float64    `json:"target_price"`
+	Channel     string     `json:"channel"`
+	Address     string     `json:"address"`
+	TriggeredAt *time.Time `json:"triggered_at"`
+}
+
+func getWishlist(db *sql.DB, customer string) ([]wishlistItem, error) {
+	rows, err := db.Query(
+		`SELECT w.customer, w.product_id, p.name, p.price, w.added_at
+		FROM wishlist_items w JOIN products p ON p.id = w.product_id
+		WHERE w.customer=$1 ORDER BY w.added_at, w.product_id`, customer)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []wishlistItem{}
+
+	for rows.Next() {
+		var item wishlistItem
+		if err := rows.Scan(&item.Customer, &item.ProductID, &item.Name, &item.Price, &item.AddedAt); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+func (item *wishlistItem) addWishlistItem(db *sql.DB) error {
+	_, err := db.Exec(
+		"INSERT INTO wishlist_items(customer, product_id) VALUES($1, $2) ON CONFLICT DO NOTHING",
+		item.Customer, item.ProductID)
+
+	return err
+}
+
+func (item *wishlistItem) deleteWishlistItem(db *sql.DB) error {
+	res, err := db.Exec("DELETE FROM wishlist_items WHERE customer=$1 AND product_id=$2",
+		item.Customer, item.ProductID)
+	if err != nil {
+		return err
+	}
+
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (pw *priceWatch) createPriceWatch(db *sql.DB) error {
+	return db.QueryRow(
+		"INSERT INTO price_watches(customer, product_id, target_price, channel, address) VALUES($1, $2, $3, $4, $5) RETURNING id",
+		pw.Customer, pw.ProductID, pw.TargetPrice, pw.Channel, pw.Address).Scan(&pw.ID)
+}
+
+func (pw *priceWatch) deletePriceWatch(db *sql.DB) error {
+	res, err := db.Exec("DELETE FROM price_watches WHERE id=$1", pw.ID)
+	if err != nil {
+		return err
+	}
+
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func getPriceWatches(db *sql.DB, customer string) ([]priceWatch, error) {
+	rows, err := db.Query(
+		"SELECT id, customer, product_id, target_price, channel, address, triggered_at FROM price_watches WHERE customer=$1 ORDER BY id",
+		customer)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	watches := []priceWatch{}
+
+	for rows.Next() {
+		var pw priceWatch
+		if err := rows.Scan(&pw.ID, &pw.Customer, &pw.ProductID, &pw.TargetPrice, &pw.Channel, &pw.Address, &pw.TriggeredAt); err != nil {
+			return nil, err
+		}
+		watches = append(watches, pw)
+	}
+
+	return watches, rows.Err()
+}
+
+// triggerPriceWatches marks every untriggered watch on the product whose
+// target is at or above price as triggered and returns them.
+func triggerPriceWatches(db *sql.DB, productID int, price float64) ([]priceWatch, error) {
+	rows, err := db.Query(
+		`UPDATE price_watches SET triggered_at=now()
+		WHERE product_id=$1 AND target_price >= $2 AND triggered_at IS NULL
+		RETURNING id, customer, product_id, target_price, channel, address, triggered_at`,
+		productID, price)
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var watches []priceWatch
+
+	for rows.Next() {
+		var pw priceWatch
+		if err := rows.Scan(&pw.ID, &pw.Customer, &pw.ProductID, &pw.TargetPrice, &pw.Channel, &pw.Address, &pw.TriggeredAt); err != nil {
+			return nil, err
+		}
+		watches = append(watches, pw)
+	}
+
+	return watches, rows.Err()
+}
+
+func (a *App) getWishlist(w http.ResponseWriter, r *http.Request) {
+	items, err := getWishlist(a.db(r), mux.Vars(r)["customer"])
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, items)
+}
+
+func (a *App) addWishlistItem(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	productID, err := strconv.Atoi(vars["product_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	p := product{ID: productID}
+	if err := p.getProduct(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Product not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	item := wishlistItem{Customer: vars["customer"], ProductID: productID}
+	if err := item.addWishlistItem(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (a *App) deleteWishlistItem(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	productID, err := strconv.Atoi(vars["product_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid product ID")
+		return
+	}
+
+	item := wishlistItem{Customer: vars["customer"], ProductID: productID}
+	if err := item.deleteWishlistItem(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Wishlist item not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respond(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// getPriceWatches lists the watches of a customer with their addresses.
+// Customers are not authenticated, so like deletePriceWatch it is only
+// routed for admins.
+func (a *App) getPriceWatches(w http.ResponseWriter, r *http.Request) {
+	customer := r.FormValue("customer")
+	if len(customer) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Customer is required")
+		return
+	}
+
+	watches, err := getPriceWatches(a.db(r), customer)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusOK, watches)
+}
+
+func (a *App) createPriceWatch(w http.ResponseWriter, r *http.Request) {
+	var pw priceWatch
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&pw); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	defer r.Body.Close()
+
+	if pw.Channel == "" {
+		pw.Channel = "log"
+	}
+
+	if len(pw.Customer) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Customer is required")
+		return
+	}
+	if pw.TargetPrice <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Target price must be positive")
+		return
+	}
+	if err := validateWatchAddress(r.Context(), pw.Channel, pw.Address); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, ok := a.Notifiers[pw.Channel]; !ok {
+		respondWithError(w, http.StatusBadRequest, "Unsupported notification channel")
+		return
+	}
+
+	p := product{ID: pw.ProductID}
+	if err := p.getProduct(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Product not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	if err := pw.createPriceWatch(a.db(r)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respond(w, http.StatusCreated, pw)
+}
+
+func (a *App) deletePriceWatch(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid price watch ID")
+		return
+	}
+
+	pw := priceWatch{ID: id}
+	if err := pw.deletePriceWatch(a.db(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Price watch not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respond(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// evaluatePriceWatches triggers the watches satisfied by the product's new
+// price and delivers their notifications in the background.
+func (a *App) evaluatePriceWatches(db *sql.DB, p product) error {
+	watches, err := triggerPriceWatches(db, p.ID, p.Price)
+	if err != nil {
+		return err
+	}
+
+	for _, pw := range watches {
+		n, ok := a.Notifiers[pw.Channel]
+		if !ok {
+			continue
+		}
+		alert := priceAlert{Watch: pw, ProductName: p.Name, Price: p.Price}
+		go func() {
+			if err := n.notify(alert); err != nil {
+				log.Printf("price watch %d: %v", alert.Watch.ID, err)
+			}
+		}()
+	}
+
+	return nil
+}